@@ -1,15 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -25,8 +29,107 @@ What does cc do:
 	- Get CPU Utilizations from host agents
 	- Solve the optimization problem by connection to Gurobi Optimizer
 	- Send the CPU shares to the host agents to be applied
+
+Coordination with the central controller:
+	the central controller routes traffic on the slow timescale (once a
+	round, every INTERVAL_MS); cc sets CPU shares on the fast one (every
+	CC_INTERVAL_MS, which should be several times shorter)
+	every iteration cc reads the load each pod is projected to get from the
+	controller's latest assignments, and sizes each app for at least
+	CPU_PER_REQUEST * its projected load, so that it doesn't shrink the
+	shares of an app the controller is sending more traffic to
+	CPU_PER_REQUEST (the CPU utilisation one request of projected load takes)
+	depends on the apps, so it has no default and must be set
+	the shares applied are reported back to the controller, which routes
+	less traffic to pods that have less than their fair part of their host
 */
 
+type CoordinationState struct {
+	Round          int                `json:"round"`
+	IntervalMs     int64              `json:"intervalMs"`
+	ProjectedLoads map[string]float64 `json:"projectedLoads"`
+}
+
+func getEnvFloat(name string, defaultValue float64) float64 {
+	valueStr := os.Getenv(name)
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := strconv.ParseFloat(valueStr, 64)
+	check(err)
+	return value
+}
+
+func getEnvString(name string, defaultValue string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+func getCPUPerRequest() float64 {
+	if os.Getenv("CPU_PER_REQUEST") == "" {
+		panic("CPU_PER_REQUEST must be set to the CPU utilisation one request takes")
+	}
+	cpuPerRequest := getEnvFloat("CPU_PER_REQUEST", 0)
+	if !(cpuPerRequest > 0) {
+		panic(fmt.Sprintf("CPU_PER_REQUEST must be positive, got %f", cpuPerRequest))
+	}
+	return cpuPerRequest
+}
+
+var coordinationClient = &http.Client{Timeout: 500 * time.Millisecond}
+
+func getCoordinationState(controllerURL string) (CoordinationState, error) {
+	var state CoordinationState
+
+	res, err := coordinationClient.Get(controllerURL + "/coordination")
+	if err != nil {
+		return state, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return state, fmt.Errorf("controller returned status %d", res.StatusCode)
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&state)
+	return state, err
+}
+
+func reportCPUShares(controllerURL string, nodeCPUShares []string) error {
+
+	// example nodeCPUShares entry to parse: "app1-node1:0.500000 app3-node1:0.500000"
+	podShares := make(map[string]float64)
+	for _, cpuShares := range nodeCPUShares {
+		for _, podSharesStr := range strings.Split(cpuShares, " ") {
+			shares := strings.Split(podSharesStr, ":")
+			if len(shares) != 2 {
+				continue
+			}
+			podShare, err := strconv.ParseFloat(shares[1], 64)
+			if err != nil {
+				return err
+			}
+			podShares[shares[0]] = podShare
+		}
+	}
+
+	body, err := json.Marshal(podShares)
+	if err != nil {
+		return err
+	}
+	res, err := coordinationClient.Post(controllerURL+"/coordination/shares", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("controller returned status %d", res.StatusCode)
+	}
+	return nil
+}
+
 type Node struct {
 	IP   string
 	Pods map[string]string
@@ -106,11 +209,17 @@ func main() {
 		}
 	}
 
-	// Repeat the following:
+	controllerURL := getEnvString("CONTROLLER_URL", "http://10.101.101.101:3000")
+	interval := time.Duration(getEnvFloat("CC_INTERVAL_MS", 250)) * time.Millisecond
+	cpuPerRequest := getCPUPerRequest()
+
+	// Repeat the following (every interval):
 	// - Get CPU Utilizations from host agents
+	// - Get the projected pod loads from the central controller
 	// - Solve the optimization problem by connection to Gurobi Optimizer
 	// - Send the CPU shares to the host agents to be applied
-	for {
+	// - Report the CPU shares to the central controller
+	for range time.Tick(interval) {
 
 		// - Get CPU Utilizations from host agents
 		cpuUtilizationCh := make(chan CPUUtil)
@@ -129,8 +238,17 @@ func main() {
 				cpuUtil.Node, cpuUtil.CPUUtilizations))
 		}
 
+		// - Get the projected pod loads from the central controller
+		coordination, err := getCoordinationState(controllerURL)
+		if err != nil {
+			slog.Warn("Couldn't get projected loads from the central controller: " + err.Error())
+		} else if time.Duration(coordination.IntervalMs)*time.Millisecond < 2*interval {
+			slog.Warn(fmt.Sprintf("Routing interval (%dms) is not much slower than ours (%s), the controllers may fight",
+				coordination.IntervalMs, interval))
+		}
+
 		// - Solve the optimization problem by connection to Gurobi Optimizer
-		nodeCPUShares := getOptimalCPUShares(nodeCPUUtilizations)
+		nodeCPUShares := getOptimalCPUShares(nodeCPUUtilizations, coordination.ProjectedLoads, cpuPerRequest)
 
 		// - Send the CPU shares to the host agents to be applied
 		if nodeCPUShares == nil {
@@ -143,15 +261,28 @@ func main() {
 					slog.Warn("Failed to apply CPU shares on node: " + node.IP)
 				}
 			}
+
+			// - Report the CPU shares to the central controller
+			if err := reportCPUShares(controllerURL, nodeCPUShares); err != nil {
+				slog.Warn("Couldn't report CPU shares to the central controller: " + err.Error())
+			}
 		}
 	}
 }
 
-func getOptimalCPUShares(nodeCPUUtilizations []string) []string {
+func getOptimalCPUShares(
+	nodeCPUUtilizations []string,
+	projectedPodLoads map[string]float64,
+	cpuPerRequest float64) []string {
 
 	// parse cpu utilizations
 	appUtils := getPerAppUtilizations(nodeCPUUtilizations)
 
+	// size every app for at least the load the controller is sending it
+	for appNum, projectedUtil := range getProjectedAppUtilizations(projectedPodLoads, cpuPerRequest) {
+		appUtils[appNum] = math.Max(appUtils[appNum], projectedUtil)
+	}
+
 	// get weights from gurobi
 	gurobiResponse := getWeightsFromGurobi(200.0, appUtils)
 
@@ -179,8 +310,7 @@ func getPerAppUtilizations(nodeCPUUtilizations []string) map[int]float64 {
 
 			util := strings.Split(cpuUtilStr, ":")
 
-			appNumStr := (util[0][3:4])
-			appNum, err := strconv.Atoi(appNumStr)
+			appNum, err := getAppNum(util[0])
 			check(err)
 
 			podUtil, err := strconv.ParseFloat(util[1], 64)
@@ -193,6 +323,30 @@ func getPerAppUtilizations(nodeCPUUtilizations []string) map[int]float64 {
 	return appUtils
 }
 
+// getAppNum returns the number of the app of a pod named like "app12-node1"
+func getAppNum(podname string) (int, error) {
+	appName, _, _ := strings.Cut(podname, "-")
+	if !strings.HasPrefix(appName, "app") {
+		return 0, fmt.Errorf("pod %s is not named app<number>-<node>", podname)
+	}
+	return strconv.Atoi(strings.TrimPrefix(appName, "app"))
+}
+
+func getProjectedAppUtilizations(projectedPodLoads map[string]float64, cpuPerRequest float64) map[int]float64 {
+
+	appUtils := make(map[int]float64)
+	for podname, load := range projectedPodLoads {
+
+		appNum, err := getAppNum(podname)
+		if err != nil {
+			continue
+		}
+
+		appUtils[appNum] += cpuPerRequest * load
+	}
+	return appUtils
+}
+
 type GurobiResponse struct {
 	Status    int     `json:"status"`
 	App1Node1 float64 `json:"t00"`
@@ -1,3 +1,4 @@
+import json
 import requests
 import redis
 import time
@@ -9,6 +10,82 @@ OUTSTANDING_REQUESTS_KEY = 'outstanding_requests'
 print("Starting central controller updater")
 
 
+# The report ({"podname", "k", "a"}) goes to the central controller through
+# the transport in REPORT_TRANSPORT, as in the go servers:
+#   - "http_query":   GET with the report as query parameters (default)
+#   - "http_json":    POST with the report as JSON body
+#   - "redis_stream": XADD to REPORT_STREAM (default "pod_reports") of the
+#                     Redis REPORT_STREAM_ADDR (host:port), in the field "report"
+#   - "nats":         publish on REPORT_NATS_SUBJECT (default "pod_reports") of
+#                     REPORT_NATS_URL (default nats://localhost:4222)
+class HTTPReportSink:
+    def __init__(self, cc_url, as_json):
+        self.cc_url = cc_url
+        self.as_json = as_json
+
+    def send(self, report):
+        try:
+            if self.as_json:
+                requests.post(self.cc_url, headers={"Connection": "close"}, json=report, timeout=0.75)
+            else:
+                requests.get(self.cc_url, headers={"Connection": "close"}, params=report, timeout=0.75)
+        except requests.exceptions.Timeout:
+            print("The request timed out")
+        except requests.exceptions.RequestException as e:
+            print("An error occurred:", e)
+
+
+class RedisStreamReportSink:
+    def __init__(self, addr, stream, max_len):
+        host, port = addr.rsplit(':', 1)
+        self.redis = redis.Redis(host=host, port=int(port), db=0, socket_timeout=0.75)
+        self.stream = stream
+        self.max_len = max_len
+
+    def send(self, report):
+        try:
+            self.redis.xadd(self.stream, {'report': json.dumps(report)}, maxlen=self.max_len, approximate=True)
+        except redis.exceptions.RedisError as e:
+            print("Could not add report to stream", self.stream, ":", e)
+
+
+class NATSReportSink:
+    # nats-py is asyncio only, so the connection lives in a loop of its own
+    def __init__(self, url, subject):
+        import asyncio
+        import nats
+
+        self.subject = subject
+        self.loop = asyncio.new_event_loop()
+        threading.Thread(target=self.loop.run_forever, daemon=True).start()
+        self.conn = asyncio.run_coroutine_threadsafe(nats.connect(url, max_reconnect_attempts=-1), self.loop).result()
+
+    def send(self, report):
+        import asyncio
+
+        future = asyncio.run_coroutine_threadsafe(self.conn.publish(self.subject, json.dumps(report).encode()), self.loop)
+        try:
+            future.result(timeout=0.75)
+        except Exception as e:
+            print("Could not publish report on", self.subject, ":", e)
+
+
+def get_report_sink(cc_url):
+    transport = os.environ.get('REPORT_TRANSPORT') or 'http_query'
+    if transport == 'http_query':
+        return HTTPReportSink(cc_url, False)
+    if transport == 'http_json':
+        return HTTPReportSink(cc_url, True)
+    if transport == 'redis_stream':
+        return RedisStreamReportSink(os.environ['REPORT_STREAM_ADDR'],
+                                     os.environ.get('REPORT_STREAM') or 'pod_reports',
+                                     int(os.environ.get('REPORT_STREAM_MAXLEN') or 10000))
+    if transport == 'nats':
+        return NATSReportSink(os.environ.get('REPORT_NATS_URL') or 'nats://localhost:4222',
+                              os.environ.get('REPORT_NATS_SUBJECT') or 'pod_reports')
+    raise ValueError("invalid REPORT_TRANSPORT " + transport + " (must be http_query, http_json, redis_stream or nats)")
+
+
 class CentralControllerUpdater:
     def __init__(self, wait_interval_seconds, outstanding_request_key):
         cc_ip = '10.101.101.101'
@@ -21,6 +98,7 @@ class CentralControllerUpdater:
 
         self.wait_interval_seconds = wait_interval_seconds
         self.outstanding_request_key = outstanding_request_key
+        self.report_sink = get_report_sink(self.cc_url)
 
     @staticmethod
     def get_redis():
@@ -74,12 +152,7 @@ class CentralControllerUpdater:
         outstanding_requests = self.get_outstanding_requests()
         print("outstanding requests:", outstanding_requests)
 
-        try:
-            requests.get(self.cc_url, headers={"Connection": "close"}, params={'podname': platform.node(), 'k': int(time.time()), 'a': outstanding_requests}, timeout=0.75)
-        except requests.exceptions.Timeout:
-            print("The request timed out")
-        except requests.exceptions.RequestException as e:
-            print("An error occurred:", e)
+        self.report_sink.send({'podname': platform.node(), 'k': int(time.time()), 'a': outstanding_requests})
 
     def get_outstanding_requests(self):
 
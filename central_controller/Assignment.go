@@ -0,0 +1,97 @@
+package main
+
+import "log"
+
+// Assignment is what an LB is told to do: spread its traffic over the
+// endpoints of all of its pods on the chosen host, or split it over its
+// endpoints by weight.
+// Versions only grow; an LB ignores an assignment older than the one it has.
+type Assignment struct {
+	LB        string    `json:"lb"`
+	Version   int64     `json:"version"`
+	Host      string    `json:"host"`
+	Endpoints []string  `json:"endpoints"`
+	Weights   []float64 `json:"weights,omitempty"`
+}
+
+func (a Assignment) hasSameTarget(b Assignment) bool {
+	if a.Host != b.Host || len(a.Endpoints) != len(b.Endpoints) || len(a.Weights) != len(b.Weights) {
+		return false
+	}
+	for i := range a.Endpoints {
+		if a.Endpoints[i] != b.Endpoints[i] {
+			return false
+		}
+	}
+	for i := range a.Weights {
+		if a.Weights[i] != b.Weights[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// getAssignments turns the optimal host of every LB (or the split of its
+// traffic, if the splitter is weighted) into an assignment. An assignment
+// keeps its version while its target does not change, and gets the round as
+// its new version (at least one more than the old one) when it does, so
+// versions keep growing across restarts and leader changes as long as the
+// round does.
+func getAssignments(
+	round int,
+	LBs map[string]LBProps,
+	pods map[string]PodProps,
+	optimalHostsForLBs map[string]string,
+	pricesForLBs map[string]map[string]float64,
+	health *HealthTracker,
+	splitter *TrafficSplitter,
+	oldAssignments map[string]Assignment) map[string]Assignment {
+
+	assignments := make(map[string]Assignment)
+
+	for lbName, LB := range LBs {
+		optimalHost := optimalHostsForLBs[lbName]
+		if optimalHost == "" {
+			continue
+		}
+
+		assignment := Assignment{
+			LB:   lbName,
+			Host: optimalHost,
+		}
+
+		if splitter.IsWeighted() {
+			assignment.Endpoints, assignment.Weights = splitter.GetSplit(LB, pods, pricesForLBs[lbName], health)
+			if len(assignment.Endpoints) == 0 {
+				log.Printf("Error: LB %s has no healthy pod on a priced host\n", lbName)
+				continue
+			}
+		} else {
+			podIPs, err := getPodIPsOnGivenHost(optimalHost, LB, pods, health)
+			if err != nil {
+				log.Printf("Error: %s\n", err)
+				continue
+			}
+			assignment.Endpoints = podIPs
+		}
+
+		oldAssignment, ok := oldAssignments[lbName]
+		if ok && splitter.IsWeighted() && splitter.hasSimilarSplit(oldAssignment, assignment.Endpoints, assignment.Weights) {
+			// not worth telling the LB
+			assignments[lbName] = oldAssignment
+			continue
+		}
+		if ok && oldAssignment.hasSameTarget(assignment) {
+			assignment.Version = oldAssignment.Version
+		} else {
+			assignment.Version = int64(round)
+			if ok && assignment.Version <= oldAssignment.Version {
+				assignment.Version = oldAssignment.Version + 1
+			}
+		}
+
+		assignments[lbName] = assignment
+	}
+
+	return assignments
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Assignment delivery:
+	every LB has its own delivery worker, so a slow or dead LB never holds up
+	the control loop or the other LBs
+	the control loop publishes the latest assignment of every LB each round;
+	a worker only keeps the latest one (older ones it has not sent yet are
+	dropped) and sends it as
+		GET http://<LB>/?endpoints=<ip>,<ip>&version=<version>[&weights=<w>,<w>]
+	with a timeout, retrying with exponential backoff up to maxAttempts times
+	an LB acknowledges an assignment by responding 200 with the version in the
+	X-Assignment-Version header (LBs that don't send the header are taken to
+	have accepted it), and rejects one older than what it has with 409 and
+	its own version in the header, after which the assignment is re-sent with
+	a newer version
+	an assignment that has not been acknowledged is sent again the next round,
+	and acknowledged ones are re-sent every resync interval in case the LB
+	restarted
+
+Delivery API:
+	GET /deliveries    delivery status of every LB
+*/
+
+var errStaleAssignment = errors.New("LB has a newer assignment")
+
+type LBDeliveryStatus struct {
+	Address      string     `json:"address"`
+	Assignment   Assignment `json:"assignment"`
+	AckedVersion int64      `json:"ackedVersion"`
+	Attempts     int        `json:"attempts"`
+	LastError    string     `json:"lastError,omitempty"`
+	LastAttempt  time.Time  `json:"lastAttempt,omitempty"`
+	LastAck      time.Time  `json:"lastAck,omitempty"`
+}
+
+type lbDelivery struct {
+	LBDeliveryStatus
+	needsResync bool
+	chWake      chan struct{}
+	chStop      chan struct{}
+}
+
+type AssignmentDelivery struct {
+	mu  sync.Mutex
+	lbs map[string]*lbDelivery
+
+	client         *http.Client
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	resyncInterval time.Duration
+}
+
+func NewAssignmentDelivery(
+	timeout time.Duration,
+	maxAttempts int,
+	initialBackoff time.Duration,
+	maxBackoff time.Duration,
+	resyncInterval time.Duration) *AssignmentDelivery {
+
+	return &AssignmentDelivery{
+		lbs: make(map[string]*lbDelivery),
+		client: &http.Client{
+			Timeout: timeout,
+		},
+		maxAttempts:    maxAttempts,
+		initialBackoff: initialBackoff,
+		maxBackoff:     maxBackoff,
+		resyncInterval: resyncInterval,
+	}
+}
+
+// Publish hands the latest assignments to the workers of the LBs (starting
+// workers for new LBs and stopping the ones of removed LBs) without waiting
+// for them to be delivered
+func (d *AssignmentDelivery) Publish(LBs map[string]LBProps, assignments map[string]Assignment) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for lbName, delivery := range d.lbs {
+		if _, ok := LBs[lbName]; !ok {
+			close(delivery.chStop)
+			delete(d.lbs, lbName)
+		}
+	}
+
+	for lbName, assignment := range assignments {
+		delivery, ok := d.lbs[lbName]
+		if !ok {
+			delivery = &lbDelivery{
+				chWake: make(chan struct{}, 1),
+				chStop: make(chan struct{}),
+			}
+			d.lbs[lbName] = delivery
+			go d.runWorker(lbName, delivery)
+		}
+
+		delivery.Address = getLBControlAddress(LBs[lbName])
+
+		// the version we send may have been bumped past the LB's version
+		if !delivery.Assignment.hasSameTarget(assignment) || assignment.Version > delivery.Assignment.Version {
+			if assignment.Version <= delivery.Assignment.Version {
+				assignment.Version = delivery.Assignment.Version + 1
+			}
+			delivery.Assignment = assignment
+			delivery.Attempts = 0
+		}
+
+		if delivery.AckedVersion == delivery.Assignment.Version && time.Since(delivery.LastAck) < d.resyncInterval {
+			continue
+		}
+		if delivery.AckedVersion == delivery.Assignment.Version {
+			delivery.needsResync = true
+		}
+
+		select {
+		case delivery.chWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (d *AssignmentDelivery) runWorker(lbName string, delivery *lbDelivery) {
+	for {
+		select {
+		case <-delivery.chStop:
+			return
+		case <-delivery.chWake:
+			d.deliver(lbName, delivery)
+		}
+	}
+}
+
+// deliver sends the latest assignment of an LB until it is acknowledged, it
+// is superseded by a newer one, or maxAttempts have failed
+func (d *AssignmentDelivery) deliver(lbName string, delivery *lbDelivery) {
+
+	backoff := d.initialBackoff
+
+	for attempt := 1; ; attempt++ {
+
+		d.mu.Lock()
+		address := delivery.Address
+		assignment := delivery.Assignment
+		if assignment.Version == delivery.AckedVersion && !delivery.needsResync {
+			d.mu.Unlock()
+			return
+		}
+		delivery.Attempts++
+		delivery.LastAttempt = time.Now()
+		d.mu.Unlock()
+
+		lbVersion, err := d.send(address, assignment)
+
+		d.mu.Lock()
+		if err == nil {
+			delivery.AckedVersion = assignment.Version
+			delivery.LastAck = time.Now()
+			delivery.LastError = ""
+			if delivery.Assignment.Version == assignment.Version {
+				delivery.needsResync = false
+			}
+			d.mu.Unlock()
+			log.Printf("LB Update: %s -> %s acknowledged (version %d)\n", lbName, assignment.Host, assignment.Version)
+			return
+		}
+
+		delivery.LastError = err.Error()
+		if errors.Is(err, errStaleAssignment) && delivery.Assignment.Version == assignment.Version {
+			// send the same assignment again (as an attempt of its own), as
+			// newer than what the LB has
+			delivery.Assignment.Version = lbVersion + 1
+			d.mu.Unlock()
+			log.Printf("LB Update: %s has version %d, re-sending as version %d (attempt %d)\n", lbName, lbVersion, lbVersion+1, attempt)
+		} else {
+			d.mu.Unlock()
+			log.Printf("Error: LB Update: %s -> %s (version %d) attempt %d failed: %s\n", lbName, assignment.Host, assignment.Version, attempt, err)
+		}
+
+		if attempt >= d.maxAttempts {
+			log.Printf("LB Update: giving up on %s until the next round\n", lbName)
+			return
+		}
+
+		select {
+		case <-delivery.chStop:
+			return
+		case <-delivery.chWake:
+			// a newer assignment arrived, send it right away
+			backoff = d.initialBackoff
+		case <-time.After(backoff):
+			backoff *= 2
+			if backoff > d.maxBackoff {
+				backoff = d.maxBackoff
+			}
+		}
+	}
+}
+
+// send sends an assignment to an LB and returns the error, if any, along with
+// the version the LB says it has
+func (d *AssignmentDelivery) send(address string, assignment Assignment) (int64, error) {
+
+	// an LB would take an empty endpoints= as having nowhere to send traffic
+	if len(assignment.Endpoints) == 0 {
+		return 0, fmt.Errorf("assignment %d of LB %s has no endpoints", assignment.Version, assignment.LB)
+	}
+
+	q := url.Values{}
+	q.Set("endpoints", strings.Join(assignment.Endpoints, ","))
+	q.Set("version", strconv.FormatInt(assignment.Version, 10))
+	if len(assignment.Weights) > 0 {
+		weights := make([]string, len(assignment.Weights))
+		for i, weight := range assignment.Weights {
+			weights[i] = strconv.FormatFloat(weight, 'f', -1, 64)
+		}
+		q.Set("weights", strings.Join(weights, ","))
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/?%s", address, q.Encode()), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Connection", "close")
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	ackHeader := res.Header.Get("X-Assignment-Version")
+	var lbVersion int64
+	if ackHeader != "" {
+		lbVersion, err = strconv.ParseInt(ackHeader, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid X-Assignment-Version %q", ackHeader)
+		}
+	}
+
+	switch {
+	case res.StatusCode == http.StatusConflict && ackHeader != "":
+		return lbVersion, fmt.Errorf("%w (version %d)", errStaleAssignment, lbVersion)
+	case res.StatusCode != http.StatusOK:
+		return lbVersion, fmt.Errorf("LB responded with %d", res.StatusCode)
+	case ackHeader != "" && lbVersion != assignment.Version:
+		return lbVersion, fmt.Errorf("LB acknowledged version %d instead of %d", lbVersion, assignment.Version)
+	}
+	return lbVersion, nil
+}
+
+func (d *AssignmentDelivery) GetStatus() map[string]LBDeliveryStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	status := make(map[string]LBDeliveryStatus)
+	for lbName, delivery := range d.lbs {
+		status[lbName] = delivery.LBDeliveryStatus
+	}
+	return status
+}
+
+func registerDeliveryHandlers(mux *http.ServeMux, delivery *AssignmentDelivery) {
+	if delivery == nil {
+		return
+	}
+	mux.HandleFunc("/deliveries", func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, delivery.GetStatus())
+	})
+}
+
+/*
+getAssignmentDelivery builds the assignment delivery configured by the environment:
+  - DELIVERY_TIMEOUT_MS:         timeout of a request to an LB, default 1000
+  - DELIVERY_MAX_ATTEMPTS:       attempts per round before waiting for the next round, default 3
+  - DELIVERY_INITIAL_BACKOFF_MS: backoff after the first failed attempt, default 100
+  - DELIVERY_MAX_BACKOFF_MS:     max backoff between attempts, default 2000
+  - DELIVERY_RESYNC_MS:          time after which an acknowledged assignment is sent again, default 10000
+*/
+func getAssignmentDelivery() *AssignmentDelivery {
+	return NewAssignmentDelivery(
+		time.Duration(getEnvFloat("DELIVERY_TIMEOUT_MS", 1000))*time.Millisecond,
+		int(getEnvFloat("DELIVERY_MAX_ATTEMPTS", 3)),
+		time.Duration(getEnvFloat("DELIVERY_INITIAL_BACKOFF_MS", 100))*time.Millisecond,
+		time.Duration(getEnvFloat("DELIVERY_MAX_BACKOFF_MS", 2000))*time.Millisecond,
+		time.Duration(getEnvFloat("DELIVERY_RESYNC_MS", 10000))*time.Millisecond,
+	)
+}
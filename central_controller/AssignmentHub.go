@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Watch API:
+	GET /watch?lb=<LB name>[&since=<version>]
+	a long-lived server-sent events stream of the assignments of the LB:
+		- the current assignment is sent right away unless the LB already has
+		  it (its version is the one in since, or in the Last-Event-ID header
+		  that SSE clients send when they reconnect)
+		- every new assignment is sent as it is made; a slow LB only gets the
+		  latest one
+		- a comment is sent every heartbeat interval to keep the connection
+		  (and any NAT in between) open
+	each event has the assignment version as its id and the assignment as JSON
+	data; followers redirect watchers to the leader, and a controller that
+	stops being the leader closes its streams so the LBs reconnect to the new
+	one
+*/
+
+type assignmentWatcher struct {
+	chAssignment chan Assignment
+	chClosed     chan struct{}
+}
+
+// AssignmentHub keeps the latest assignment of every LB and passes new ones
+// on to the LBs watching them
+type AssignmentHub struct {
+	mu          sync.Mutex
+	assignments map[string]Assignment
+	watchers    map[string]map[*assignmentWatcher]bool
+}
+
+func NewAssignmentHub() *AssignmentHub {
+	return &AssignmentHub{
+		assignments: make(map[string]Assignment),
+		watchers:    make(map[string]map[*assignmentWatcher]bool),
+	}
+}
+
+func (h *AssignmentHub) Publish(assignments map[string]Assignment) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for lbName, assignment := range assignments {
+		if oldAssignment, ok := h.assignments[lbName]; ok && oldAssignment.Version == assignment.Version {
+			continue
+		}
+		h.assignments[lbName] = assignment
+
+		for watcher := range h.watchers[lbName] {
+			// replace the assignment the watcher has not picked up yet
+			select {
+			case <-watcher.chAssignment:
+			default:
+			}
+			watcher.chAssignment <- assignment
+		}
+	}
+}
+
+// Subscribe returns a watcher of the LB's assignments along with its current
+// assignment, if it has one
+func (h *AssignmentHub) Subscribe(lbName string) (*assignmentWatcher, Assignment, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	watcher := &assignmentWatcher{
+		chAssignment: make(chan Assignment, 1),
+		chClosed:     make(chan struct{}),
+	}
+	if h.watchers[lbName] == nil {
+		h.watchers[lbName] = make(map[*assignmentWatcher]bool)
+	}
+	h.watchers[lbName][watcher] = true
+
+	assignment, ok := h.assignments[lbName]
+	return watcher, assignment, ok
+}
+
+func (h *AssignmentHub) Unsubscribe(lbName string, watcher *assignmentWatcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.watchers[lbName], watcher)
+	if len(h.watchers[lbName]) == 0 {
+		delete(h.watchers, lbName)
+	}
+}
+
+// Reset forgets all assignments and closes all streams
+func (h *AssignmentHub) Reset() {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, watchers := range h.watchers {
+		for watcher := range watchers {
+			close(watcher.chClosed)
+		}
+	}
+	h.watchers = make(map[string]map[*assignmentWatcher]bool)
+	h.assignments = make(map[string]Assignment)
+}
+
+func writeAssignmentEvent(w http.ResponseWriter, assignment Assignment) error {
+	data, err := json.Marshal(assignment)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: assignment\ndata: %s\n\n", assignment.Version, data)
+	return err
+}
+
+func handleWatch(
+	hub *AssignmentHub,
+	replica *Replica,
+	topology *Topology,
+	heartbeatInterval time.Duration,
+	w http.ResponseWriter,
+	r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		respondWithMethodNotAllowed(w, r)
+		return
+	}
+
+	lbName := r.URL.Query().Get("lb")
+	if _, _, LBs := topology.Get(); lbName == "" || LBs[lbName].Name == "" {
+		respondWithError(w, fmt.Sprintf("LB %q does not exist", lbName))
+		return
+	}
+
+	// only the leader makes assignments
+	if replica != nil && !replica.IsLeader() {
+		leaderHTTPAddr := replica.GetLeaderHTTPAddr()
+		if leaderHTTPAddr == "" {
+			respondWithStatus(w, http.StatusServiceUnavailable, "no leader elected")
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("http://%s/watch?%s", leaderHTTPAddr, r.URL.RawQuery), http.StatusTemporaryRedirect)
+		return
+	}
+
+	sinceStr := r.Header.Get("Last-Event-ID")
+	if sinceStr == "" {
+		sinceStr = r.URL.Query().Get("since")
+	}
+	var since int64
+	if sinceStr != "" {
+		var err error
+		if since, err = strconv.ParseInt(sinceStr, 10, 64); err != nil {
+			respondWithError(w, fmt.Sprintf("invalid since: %s", err))
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithStatus(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	watcher, assignment, ok := hub.Subscribe(lbName)
+	defer hub.Unsubscribe(lbName, watcher)
+	log.Printf("Watch: LB %s subscribed (since version %d)\n", lbName, since)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: 1000\n\n")
+
+	// send the current assignment unless the LB already has it (if the LB has
+	// a version we don't know, it's from before a restart and ours wins)
+	lastVersion := since
+	if ok && assignment.Version != since {
+		if err := writeAssignmentEvent(w, assignment); err != nil {
+			return
+		}
+		lastVersion = assignment.Version
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Printf("Watch: LB %s unsubscribed\n", lbName)
+			return
+		case <-watcher.chClosed:
+			return
+		case assignment := <-watcher.chAssignment:
+			if assignment.Version == lastVersion {
+				continue
+			}
+			if err := writeAssignmentEvent(w, assignment); err != nil {
+				return
+			}
+			lastVersion = assignment.Version
+		case <-heartbeat.C:
+			if _, err := fmt.Fprintf(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func registerWatchHandlers(mux *http.ServeMux, hub *AssignmentHub, replica *Replica, topology *Topology) {
+	if hub == nil {
+		return
+	}
+	heartbeatInterval := time.Duration(getEnvFloat("WATCH_HEARTBEAT_MS", 15000)) * time.Millisecond
+	mux.HandleFunc("/watch", func(w http.ResponseWriter, r *http.Request) {
+		handleWatch(hub, replica, topology, heartbeatInterval, w, r)
+	})
+}
+
+/*
+getLBNotifyMode returns how the LBs learn their assignments:
+  - LB_NOTIFY_MODE: "push" (default, the controller sends them to every LB),
+    "watch" (the LBs subscribe to GET /watch) or "both"
+*/
+func getLBNotifyMode() (bool, bool) {
+	switch mode := getEnvString("LB_NOTIFY_MODE", "push"); mode {
+	case "push":
+		return true, false
+	case "watch":
+		return false, true
+	case "both":
+		return true, true
+	default:
+		log.Fatalf("Error: invalid LB_NOTIFY_MODE %q (must be push, watch or both)\n", mode)
+		return false, false
+	}
+}
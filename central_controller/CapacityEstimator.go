@@ -0,0 +1,444 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+/*
+Capacity estimation:
+	the LBs report the latency and errors of the requests they sent to each
+	pod (POST /health/report with latency_ms, see the health reporter of
+	load_balancer); every round, the reports about
+	a host's pods are paired with the host's load into a sample, and the last
+	windowSize samples of the host are kept
+	a sample is degraded if its latency is more than latencyFactor times the
+	host's baseline latency (the mean latency of its least loaded quarter of
+	samples with a latency) or its error rate is more than maxErrorRate;
+	reports without latency_ms only count towards the error rate
+	the knee is the lowest load from which most samples are degraded; the
+	host's capacity is estimated between the highest load below the knee that
+	was fine and the knee, and kept within [minFactor, maxFactor] times the
+	configured capacity
+	if no knee shows up, the host was never loaded enough to see it, and the
+	capacity is at least the highest load seen
+	the estimate is smoothed over rounds and used for pricing (as the
+	capacity of "requests") once its confidence reaches minConfidence;
+	operators can lock the capacity of a host to a manual value instead (the
+	lock is kept until it is removed, even while the host is not ours, e.g.
+	while it belongs to another shard)
+
+Capacity API:
+	GET    /capacity                                   the capacity of every host, with bounds and confidence
+	POST   /capacity/lock?host=<host>&capacity=<n>
+	DELETE /capacity/lock?host=<host>
+*/
+
+const (
+	capacitySourceConfigured = "configured"
+	capacitySourceEstimated  = "estimated"
+	capacitySourceLocked     = "locked"
+)
+
+type capacitySample struct {
+	load       float64
+	latencyMs  float64
+	hasLatency bool
+	errorRate  float64
+}
+
+type podObservations struct {
+	requests     int
+	errors       int
+	latencySumMs float64
+	// requests of the reports with a latency
+	latencyRequests int
+}
+
+type HostCapacity struct {
+	Configured        float64 `json:"configured"`
+	Effective         float64 `json:"effective"`
+	Source            string  `json:"source"`
+	Estimate          float64 `json:"estimate"`
+	Lower             float64 `json:"lower"`
+	Upper             float64 `json:"upper"`
+	KneeFound         bool    `json:"kneeFound"`
+	Confidence        float64 `json:"confidence"`
+	BaselineLatencyMs float64 `json:"baselineLatencyMs"`
+	Samples           int     `json:"samples"`
+	LockedCapacity    float64 `json:"lockedCapacity,omitempty"`
+
+	samples []capacitySample
+}
+
+type CapacityEstimator struct {
+	mu            sync.Mutex
+	windowSize    int
+	minSamples    int
+	latencyFactor float64
+	maxErrorRate  float64
+	minFactor     float64
+	maxFactor     float64
+	smoothing     float64
+	minConfidence float64
+
+	hosts   map[string]*HostCapacity
+	pending map[string]*podObservations
+	// capacities locked by operators, by host
+	locks map[string]float64
+}
+
+func NewCapacityEstimator(
+	windowSize int,
+	minSamples int,
+	latencyFactor float64,
+	maxErrorRate float64,
+	minFactor float64,
+	maxFactor float64,
+	smoothing float64,
+	minConfidence float64) *CapacityEstimator {
+
+	return &CapacityEstimator{
+		windowSize:    windowSize,
+		minSamples:    minSamples,
+		latencyFactor: latencyFactor,
+		maxErrorRate:  maxErrorRate,
+		minFactor:     minFactor,
+		maxFactor:     maxFactor,
+		smoothing:     smoothing,
+		minConfidence: minConfidence,
+		hosts:         make(map[string]*HostCapacity),
+		pending:       make(map[string]*podObservations),
+		locks:         make(map[string]float64),
+	}
+}
+
+// RecordLBObservation records the requests an LB sent to a pod, how many of
+// them failed and their mean latency (if hasLatency)
+func (e *CapacityEstimator) RecordLBObservation(podname string, requests int, errors int, latencyMs float64, hasLatency bool) {
+	if e == nil || requests <= 0 {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	observations, ok := e.pending[podname]
+	if !ok {
+		observations = &podObservations{}
+		e.pending[podname] = observations
+	}
+	observations.requests += requests
+	observations.errors += errors
+	if hasLatency {
+		observations.latencySumMs += latencyMs * float64(requests)
+		observations.latencyRequests += requests
+	}
+}
+
+func (e *CapacityEstimator) Lock(hostname string, capacity float64) HostCapacity {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.locks[hostname] = capacity
+	hostCapacity, ok := e.hosts[hostname]
+	if !ok {
+		hostCapacity = &HostCapacity{}
+		e.hosts[hostname] = hostCapacity
+	}
+	e.setEffective(hostname, hostCapacity)
+	log.Printf("Capacity: locked host %s to %g\n", hostname, capacity)
+	return *hostCapacity
+}
+
+func (e *CapacityEstimator) Unlock(hostname string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.locks[hostname]; !ok {
+		return fmt.Errorf("host %s is not locked", hostname)
+	}
+	delete(e.locks, hostname)
+	if hostCapacity, ok := e.hosts[hostname]; ok {
+		e.setEffective(hostname, hostCapacity)
+	}
+	log.Printf("Capacity: unlocked host %s\n", hostname)
+	return nil
+}
+
+// Update turns the observations since the last round into samples of the
+// hosts whose load we know, and estimates the capacity of every host again
+func (e *CapacityEstimator) Update(hosts map[string]HostProps, hostLoads map[string]int) {
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for hostname := range e.hosts {
+		if _, ok := hosts[hostname]; !ok {
+			delete(e.hosts, hostname)
+		}
+	}
+
+	for hostname, hostProps := range hosts {
+		hostCapacity, ok := e.hosts[hostname]
+		if !ok {
+			hostCapacity = &HostCapacity{}
+			e.hosts[hostname] = hostCapacity
+		}
+		configured := getHostCapacities(hostProps)[requestsResource]
+		if hostCapacity.Configured != configured {
+			// the configured capacity changed, start over from it
+			hostCapacity.Estimate = configured
+		}
+		hostCapacity.Configured = configured
+
+		requests, errors, latencySumMs, latencyRequests := 0, 0, 0.0, 0
+		for _, podname := range hostProps.PodNames {
+			if observations, ok := e.pending[podname]; ok {
+				requests += observations.requests
+				errors += observations.errors
+				latencySumMs += observations.latencySumMs
+				latencyRequests += observations.latencyRequests
+			}
+		}
+		if load, ok := hostLoads[hostname]; ok && requests > 0 {
+			sample := capacitySample{
+				load:      float64(load),
+				errorRate: float64(errors) / float64(requests),
+			}
+			if latencyRequests > 0 {
+				sample.latencyMs = latencySumMs / float64(latencyRequests)
+				sample.hasLatency = true
+			}
+			hostCapacity.samples = append(hostCapacity.samples, sample)
+			if len(hostCapacity.samples) > e.windowSize {
+				hostCapacity.samples = hostCapacity.samples[len(hostCapacity.samples)-e.windowSize:]
+			}
+		}
+
+		e.estimate(hostname, hostCapacity)
+	}
+
+	e.pending = make(map[string]*podObservations)
+}
+
+func (e *CapacityEstimator) estimate(hostname string, hostCapacity *HostCapacity) {
+
+	samples := append([]capacitySample{}, hostCapacity.samples...)
+	hostCapacity.Samples = len(samples)
+	if len(samples) == 0 {
+		hostCapacity.Confidence = 0
+		e.setEffective(hostname, hostCapacity)
+		return
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].load < samples[j].load })
+
+	// the baseline is the latency of the least loaded quarter of the samples
+	// with a latency
+	var latencySamples []capacitySample
+	for _, sample := range samples {
+		if sample.hasLatency {
+			latencySamples = append(latencySamples, sample)
+		}
+	}
+	baseline := 0.0
+	if len(latencySamples) > 0 {
+		numBaseline := int(math.Max(1, float64(len(latencySamples)/4)))
+		for _, sample := range latencySamples[:numBaseline] {
+			baseline += sample.latencyMs
+		}
+		baseline /= float64(numBaseline)
+	}
+	hostCapacity.BaselineLatencyMs = baseline
+
+	isDegraded := func(sample capacitySample) bool {
+		return (sample.hasLatency && sample.latencyMs > e.latencyFactor*baseline) || sample.errorRate > e.maxErrorRate
+	}
+
+	// the knee is the lowest load from which most samples are degraded
+	knee := -1
+	degradedFrom := 0
+	for i := len(samples) - 1; i >= 0; i-- {
+		if isDegraded(samples[i]) {
+			degradedFrom++
+			if 2*degradedFrom > len(samples)-i {
+				knee = i
+			}
+		}
+	}
+
+	var lower, upper, agreement float64
+	if knee > 0 {
+		hostCapacity.KneeFound = true
+		upper = samples[knee].load
+		lower = samples[0].load
+		for _, sample := range samples[:knee] {
+			if !isDegraded(sample) {
+				lower = sample.load
+			}
+		}
+		degraded := 0
+		for _, sample := range samples[knee:] {
+			if isDegraded(sample) {
+				degraded++
+			}
+		}
+		agreement = float64(degraded) / float64(len(samples)-knee)
+	} else {
+		// no knee (or degraded from the least load on, which says more about
+		// the baseline than the capacity): the capacity is at least the
+		// highest load seen
+		hostCapacity.KneeFound = false
+		lower = samples[len(samples)-1].load
+		upper = math.Max(lower, hostCapacity.Configured)
+		agreement = 0.5
+	}
+
+	minCapacity := e.minFactor * hostCapacity.Configured
+	maxCapacity := e.maxFactor * hostCapacity.Configured
+	hostCapacity.Lower = math.Min(math.Max(lower, minCapacity), maxCapacity)
+	hostCapacity.Upper = math.Min(math.Max(upper, minCapacity), maxCapacity)
+
+	rawEstimate := (hostCapacity.Lower + hostCapacity.Upper) / 2
+	if hostCapacity.Estimate == 0 {
+		hostCapacity.Estimate = hostCapacity.Configured
+	}
+	hostCapacity.Estimate = e.smoothing*hostCapacity.Estimate + (1-e.smoothing)*rawEstimate
+	hostCapacity.Confidence = math.Min(1, float64(len(samples))/float64(e.minSamples)) * agreement
+
+	oldSource := hostCapacity.Source
+	e.setEffective(hostname, hostCapacity)
+	if hostCapacity.Source != oldSource {
+		log.Printf("Capacity: host %s uses its %s capacity %.2f (estimate in [%.2f, %.2f], confidence %.2f)\n",
+			hostname, hostCapacity.Source, hostCapacity.Effective, hostCapacity.Lower, hostCapacity.Upper, hostCapacity.Confidence)
+	}
+}
+
+func (e *CapacityEstimator) setEffective(hostname string, hostCapacity *HostCapacity) {
+	hostCapacity.LockedCapacity = e.locks[hostname]
+	switch {
+	case hostCapacity.LockedCapacity > 0:
+		hostCapacity.Source = capacitySourceLocked
+		hostCapacity.Effective = hostCapacity.LockedCapacity
+	case hostCapacity.Samples > 0 && hostCapacity.Confidence >= e.minConfidence:
+		hostCapacity.Source = capacitySourceEstimated
+		hostCapacity.Effective = hostCapacity.Estimate
+	default:
+		hostCapacity.Source = capacitySourceConfigured
+		hostCapacity.Effective = hostCapacity.Configured
+	}
+}
+
+// Apply returns the hosts with the capacity of "requests" they are priced by
+func (e *CapacityEstimator) Apply(hosts map[string]HostProps) map[string]HostProps {
+	if e == nil {
+		return hosts
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	pricedHosts := make(map[string]HostProps)
+	for hostname, hostProps := range hosts {
+		if hostCapacity, ok := e.hosts[hostname]; ok && hostCapacity.Source != capacitySourceConfigured {
+			hostProps.Capacities = getHostCapacities(hostProps)
+			hostProps.Capacities[requestsResource] = hostCapacity.Effective
+		}
+		pricedHosts[hostname] = hostProps
+	}
+	return pricedHosts
+}
+
+func (e *CapacityEstimator) GetStatus() map[string]HostCapacity {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	status := make(map[string]HostCapacity)
+	for hostname, hostCapacity := range e.hosts {
+		status[hostname] = *hostCapacity
+	}
+	return status
+}
+
+func handleCapacityLock(estimator *CapacityEstimator, topology *Topology, w http.ResponseWriter, r *http.Request) {
+
+	hostname := r.URL.Query().Get("host")
+
+	switch r.Method {
+	case http.MethodPost:
+		hosts, _, _ := topology.Get()
+		if _, ok := hosts[hostname]; !ok {
+			respondWithError(w, fmt.Sprintf("host %s does not exist", hostname))
+			return
+		}
+		capacity, err := strconv.ParseFloat(r.URL.Query().Get("capacity"), 64)
+		if err != nil || capacity <= 0 {
+			respondWithError(w, fmt.Sprintf("invalid capacity %q", r.URL.Query().Get("capacity")))
+			return
+		}
+		respondWithJSON(w, estimator.Lock(hostname, capacity))
+	case http.MethodDelete:
+		if err := estimator.Unlock(hostname); err != nil {
+			respondWithError(w, err.Error())
+			return
+		}
+		respondWithJSON(w, estimator.GetStatus()[hostname])
+	default:
+		respondWithMethodNotAllowed(w, r)
+	}
+}
+
+func registerCapacityHandlers(mux *http.ServeMux, estimator *CapacityEstimator, topology *Topology, replica *Replica) {
+	mux.HandleFunc("/capacity", func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, estimator.GetStatus())
+	})
+	mux.HandleFunc("/capacity/lock", forwardWritesToLeader(replica, func(w http.ResponseWriter, r *http.Request) {
+		handleCapacityLock(estimator, topology, w, r)
+	}))
+}
+
+/*
+getCapacityEstimator builds the capacity estimation configured by the environment:
+  - CAPACITY_WINDOW:          samples kept per host, default 200
+  - CAPACITY_MIN_SAMPLES:     samples needed for full confidence, default 30
+  - CAPACITY_LATENCY_FACTOR:  latency (over the baseline) of a degraded sample, default 2.0
+  - CAPACITY_MAX_ERROR_RATE:  error rate of a degraded sample, default 0.05
+  - CAPACITY_MIN_FACTOR:      lowest estimate, as a factor of the configured capacity, default 0.25
+  - CAPACITY_MAX_FACTOR:      highest estimate, as a factor of the configured capacity, default 4.0
+  - CAPACITY_SMOOTHING:       weight of the old estimate when smoothing, default 0.8
+  - CAPACITY_MIN_CONFIDENCE:  confidence needed to price by the estimate, 0.7 by default, > 1 to never use it
+*/
+func getCapacityEstimator() *CapacityEstimator {
+	windowSize := int(getEnvFloat("CAPACITY_WINDOW", 200))
+	minSamples := int(getEnvFloat("CAPACITY_MIN_SAMPLES", 30))
+	minFactor := getEnvFloat("CAPACITY_MIN_FACTOR", 0.25)
+	maxFactor := getEnvFloat("CAPACITY_MAX_FACTOR", 4.0)
+	smoothing := getEnvFloat("CAPACITY_SMOOTHING", 0.8)
+	if windowSize <= 0 || minSamples <= 0 {
+		log.Fatal("CAPACITY_WINDOW and CAPACITY_MIN_SAMPLES must be positive")
+	}
+	if minFactor <= 0 || maxFactor < minFactor {
+		log.Fatal("CAPACITY_MIN_FACTOR must be positive and at most CAPACITY_MAX_FACTOR")
+	}
+	if smoothing < 0 || smoothing >= 1 {
+		log.Fatalf("CAPACITY_SMOOTHING must be in [0, 1), got %f", smoothing)
+	}
+	return NewCapacityEstimator(
+		windowSize,
+		minSamples,
+		getEnvFloat("CAPACITY_LATENCY_FACTOR", 2.0),
+		getEnvFloat("CAPACITY_MAX_ERROR_RATE", 0.05),
+		minFactor,
+		maxFactor,
+		smoothing,
+		getEnvFloat("CAPACITY_MIN_CONFIDENCE", 0.7),
+	)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+Coordination with cc:
+	routing (this controller) is the slow loop and runs once a round; cc,
+	which sets the cpu.shares of the pods, is the fast loop and runs many
+	times a round. They share their state through the coordination API:
+		- cc reads the load every pod is projected to get from the last
+		  round's assignments, and sizes the pod's shares for at least that
+		  load, so that it doesn't shrink a pod we are sending more traffic to
+		- cc reports the shares it allocated; we smooth them over rounds
+		  (shareSmoothing) so that routing only follows lasting changes
+	an LB is costlier on a host where its pods have less than their fair part
+	of the host's shares: its cost there is divided by
+		max(minShareFactor, (shares of its pods / shares of all pods) / (its pods / all pods))
+	the shares of a pod that cc has not reported for shareTTL are forgotten
+
+Coordination API:
+	GET  /coordination           the round, the routing interval and the projected load of every pod
+	POST /coordination/shares    {"<pod>": <cpu shares>} the shares cc allocated
+*/
+
+type PodShares struct {
+	Shares     float64   `json:"shares"`
+	ReportedAt time.Time `json:"reportedAt"`
+}
+
+type CoordinationState struct {
+	Round           int                  `json:"round"`
+	IntervalMs      int64                `json:"intervalMs"`
+	ProjectedLoads  map[string]float64   `json:"projectedLoads"`
+	AllocatedShares map[string]PodShares `json:"allocatedShares"`
+}
+
+type Coordination struct {
+	mu             sync.Mutex
+	interval       time.Duration
+	shareSmoothing float64
+	minShareFactor float64
+	shareTTL       time.Duration
+
+	round          int
+	projectedLoads map[string]float64
+	shares         map[string]*PodShares
+}
+
+func NewCoordination(
+	interval time.Duration,
+	shareSmoothing float64,
+	minShareFactor float64,
+	shareTTL time.Duration) *Coordination {
+
+	return &Coordination{
+		interval:       interval,
+		shareSmoothing: shareSmoothing,
+		minShareFactor: minShareFactor,
+		shareTTL:       shareTTL,
+		projectedLoads: make(map[string]float64),
+		shares:         make(map[string]*PodShares),
+	}
+}
+
+// RecordShares records the shares cc allocated to pods
+func (c *Coordination) RecordShares(podShares map[string]float64) error {
+	for podname, shares := range podShares {
+		if shares < 0 || math.IsNaN(shares) {
+			return fmt.Errorf("invalid shares %f of pod %s", shares, podname)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for podname, shares := range podShares {
+		old, ok := c.shares[podname]
+		if !ok || now.Sub(old.ReportedAt) > c.shareTTL {
+			c.shares[podname] = &PodShares{Shares: shares, ReportedAt: now}
+			continue
+		}
+		old.Shares = c.shareSmoothing*old.Shares + (1-c.shareSmoothing)*shares
+		old.ReportedAt = now
+	}
+	return nil
+}
+
+// getShareFactor returns how much of its fair part of the host's shares the
+// LB's pods on the host have, or 1 if we don't know the shares of all of the
+// host's pods
+func (c *Coordination) getShareFactor(lbName string, host HostProps, pods map[string]PodProps, now time.Time) float64 {
+	if len(host.PodNames) == 0 {
+		return 1
+	}
+
+	lbShares, allShares := 0.0, 0.0
+	lbPods := 0
+	for _, podname := range host.PodNames {
+		shares, ok := c.shares[podname]
+		if !ok || now.Sub(shares.ReportedAt) > c.shareTTL {
+			return 1
+		}
+		allShares += shares.Shares
+		if pods[podname].LBname == lbName {
+			lbShares += shares.Shares
+			lbPods++
+		}
+	}
+	if allShares == 0 || lbPods == 0 {
+		return 1
+	}
+
+	fairPart := float64(lbPods) / float64(len(host.PodNames))
+	return math.Max(c.minShareFactor, (lbShares/allShares)/fairPart)
+}
+
+// AddShareCosts scales the cost of every LB on every host by the shares its
+// pods have there. hosts are all the hosts of the topology.
+func (c *Coordination) AddShareCosts(
+	hosts map[string]HostProps,
+	pods map[string]PodProps,
+	costsForLBs map[string]map[string]float64) map[string]map[string]float64 {
+
+	if c == nil {
+		return costsForLBs
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	newCostsForLBs := make(map[string]map[string]float64)
+	for lbName, costs := range costsForLBs {
+		newCosts := make(map[string]float64)
+		for hostname, cost := range costs {
+			host, ok := hosts[hostname]
+			if !ok {
+				newCosts[hostname] = cost
+				continue
+			}
+			newCosts[hostname] = cost / c.getShareFactor(lbName, host, pods, now)
+		}
+		newCostsForLBs[lbName] = newCosts
+	}
+	return newCostsForLBs
+}
+
+// getProjectedPodLoads returns the load every pod gets if each LB's reported
+// load is sent over its pods as the assignments say
+func getProjectedPodLoads(
+	LBs map[string]LBProps,
+	pods map[string]PodProps,
+	podReports map[string]Req,
+	assignments map[string]Assignment) map[string]float64 {
+
+	podsOfIPs := make(map[string]string)
+	for podname, pod := range pods {
+		podsOfIPs[pod.IPAddress] = podname
+	}
+
+	projectedLoads := make(map[string]float64)
+	for podname := range pods {
+		projectedLoads[podname] = 0
+	}
+
+	for lbName, LB := range LBs {
+		assignment, ok := assignments[lbName]
+		if !ok || len(assignment.Endpoints) == 0 {
+			continue
+		}
+
+		lbLoad := 0.0
+		for _, podname := range LB.PodNames {
+			if req, ok := podReports[podname]; ok && req.a > 0 {
+				lbLoad += float64(req.a)
+			}
+		}
+
+		sumOfWeights := 0.0
+		for _, weight := range assignment.Weights {
+			sumOfWeights += weight
+		}
+		for i, endpoint := range assignment.Endpoints {
+			share := 1 / float64(len(assignment.Endpoints))
+			if len(assignment.Weights) == len(assignment.Endpoints) && sumOfWeights > 0 {
+				share = assignment.Weights[i] / sumOfWeights
+			}
+			if podname, ok := podsOfIPs[endpoint]; ok {
+				projectedLoads[podname] += share * lbLoad
+			}
+		}
+	}
+
+	return projectedLoads
+}
+
+// SetProjectedLoads publishes the loads the pods are projected to get
+func (c *Coordination) SetProjectedLoads(round int, projectedLoads map[string]float64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.round = round
+	c.projectedLoads = projectedLoads
+}
+
+func (c *Coordination) GetState() CoordinationState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state := CoordinationState{
+		Round:           c.round,
+		IntervalMs:      c.interval.Milliseconds(),
+		ProjectedLoads:  make(map[string]float64),
+		AllocatedShares: make(map[string]PodShares),
+	}
+	for podname, load := range c.projectedLoads {
+		state.ProjectedLoads[podname] = load
+	}
+	for podname, shares := range c.shares {
+		state.AllocatedShares[podname] = *shares
+	}
+	return state
+}
+
+func handleCoordinationShares(coordination *Coordination, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithMethodNotAllowed(w, r)
+		return
+	}
+
+	var podShares map[string]float64
+	if err := json.NewDecoder(r.Body).Decode(&podShares); err != nil {
+		respondWithError(w, fmt.Sprintf("invalid shares: %s", err))
+		return
+	}
+	if err := coordination.RecordShares(podShares); err != nil {
+		respondWithError(w, err.Error())
+		return
+	}
+	respondWithJSON(w, coordination.GetState())
+}
+
+func registerCoordinationHandlers(mux *http.ServeMux, coordination *Coordination, replica *Replica) {
+	mux.HandleFunc("/coordination", func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, coordination.GetState())
+	})
+	mux.HandleFunc("/coordination/shares", forwardWritesToLeader(replica, func(w http.ResponseWriter, r *http.Request) {
+		handleCoordinationShares(coordination, w, r)
+	}))
+}
+
+/*
+getCoordination builds the coordination with cc configured by the environment:
+  - SHARE_SMOOTHING:    weight of the old shares when smoothing the shares cc reports, default 0.8
+  - MIN_SHARE_FACTOR:   lowest factor a cost is divided by for missing shares, default 0.25
+  - SHARE_TTL_MS:       time after which unreported shares are forgotten, default 10 rounds
+*/
+func getCoordination(interval time.Duration) *Coordination {
+	shareSmoothing := getEnvFloat("SHARE_SMOOTHING", 0.8)
+	minShareFactor := getEnvFloat("MIN_SHARE_FACTOR", 0.25)
+	if shareSmoothing < 0 || shareSmoothing >= 1 {
+		log.Fatalf("SHARE_SMOOTHING must be in [0, 1), got %f", shareSmoothing)
+	}
+	if minShareFactor <= 0 || minShareFactor > 1 {
+		log.Fatalf("MIN_SHARE_FACTOR must be in (0, 1], got %f", minShareFactor)
+	}
+	return NewCoordination(
+		interval,
+		shareSmoothing,
+		minShareFactor,
+		time.Duration(getEnvFloat("SHARE_TTL_MS", float64(10*interval.Milliseconds())))*time.Millisecond,
+	)
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Health tracking:
+	every host and pod is "healthy", "unhealthy" or on "probation"
+	failures come from
+		- hosts: failed reads of the host's load from its Redis
+		- pods:  missed reports (no report for the pod report timeout) and
+		         errors observed by the LBs (POST /health/report)
+	after failureThreshold consecutive failures a host or pod becomes
+	unhealthy and is excluded from selection for a backoff period
+	in the first round after the backoff has passed it is put on probation,
+	which lets it be selected again:
+		- a success on probation makes it healthy (and resets the backoff)
+		- a failure on probation makes it unhealthy again with twice the backoff
+
+Health API:
+	GET  /health                                     health of all hosts and pods, and recent transitions
+	POST /health/report?lb=<lb>&pod=<pod>&requests=<n>&errors=<n>[&latency_ms=<mean latency>]
+	(the pod can also be given by its address, as endpoint=<address>, which
+	is what the LBs know it by; the reports also feed the capacity estimation)
+*/
+
+const (
+	healthHealthy   = "healthy"
+	healthUnhealthy = "unhealthy"
+	healthProbation = "probation"
+)
+
+type EntityHealth struct {
+	State               string    `json:"state"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LastError           string    `json:"lastError,omitempty"`
+	LastTransition      time.Time `json:"lastTransition"`
+	RetryAt             time.Time `json:"retryAt,omitempty"`
+	Backoff             string    `json:"backoff,omitempty"`
+
+	backoff time.Duration
+}
+
+type HealthTransition struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Name   string    `json:"name"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+}
+
+type HealthStatus struct {
+	Hosts       map[string]EntityHealth `json:"hosts"`
+	Pods        map[string]EntityHealth `json:"pods"`
+	Transitions []HealthTransition      `json:"transitions"`
+}
+
+type HealthTracker struct {
+	mu sync.Mutex
+
+	failureThreshold   int
+	initialBackoff     time.Duration
+	maxBackoff         time.Duration
+	podReportTimeout   time.Duration
+	lbErrorRateToFail  float64
+	maxTransitionsKept int
+
+	hosts         map[string]*EntityHealth
+	pods          map[string]*EntityHealth
+	podLastReport map[string]time.Time
+	transitions   []HealthTransition
+}
+
+func NewHealthTracker(
+	failureThreshold int,
+	initialBackoff time.Duration,
+	maxBackoff time.Duration,
+	podReportTimeout time.Duration,
+	lbErrorRateToFail float64) *HealthTracker {
+
+	return &HealthTracker{
+		failureThreshold:   failureThreshold,
+		initialBackoff:     initialBackoff,
+		maxBackoff:         maxBackoff,
+		podReportTimeout:   podReportTimeout,
+		lbErrorRateToFail:  lbErrorRateToFail,
+		maxTransitionsKept: 100,
+		hosts:              make(map[string]*EntityHealth),
+		pods:               make(map[string]*EntityHealth),
+		podLastReport:      make(map[string]time.Time),
+	}
+}
+
+// Reconcile starts tracking new hosts and pods, and forgets removed ones
+func (h *HealthTracker) Reconcile(hosts map[string]HostProps, pods map[string]PodProps) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+
+	reconcileEntities(h.hosts, func(name string) bool { _, ok := hosts[name]; return ok })
+	for hostname := range hosts {
+		if _, ok := h.hosts[hostname]; !ok {
+			h.hosts[hostname] = &EntityHealth{State: healthHealthy, LastTransition: now, backoff: h.initialBackoff}
+		}
+	}
+
+	reconcileEntities(h.pods, func(name string) bool { _, ok := pods[name]; return ok })
+	for podname := range pods {
+		if _, ok := h.pods[podname]; !ok {
+			h.pods[podname] = &EntityHealth{State: healthHealthy, LastTransition: now, backoff: h.initialBackoff}
+			// give new pods a whole timeout to send their first report
+			h.podLastReport[podname] = now
+		}
+	}
+	for podname := range h.podLastReport {
+		if _, ok := pods[podname]; !ok {
+			delete(h.podLastReport, podname)
+		}
+	}
+}
+
+func reconcileEntities(entities map[string]*EntityHealth, exists func(string) bool) {
+	for name := range entities {
+		if !exists(name) {
+			delete(entities, name)
+		}
+	}
+}
+
+func (h *HealthTracker) RecordHostSuccess(hostname string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.recordSuccess("host", hostname, h.hosts[hostname])
+}
+
+func (h *HealthTracker) RecordHostFailure(hostname string, reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.recordFailure("host", hostname, h.hosts[hostname], reason)
+}
+
+// RecordPodReports marks the pods that reported this round as alive, and
+// the pods that have not reported for the pod report timeout as failed
+func (h *HealthTracker) RecordPodReports(podReports map[string]Req) {
+	if h.podReportTimeout <= 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for podname := range podReports {
+		if _, ok := h.pods[podname]; ok {
+			h.podLastReport[podname] = now
+			h.recordSuccess("pod", podname, h.pods[podname])
+		}
+	}
+	for podname, lastReport := range h.podLastReport {
+		if silence := now.Sub(lastReport); silence > h.podReportTimeout {
+			h.recordFailure("pod", podname, h.pods[podname],
+				fmt.Sprintf("no report for %s", silence.Round(time.Millisecond)))
+		}
+	}
+}
+
+// RecordLBObservation records the requests an LB sent to a pod and how many
+// of them failed
+func (h *HealthTracker) RecordLBObservation(lbName string, podname string, requests int, errors int) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	podHealth, ok := h.pods[podname]
+	if !ok {
+		return fmt.Errorf("pod %s does not exist", podname)
+	}
+	if requests <= 0 {
+		return nil
+	}
+
+	errorRate := float64(errors) / float64(requests)
+	if errorRate >= h.lbErrorRateToFail {
+		h.recordFailure("pod", podname, podHealth,
+			fmt.Sprintf("LB %s saw %d/%d requests fail", lbName, errors, requests))
+	} else {
+		h.recordSuccess("pod", podname, podHealth)
+	}
+	return nil
+}
+
+// StartProbations puts the unhealthy hosts and pods whose backoff has passed
+// on probation; it is called once per round, before the selection, so that
+// checking the availability changes nothing
+func (h *HealthTracker) StartProbations() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for hostname, health := range h.hosts {
+		h.startProbation("host", hostname, health, now)
+	}
+	for podname, health := range h.pods {
+		h.startProbation("pod", podname, health, now)
+	}
+}
+
+func (h *HealthTracker) startProbation(kind string, name string, health *EntityHealth, now time.Time) {
+	if health.State == healthUnhealthy && !now.Before(health.RetryAt) {
+		h.transition(kind, name, health, healthProbation, "backoff expired")
+	}
+}
+
+// IsHostAvailable tells if a host can be selected (it is healthy, or on
+// probation)
+func (h *HealthTracker) IsHostAvailable(hostname string) bool {
+	if h == nil {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return isAvailable(h.hosts[hostname])
+}
+
+func (h *HealthTracker) IsPodAvailable(podname string) bool {
+	if h == nil {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return isAvailable(h.pods[podname])
+}
+
+func isAvailable(health *EntityHealth) bool {
+	return health == nil || health.State != healthUnhealthy
+}
+
+func (h *HealthTracker) recordSuccess(kind string, name string, health *EntityHealth) {
+	if health == nil {
+		return
+	}
+	health.ConsecutiveFailures = 0
+	if health.State == healthProbation {
+		health.backoff = h.initialBackoff
+		h.transition(kind, name, health, healthHealthy, "succeeded on probation")
+	}
+}
+
+func (h *HealthTracker) recordFailure(kind string, name string, health *EntityHealth, reason string) {
+	if health == nil {
+		return
+	}
+	health.ConsecutiveFailures++
+	health.LastError = reason
+
+	switch health.State {
+	case healthHealthy:
+		if health.ConsecutiveFailures >= h.failureThreshold {
+			h.markUnhealthy(kind, name, health, reason)
+		}
+	case healthProbation:
+		health.backoff *= 2
+		if health.backoff > h.maxBackoff {
+			health.backoff = h.maxBackoff
+		}
+		h.markUnhealthy(kind, name, health, reason)
+	}
+}
+
+func (h *HealthTracker) markUnhealthy(kind string, name string, health *EntityHealth, reason string) {
+	health.RetryAt = time.Now().Add(health.backoff)
+	health.Backoff = health.backoff.String()
+	h.transition(kind, name, health, healthUnhealthy, reason)
+}
+
+func (h *HealthTracker) transition(kind string, name string, health *EntityHealth, to string, reason string) {
+	from := health.State
+	health.State = to
+	health.LastTransition = time.Now()
+
+	log.Printf("Health: %s %s %s -> %s (%s)\n", kind, name, from, to, reason)
+
+	h.transitions = append(h.transitions, HealthTransition{
+		Time: health.LastTransition, Kind: kind, Name: name, From: from, To: to, Reason: reason,
+	})
+	if len(h.transitions) > h.maxTransitionsKept {
+		h.transitions = h.transitions[len(h.transitions)-h.maxTransitionsKept:]
+	}
+}
+
+func (h *HealthTracker) GetStatus() HealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := HealthStatus{
+		Hosts:       make(map[string]EntityHealth),
+		Pods:        make(map[string]EntityHealth),
+		Transitions: append([]HealthTransition{}, h.transitions...),
+	}
+	for hostname, health := range h.hosts {
+		status.Hosts[hostname] = *health
+	}
+	for podname, health := range h.pods {
+		status.Pods[podname] = *health
+	}
+	return status
+}
+
+func handleHealthReport(
+	health *HealthTracker,
+	estimator *CapacityEstimator,
+	topology *Topology,
+	w http.ResponseWriter,
+	r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		respondWithMethodNotAllowed(w, r)
+		return
+	}
+
+	lbName := r.URL.Query().Get("lb")
+	podname := r.URL.Query().Get("pod")
+	if address := r.URL.Query().Get("endpoint"); podname == "" && address != "" {
+		var ok bool
+		if podname, ok = topology.GetPodnameByAddress(address); !ok {
+			respondWithError(w, fmt.Sprintf("no pod has address %s", address))
+			return
+		}
+	}
+	requests, err := strconv.Atoi(r.URL.Query().Get("requests"))
+	if err != nil {
+		respondWithError(w, fmt.Sprintf("invalid requests: %s", err))
+		return
+	}
+	errors, err := strconv.Atoi(r.URL.Query().Get("errors"))
+	if err != nil {
+		respondWithError(w, fmt.Sprintf("invalid errors: %s", err))
+		return
+	}
+
+	// a report without latency_ms says nothing about the latency
+	latencyMs, hasLatency := 0.0, false
+	if latencyStr := r.URL.Query().Get("latency_ms"); latencyStr != "" {
+		latencyMs, err = strconv.ParseFloat(latencyStr, 64)
+		if err != nil || latencyMs < 0 {
+			respondWithError(w, fmt.Sprintf("invalid latency_ms %q", latencyStr))
+			return
+		}
+		hasLatency = true
+	}
+
+	if err := health.RecordLBObservation(lbName, podname, requests, errors); err != nil {
+		respondWithError(w, err.Error())
+		return
+	}
+	estimator.RecordLBObservation(podname, requests, errors, latencyMs, hasLatency)
+	respondWithJSON(w, health.GetStatus().Pods[podname])
+}
+
+func registerHealthHandlers(mux *http.ServeMux, health *HealthTracker, estimator *CapacityEstimator, topology *Topology, replica *Replica) {
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, health.GetStatus())
+	})
+	mux.HandleFunc("/health/report", forwardWritesToLeader(replica, func(w http.ResponseWriter, r *http.Request) {
+		handleHealthReport(health, estimator, topology, w, r)
+	}))
+}
+
+/*
+getHealthTracker builds the health tracker configured by the environment:
+  - HEALTH_FAILURE_THRESHOLD:   consecutive failures that make a host or pod unhealthy, default 3
+  - HEALTH_INITIAL_BACKOFF_MS:  first backoff of an unhealthy host or pod, default 5000
+  - HEALTH_MAX_BACKOFF_MS:      max backoff, default 120000
+  - POD_REPORT_TIMEOUT_MS:      time without a report after which a pod fails, 0 (default) to not expect reports
+  - LB_ERROR_RATE_TO_FAIL:      error rate seen by an LB that counts as a pod failure, default 0.5
+*/
+func getHealthTracker() *HealthTracker {
+	return NewHealthTracker(
+		int(getEnvFloat("HEALTH_FAILURE_THRESHOLD", 3)),
+		time.Duration(getEnvFloat("HEALTH_INITIAL_BACKOFF_MS", 5000))*time.Millisecond,
+		time.Duration(getEnvFloat("HEALTH_MAX_BACKOFF_MS", 120000))*time.Millisecond,
+		time.Duration(getEnvFloat("POD_REPORT_TIMEOUT_MS", 0))*time.Millisecond,
+		getEnvFloat("LB_ERROR_RATE_TO_FAIL", 0.5),
+	)
+}
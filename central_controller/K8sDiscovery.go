@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+/*
+Kubernetes discovery:
+	instead of being written by hand, the topology can be built from the
+	cluster through informers, and is rebuilt whenever they see a change:
+		- every Node matching nodeSelector is a host; its loadCapacity is the
+		  mclb/load-capacity annotation (defaultLoadCapacity if it has none),
+		  its capacities the mclb/capacities annotation ({"<resource>": capacity}),
+		  its load source the mclb/load-source annotation (see LoadSources.go)
+		  and its zone and region the topology.kubernetes.io/zone and /region labels
+		- every running Pod in namespace matching podSelector, with an IP and
+		  on one of the hosts, is a pod; its address is <pod IP>:<port>, where
+		  port is the mclb/port annotation, else podPort, else the first port
+		  of its containers; its demand is the mclb/demand annotation
+		- every Service in namespace matching serviceSelector and selecting
+		  pods is an LB, made up of the pods its selector matches (a pod
+		  matched by several Services belongs to the first of them by name);
+		  its address is the mclb/lb-address annotation, which it must have
+		  (the cluster IP of the Service would lead to its pods, not to the
+		  LB in front of them); the address of its control endpoint is the
+		  mclb/control-address annotation, else port 3001 of its address;
+		  its demand, zone and region are the mclb/demand, mclb/zone and
+		  mclb/region annotations
+	a node, pod or Service with an invalid annotation (or a Service without
+	mclb/lb-address) is logged and left out of the topology, rather than
+	holding back the changes of the rest of the cluster
+	a rebuilt topology replaces the whole topology (including changes made
+	through the topology API) if it is valid, otherwise the controller keeps
+	running on the last good topology
+	the discovery only needs a kubernetes.Interface, so it runs as well on the
+	fake clientset of client-go as on a cluster
+*/
+
+const (
+	loadCapacityAnnotation   = "mclb/load-capacity"
+	capacitiesAnnotation     = "mclb/capacities"
+	loadSourceAnnotation     = "mclb/load-source"
+	portAnnotation           = "mclb/port"
+	demandAnnotation         = "mclb/demand"
+	lbAddressAnnotation      = "mclb/lb-address"
+	controlAddressAnnotation = "mclb/control-address"
+	zoneAnnotation           = "mclb/zone"
+	regionAnnotation         = "mclb/region"
+)
+
+type KubernetesDiscovery struct {
+	namespace           string
+	nodeSelector        labels.Selector
+	podSelector         labels.Selector
+	serviceSelector     labels.Selector
+	defaultLoadCapacity int
+	podPort             int
+
+	factory       informers.SharedInformerFactory
+	nodeLister    listersv1.NodeLister
+	podLister     listersv1.PodLister
+	serviceLister listersv1.ServiceLister
+	synced        []cache.InformerSynced
+
+	// changed is signalled (without blocking) on every informer event
+	changed chan struct{}
+}
+
+func NewKubernetesDiscovery(
+	client kubernetes.Interface,
+	namespace string,
+	nodeSelector string,
+	podSelector string,
+	serviceSelector string,
+	defaultLoadCapacity int,
+	podPort int,
+	resync time.Duration) (*KubernetesDiscovery, error) {
+
+	if defaultLoadCapacity <= 0 {
+		return nil, fmt.Errorf("default load capacity must be positive, got %d", defaultLoadCapacity)
+	}
+
+	selectors := make([]labels.Selector, 3)
+	for i, selector := range []string{nodeSelector, podSelector, serviceSelector} {
+		parsed, err := labels.Parse(selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label selector %q: %w", selector, err)
+		}
+		selectors[i] = parsed
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(client, resync, informers.WithNamespace(namespace))
+	nodeInformer := factory.Core().V1().Nodes()
+	podInformer := factory.Core().V1().Pods()
+	serviceInformer := factory.Core().V1().Services()
+
+	d := &KubernetesDiscovery{
+		namespace:           namespace,
+		nodeSelector:        selectors[0],
+		podSelector:         selectors[1],
+		serviceSelector:     selectors[2],
+		defaultLoadCapacity: defaultLoadCapacity,
+		podPort:             podPort,
+		factory:             factory,
+		nodeLister:          nodeInformer.Lister(),
+		podLister:           podInformer.Lister(),
+		serviceLister:       serviceInformer.Lister(),
+		changed:             make(chan struct{}, 1),
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { d.notify() },
+		UpdateFunc: func(interface{}, interface{}) { d.notify() },
+		DeleteFunc: func(interface{}) { d.notify() },
+	}
+	for _, informer := range []cache.SharedIndexInformer{
+		nodeInformer.Informer(),
+		podInformer.Informer(),
+		serviceInformer.Informer(),
+	} {
+		if _, err := informer.AddEventHandler(handler); err != nil {
+			return nil, fmt.Errorf("couldn't watch the cluster: %w", err)
+		}
+		d.synced = append(d.synced, informer.HasSynced)
+	}
+
+	return d, nil
+}
+
+func (d *KubernetesDiscovery) notify() {
+	select {
+	case d.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Start starts the informers and waits until they have listed the cluster
+func (d *KubernetesDiscovery) Start(stopCh <-chan struct{}) error {
+	d.factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, d.synced...) {
+		return fmt.Errorf("couldn't list the nodes, pods and services of the cluster")
+	}
+	return nil
+}
+
+func parseAnnotationJSON(annotations map[string]string, key string, value interface{}) error {
+	data, ok := annotations[key]
+	if !ok {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(data), value); err != nil {
+		return fmt.Errorf("couldn't parse annotation %s: %w", key, err)
+	}
+	return nil
+}
+
+func (d *KubernetesDiscovery) getHostProps(node *corev1.Node) (HostProps, error) {
+	hostProps := HostProps{
+		Name:         node.Name,
+		LoadCapacity: d.defaultLoadCapacity,
+		Zone:         node.Labels[corev1.LabelTopologyZone],
+		Region:       node.Labels[corev1.LabelTopologyRegion],
+		PodNames:     []string{},
+	}
+	if loadCapacity, ok := node.Annotations[loadCapacityAnnotation]; ok {
+		value, err := strconv.Atoi(loadCapacity)
+		if err != nil {
+			return HostProps{}, fmt.Errorf("node %s: couldn't parse annotation %s: %w", node.Name, loadCapacityAnnotation, err)
+		}
+		hostProps.LoadCapacity = value
+	}
+	if err := parseAnnotationJSON(node.Annotations, capacitiesAnnotation, &hostProps.Capacities); err != nil {
+		return HostProps{}, fmt.Errorf("node %s: %w", node.Name, err)
+	}
+	if err := parseAnnotationJSON(node.Annotations, loadSourceAnnotation, &hostProps.LoadSource); err != nil {
+		return HostProps{}, fmt.Errorf("node %s: %w", node.Name, err)
+	}
+	// (a host on its own is a valid topology unless its own props are not)
+	if err := validateTopology(map[string]HostProps{node.Name: hostProps}, nil, nil); err != nil {
+		return HostProps{}, fmt.Errorf("node %s: %w", node.Name, err)
+	}
+	return hostProps, nil
+}
+
+func validateDemand(demand map[string]float64) error {
+	for resource, amount := range demand {
+		if amount < 0 {
+			return fmt.Errorf("negative demand %g of %s", amount, resource)
+		}
+	}
+	return nil
+}
+
+func (d *KubernetesDiscovery) getPodPort(pod *corev1.Pod) (int, error) {
+	if port, ok := pod.Annotations[portAnnotation]; ok {
+		value, err := strconv.Atoi(port)
+		if err != nil {
+			return 0, fmt.Errorf("couldn't parse annotation %s: %w", portAnnotation, err)
+		}
+		return value, nil
+	}
+	if d.podPort > 0 {
+		return d.podPort, nil
+	}
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			return int(port.ContainerPort), nil
+		}
+	}
+	return 0, fmt.Errorf("has no port")
+}
+
+func isPodUsable(pod *corev1.Pod) bool {
+	return pod.DeletionTimestamp == nil &&
+		pod.Status.Phase == corev1.PodRunning &&
+		pod.Status.PodIP != "" &&
+		pod.Spec.NodeName != ""
+}
+
+func getLBProps(service *corev1.Service) (LBProps, error) {
+	address, ok := service.Annotations[lbAddressAnnotation]
+	if !ok || address == "" {
+		return LBProps{}, fmt.Errorf("service %s: has no annotation %s", service.Name, lbAddressAnnotation)
+	}
+	lbProps := LBProps{
+		Name:           service.Name,
+		IPAddress:      address,
+		ControlAddress: service.Annotations[controlAddressAnnotation],
+		PodNames:       []string{},
+		Zone:           service.Annotations[zoneAnnotation],
+		Region:         service.Annotations[regionAnnotation],
+	}
+	if err := parseAnnotationJSON(service.Annotations, demandAnnotation, &lbProps.Demand); err != nil {
+		return LBProps{}, fmt.Errorf("service %s: %w", service.Name, err)
+	}
+	if err := validateDemand(lbProps.Demand); err != nil {
+		return LBProps{}, fmt.Errorf("service %s: %w", service.Name, err)
+	}
+	return lbProps, nil
+}
+
+func (d *KubernetesDiscovery) getPodProps(pod *corev1.Pod) (PodProps, error) {
+	port, err := d.getPodPort(pod)
+	if err != nil {
+		return PodProps{}, fmt.Errorf("pod %s: %w", pod.Name, err)
+	}
+	podProps := PodProps{
+		Name:      pod.Name,
+		IPAddress: net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(port)),
+		HostName:  pod.Spec.NodeName,
+	}
+	if err := parseAnnotationJSON(pod.Annotations, demandAnnotation, &podProps.Demand); err != nil {
+		return PodProps{}, fmt.Errorf("pod %s: %w", pod.Name, err)
+	}
+	if err := validateDemand(podProps.Demand); err != nil {
+		return PodProps{}, fmt.Errorf("pod %s: %w", pod.Name, err)
+	}
+	return podProps, nil
+}
+
+// GetTopology builds the topology from what the informers last saw of the
+// cluster
+func (d *KubernetesDiscovery) GetTopology() (map[string]HostProps, map[string]PodProps, map[string]LBProps, error) {
+
+	nodes, err := d.nodeLister.List(d.nodeSelector)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("couldn't list nodes: %w", err)
+	}
+	k8sPods, err := d.podLister.Pods(d.namespace).List(d.podSelector)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("couldn't list pods: %w", err)
+	}
+	services, err := d.serviceLister.Services(d.namespace).List(d.serviceSelector)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("couldn't list services: %w", err)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+
+	hosts := make(map[string]HostProps)
+	for _, node := range nodes {
+		hostProps, err := d.getHostProps(node)
+		if err != nil {
+			log.Printf("Discovery: skipping %s\n", err)
+			continue
+		}
+		hosts[node.Name] = hostProps
+	}
+
+	LBs := make(map[string]LBProps)
+	for _, service := range services {
+		if len(service.Spec.Selector) == 0 {
+			continue
+		}
+		lbProps, err := getLBProps(service)
+		if err != nil {
+			log.Printf("Discovery: skipping %s\n", err)
+			continue
+		}
+		LBs[service.Name] = lbProps
+	}
+
+	pods := make(map[string]PodProps)
+	for _, pod := range k8sPods {
+		if !isPodUsable(pod) {
+			continue
+		}
+		hostProps, ok := hosts[pod.Spec.NodeName]
+		if !ok {
+			log.Printf("Discovery: skipping pod %s on unmanaged node %s\n", pod.Name, pod.Spec.NodeName)
+			continue
+		}
+		podProps, err := d.getPodProps(pod)
+		if err != nil {
+			log.Printf("Discovery: skipping %s\n", err)
+			continue
+		}
+		for _, service := range services {
+			lbProps, ok := LBs[service.Name]
+			if ok && labels.SelectorFromSet(service.Spec.Selector).Matches(labels.Set(pod.Labels)) {
+				podProps.LBname = service.Name
+				lbProps.PodNames = append(lbProps.PodNames, pod.Name)
+				LBs[service.Name] = lbProps
+				break
+			}
+		}
+		hostProps.PodNames = append(hostProps.PodNames, pod.Name)
+		hosts[pod.Spec.NodeName] = hostProps
+		pods[pod.Name] = podProps
+	}
+
+	for hostname, hostProps := range hosts {
+		sort.Strings(hostProps.PodNames)
+		hosts[hostname] = hostProps
+	}
+	for lbName, lbProps := range LBs {
+		sort.Strings(lbProps.PodNames)
+		LBs[lbName] = lbProps
+	}
+
+	if err := validateTopology(hosts, pods, LBs); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid cluster topology: %w", err)
+	}
+
+	return hosts, pods, LBs, nil
+}
+
+// Watch rebuilds the topology whenever the informers see a change, and
+// replaces it if it changed
+func (d *KubernetesDiscovery) Watch(topology *Topology, stopCh <-chan struct{}) {
+	lastHosts, lastPods, lastLBs := topology.Get()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-d.changed:
+		}
+
+		hosts, pods, LBs, err := d.GetTopology()
+		if err != nil {
+			log.Printf("Error: keeping the last good topology: %s\n", err)
+			continue
+		}
+		if reflect.DeepEqual(hosts, lastHosts) && reflect.DeepEqual(pods, lastPods) && reflect.DeepEqual(LBs, lastLBs) {
+			continue
+		}
+		lastHosts, lastPods, lastLBs = hosts, pods, LBs
+
+		topology.Replace(hosts, pods, LBs)
+		log.Printf("Topology: rediscovered from the cluster\n")
+		logTopology(hosts, pods, LBs)
+	}
+}
+
+// getKubernetesClient connects to the cluster of KUBECONFIG, or to the
+// cluster we run in if it is not set
+func getKubernetesClient() (kubernetes.Interface, error) {
+	var config *rest.Config
+	var err error
+	if kubeconfig := getEnvString("KUBECONFIG", ""); kubeconfig != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't configure the Kubernetes client: %w", err)
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+/*
+getKubernetesDiscovery builds the discovery configured by the environment:
+  - KUBECONFIG:                kubeconfig of the cluster, default the cluster we run in
+  - K8S_NAMESPACE:             namespace of the pods and services, default "default"
+  - K8S_NODE_SELECTOR:         label selector of the nodes that are hosts, default all
+  - K8S_POD_SELECTOR:          label selector of the pods, default all
+  - K8S_SERVICE_SELECTOR:      label selector of the services that are LBs, default all
+  - K8S_DEFAULT_LOAD_CAPACITY: loadCapacity of nodes without the annotation, default 22
+  - K8S_POD_PORT:              port of pods without the annotation, default their first container port
+  - K8S_RESYNC_MS:             period of the informers' resyncs, default 0 (none)
+*/
+func getKubernetesDiscovery() *KubernetesDiscovery {
+	client, err := getKubernetesClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	discovery, err := NewKubernetesDiscovery(
+		client,
+		getEnvString("K8S_NAMESPACE", "default"),
+		getEnvString("K8S_NODE_SELECTOR", ""),
+		getEnvString("K8S_POD_SELECTOR", ""),
+		getEnvString("K8S_SERVICE_SELECTOR", ""),
+		int(getEnvFloat("K8S_DEFAULT_LOAD_CAPACITY", 22)),
+		int(getEnvFloat("K8S_POD_PORT", 0)),
+		time.Duration(getEnvFloat("K8S_RESYNC_MS", 0))*time.Millisecond,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return discovery
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestNode(name string, labels map[string]string, annotations map[string]string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels, Annotations: annotations},
+	}
+}
+
+func newTestPod(name string, node string, ip string, phase corev1.PodPhase, labels map[string]string, annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: labels, Annotations: annotations},
+		Spec: corev1.PodSpec{
+			NodeName:   node,
+			Containers: []corev1.Container{{Name: "app", Ports: []corev1.ContainerPort{{ContainerPort: 3000}}}},
+		},
+		Status: corev1.PodStatus{Phase: phase, PodIP: ip},
+	}
+}
+
+func newTestService(name string, selector map[string]string, annotations map[string]string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+		Spec: corev1.ServiceSpec{
+			Selector:  selector,
+			ClusterIP: "10.96.0.10",
+			Ports:     []corev1.ServicePort{{Port: 80}},
+		},
+	}
+}
+
+func startTestDiscovery(t *testing.T, client *fake.Clientset) *KubernetesDiscovery {
+	t.Helper()
+
+	discovery, err := NewKubernetesDiscovery(client, "default", "", "", "", 22, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	if err := discovery.Start(stopCh); err != nil {
+		t.Fatal(err)
+	}
+	return discovery
+}
+
+func TestKubernetesDiscoveryGetTopology(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newTestNode("node1",
+			map[string]string{corev1.LabelTopologyZone: "zone-a", corev1.LabelTopologyRegion: "region-1"},
+			map[string]string{
+				loadCapacityAnnotation: "10",
+				capacitiesAnnotation:   `{"cpu": 4}`,
+				loadSourceAnnotation:   `{"address": "redis1:6379"}`,
+			}),
+		newTestNode("node2", nil, nil),
+		// skipped: a bad annotation
+		newTestNode("node3", nil, map[string]string{loadCapacityAnnotation: "lots"}),
+
+		newTestPod("pod1", "node1", "10.0.0.1", corev1.PodRunning,
+			map[string]string{"app": "a"},
+			map[string]string{portAnnotation: "8080", demandAnnotation: `{"cpu": 0.5}`}),
+		newTestPod("pod2", "node2", "10.0.0.2", corev1.PodRunning, map[string]string{"app": "a"}, nil),
+		newTestPod("pod3", "node2", "10.0.0.3", corev1.PodRunning, map[string]string{"app": "b"}, nil),
+		// skipped: not running, a bad annotation, and on a skipped node
+		newTestPod("pod4", "node1", "", corev1.PodPending, map[string]string{"app": "a"}, nil),
+		newTestPod("pod5", "node1", "10.0.0.5", corev1.PodRunning, map[string]string{"app": "a"}, map[string]string{demandAnnotation: "{"}),
+		newTestPod("pod6", "node3", "10.0.0.6", corev1.PodRunning, map[string]string{"app": "a"}, nil),
+
+		newTestService("lb-a", map[string]string{"app": "a"}, map[string]string{
+			lbAddressAnnotation:      "10.1.0.1:3000",
+			controlAddressAnnotation: "10.1.0.1:3001",
+			zoneAnnotation:           "zone-a",
+			demandAnnotation:         `{"requests": 2}`,
+		}),
+		// skipped: no LB address
+		newTestService("lb-b", map[string]string{"app": "b"}, nil),
+	)
+	discovery := startTestDiscovery(t, client)
+
+	hosts, pods, LBs, err := discovery.GetTopology()
+	if err != nil {
+		t.Fatalf("couldn't get topology: %s", err)
+	}
+
+	expectedHosts := map[string]HostProps{
+		"node1": {
+			Name:         "node1",
+			LoadCapacity: 10,
+			Capacities:   map[string]float64{"cpu": 4},
+			Zone:         "zone-a",
+			Region:       "region-1",
+			LoadSource:   &LoadSource{Address: "redis1:6379"},
+			PodNames:     []string{"pod1"},
+		},
+		"node2": {Name: "node2", LoadCapacity: 22, PodNames: []string{"pod2", "pod3"}},
+	}
+	expectedPods := map[string]PodProps{
+		"pod1": {Name: "pod1", IPAddress: "10.0.0.1:8080", HostName: "node1", LBname: "lb-a", Demand: map[string]float64{"cpu": 0.5}},
+		"pod2": {Name: "pod2", IPAddress: "10.0.0.2:3000", HostName: "node2", LBname: "lb-a"},
+		"pod3": {Name: "pod3", IPAddress: "10.0.0.3:3000", HostName: "node2"},
+	}
+	expectedLBs := map[string]LBProps{
+		"lb-a": {
+			Name:           "lb-a",
+			IPAddress:      "10.1.0.1:3000",
+			ControlAddress: "10.1.0.1:3001",
+			PodNames:       []string{"pod1", "pod2"},
+			Demand:         map[string]float64{"requests": 2},
+			Zone:           "zone-a",
+		},
+	}
+
+	if !reflect.DeepEqual(hosts, expectedHosts) {
+		t.Errorf("got hosts %+v, expected %+v", hosts, expectedHosts)
+	}
+	if !reflect.DeepEqual(pods, expectedPods) {
+		t.Errorf("got pods %+v, expected %+v", pods, expectedPods)
+	}
+	if !reflect.DeepEqual(LBs, expectedLBs) {
+		t.Errorf("got LBs %+v, expected %+v", LBs, expectedLBs)
+	}
+}
+
+func TestKubernetesDiscoveryWatchReplacesTopology(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newTestNode("node1", nil, nil),
+		newTestNode("node2", nil, nil),
+		newTestPod("pod1", "node1", "10.0.0.1", corev1.PodRunning, map[string]string{"app": "a"}, nil),
+		newTestPod("pod2", "node2", "10.0.0.2", corev1.PodRunning, map[string]string{"app": "a"}, nil),
+		newTestService("lb-a", map[string]string{"app": "a"}, map[string]string{lbAddressAnnotation: "10.1.0.1:3000"}),
+	)
+	discovery := startTestDiscovery(t, client)
+
+	hosts, pods, LBs, err := discovery.GetTopology()
+	if err != nil {
+		t.Fatalf("couldn't get topology: %s", err)
+	}
+	topology := NewTopology(hosts, pods, LBs)
+
+	stopWatch := make(chan struct{})
+	defer close(stopWatch)
+	go discovery.Watch(topology, stopWatch)
+
+	// the pod moves to another address and stops being part of the LB
+	pod, err := client.CoreV1().Pods("default").Get(context.Background(), "pod2", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod.Labels = map[string]string{"app": "b"}
+	pod.Status.PodIP = "10.0.0.20"
+	if _, err := client.CoreV1().Pods("default").Update(context.Background(), pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedPod := PodProps{Name: "pod2", IPAddress: "10.0.0.20:3000", HostName: "node2"}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, pods, LBs := topology.Get()
+		if reflect.DeepEqual(pods["pod2"], expectedPod) {
+			if !reflect.DeepEqual(LBs["lb-a"].PodNames, []string{"pod1"}) {
+				t.Errorf("LB lb-a has pods %v after the change, expected [pod1]", LBs["lb-a"].PodNames)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("topology has pod %+v, expected %+v", pods["pod2"], expectedPod)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+Load sources:
+	the load of every host is read from a Redis, its load source, which the
+	host sets in the topology as
+		"loadSource": {"address": "<host:port>", "db": 0, "key": "outstanding_requests",
+		               "leasePrefix": "", "username": "", "passwordEnv": "<env var holding the password>"}
+	a host without a load source uses the default one (LOAD_SOURCE_DEFAULT_*)
+	the load of a host is the value of its key or, with a leasePrefix, the sum
+	of the in-flight requests in the leases of its pods, the hashes
+	<leasePrefix>:<pod> that each pod renews while it is alive (a lease that
+	has expired, e.g. of a pod that crashed, is no load)
+	the password is read from the environment so that it is never part of the
+	topology (which is served by the topology API, logged and snapshotted)
+	hosts whose load sources only differ by key share an endpoint (one
+	client); the connections are checked at startup, and an endpoint that
+	can't be read is reconnected to (with a new client) every
+	reconnectInterval until it can be read again
+
+Polling:
+	every round the endpoints are polled concurrently (at most concurrency at
+	a time), each with a single pipeline reading the keys of all of its hosts,
+	within timeout per endpoint and deadline for the whole poll; every host
+	gets an explicit result:
+		- "ok":      its load
+		- "no_data": its key does not exist (nothing counted the load yet), or
+		             none of its pods has a live lease
+		- "error":   the endpoint or the value of the key is broken
+		- "timeout": the endpoint did not answer in time
+	the latency of the last poll of every host (and a smoothed one) is kept
+
+Load sources API:
+	GET /loadsources    the load source of every host, whether it is connected and its poll latency
+*/
+
+const defaultLoadKey = "outstanding_requests"
+
+const (
+	pollOK      = "ok"
+	pollNoData  = "no_data"
+	pollError   = "error"
+	pollTimeout = "timeout"
+)
+
+// weight of the old latency when smoothing the poll latency of a host
+const pollLatencySmoothing = 0.8
+
+type LoadSource struct {
+	Address     string `json:"address"`
+	DB          int    `json:"db,omitempty"`
+	Key         string `json:"key,omitempty"`
+	LeasePrefix string `json:"leasePrefix,omitempty"`
+	Username    string `json:"username,omitempty"`
+	PasswordEnv string `json:"passwordEnv,omitempty"`
+}
+
+func (s LoadSource) GetKey() string {
+	if s.Key == "" {
+		return defaultLoadKey
+	}
+	return s.Key
+}
+
+// getEndpoint returns the load source without its key (and lease prefix),
+// i.e. what the hosts sharing a client have in common
+func (s LoadSource) getEndpoint() LoadSource {
+	s.Key = ""
+	s.LeasePrefix = ""
+	return s
+}
+
+// validateLoadSource reports what is wrong with a host's load source
+func validateLoadSource(hostname string, source *LoadSource) []string {
+	if source == nil {
+		return nil
+	}
+	var problems []string
+	if source.Address == "" {
+		problems = append(problems, fmt.Sprintf("host %s has a loadSource without an address", hostname))
+	}
+	if source.DB < 0 {
+		problems = append(problems, fmt.Sprintf("host %s has a loadSource with negative db %d", hostname, source.DB))
+	}
+	if source.PasswordEnv != "" {
+		if _, ok := os.LookupEnv(source.PasswordEnv); !ok {
+			problems = append(problems, fmt.Sprintf("host %s has a loadSource whose passwordEnv %s is not set", hostname, source.PasswordEnv))
+		}
+	}
+	return problems
+}
+
+// LoadPoll is the result of polling the load of a host
+type LoadPoll struct {
+	Status  string
+	Load    int
+	Err     error
+	Latency time.Duration
+}
+
+type LoadSourceStatus struct {
+	LoadSource
+	Connected       bool      `json:"connected"`
+	LastError       string    `json:"lastError,omitempty"`
+	ConnectedAt     time.Time `json:"connectedAt"`
+	LastPoll        string    `json:"lastPoll,omitempty"`
+	LastLatencyMs   float64   `json:"lastLatencyMs"`
+	SmoothLatencyMs float64   `json:"smoothLatencyMs"`
+}
+
+type loadSourceEndpoint struct {
+	source      LoadSource
+	client      *redis.Client
+	connected   bool
+	lastError   string
+	connectedAt time.Time
+	lastAttempt time.Time
+}
+
+type hostPollStats struct {
+	lastPoll      string
+	lastLatency   time.Duration
+	smoothLatency time.Duration
+}
+
+type LoadSources struct {
+	mu                sync.Mutex
+	defaultSource     LoadSource
+	timeout           time.Duration
+	deadline          time.Duration
+	concurrency       int
+	reconnectInterval time.Duration
+
+	sources     map[string]LoadSource
+	podsOfHosts map[string][]string
+	endpoints   map[LoadSource]*loadSourceEndpoint
+	stats       map[string]*hostPollStats
+}
+
+func NewLoadSources(
+	defaultSource LoadSource,
+	timeout time.Duration,
+	deadline time.Duration,
+	concurrency int,
+	reconnectInterval time.Duration) *LoadSources {
+
+	return &LoadSources{
+		defaultSource:     defaultSource,
+		timeout:           timeout,
+		deadline:          deadline,
+		concurrency:       concurrency,
+		reconnectInterval: reconnectInterval,
+		sources:           make(map[string]LoadSource),
+		podsOfHosts:       make(map[string][]string),
+		endpoints:         make(map[LoadSource]*loadSourceEndpoint),
+		stats:             make(map[string]*hostPollStats),
+	}
+}
+
+func (l *LoadSources) getSource(host HostProps) LoadSource {
+	if host.LoadSource != nil {
+		return *host.LoadSource
+	}
+	return l.defaultSource
+}
+
+func (l *LoadSources) newEndpoint(endpoint LoadSource) *loadSourceEndpoint {
+	return &loadSourceEndpoint{
+		source: endpoint,
+		client: redis.NewClient(&redis.Options{
+			Addr:         endpoint.Address,
+			Username:     endpoint.Username,
+			Password:     os.Getenv(endpoint.PasswordEnv),
+			DB:           endpoint.DB,
+			DialTimeout:  l.timeout,
+			ReadTimeout:  l.timeout,
+			WriteTimeout: l.timeout,
+		}),
+		lastAttempt: time.Now(),
+	}
+}
+
+// Reconcile takes the load sources of hosts that were added to the topology
+// or whose load source changed, and disconnects from the endpoints that no
+// host uses anymore
+func (l *LoadSources) Reconcile(hosts map[string]HostProps) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sources = make(map[string]LoadSource)
+	l.podsOfHosts = make(map[string][]string)
+	used := make(map[LoadSource]bool)
+	for hostname, host := range hosts {
+		source := l.getSource(host)
+		l.sources[hostname] = source
+		l.podsOfHosts[hostname] = copyStrings(host.PodNames)
+		used[source.getEndpoint()] = true
+	}
+
+	for endpoint, conn := range l.endpoints {
+		if !used[endpoint] {
+			conn.client.Close()
+			delete(l.endpoints, endpoint)
+		}
+	}
+	for endpoint := range used {
+		if _, ok := l.endpoints[endpoint]; !ok {
+			l.endpoints[endpoint] = l.newEndpoint(endpoint)
+		}
+	}
+
+	for hostname := range l.stats {
+		if _, ok := hosts[hostname]; !ok {
+			delete(l.stats, hostname)
+		}
+	}
+	for hostname := range hosts {
+		if _, ok := l.stats[hostname]; !ok {
+			l.stats[hostname] = &hostPollStats{}
+		}
+	}
+}
+
+// Validate polls the load source of every host and reports the ones that
+// can't be reached
+func (l *LoadSources) Validate(hosts map[string]HostProps) error {
+	l.Reconcile(hosts)
+
+	var problems []string
+	for hostname, poll := range l.PollLoads() {
+		if poll.Status == pollError || poll.Status == pollTimeout {
+			problems = append(problems, fmt.Sprintf("load source of host %s is unreachable: %s", hostname, poll.Err))
+		}
+	}
+	return getProblemsAsError(problems)
+}
+
+// getEndpointToPoll returns the client of an endpoint, after reconnecting
+// to it if it was unreachable for reconnectInterval
+func (l *LoadSources) getEndpointToPoll(endpoint LoadSource) *loadSourceEndpoint {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	conn := l.endpoints[endpoint]
+	if !conn.connected && conn.lastError != "" && time.Since(conn.lastAttempt) >= l.reconnectInterval {
+		log.Printf("Load source: reconnecting to %s\n", endpoint.Address)
+		conn.client.Close()
+		newConn := l.newEndpoint(endpoint)
+		newConn.lastError = conn.lastError
+		l.endpoints[endpoint] = newConn
+		conn = newConn
+	}
+	return conn
+}
+
+func (l *LoadSources) recordEndpointResult(conn *loadSourceEndpoint, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err != nil {
+		if conn.connected || conn.lastError == "" {
+			log.Printf("Load source: lost %s: %s\n", conn.source.Address, err)
+		}
+		conn.connected = false
+		conn.lastError = err.Error()
+		return
+	}
+	if !conn.connected {
+		log.Printf("Load source: connected to %s (db %d)\n", conn.source.Address, conn.source.DB)
+		conn.connected = true
+		conn.connectedAt = time.Now()
+		conn.lastError = ""
+	}
+}
+
+func getPollStatus(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return pollTimeout
+	}
+	var netErr interface{ Timeout() bool }
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return pollTimeout
+	}
+	return pollError
+}
+
+// hostLoadRead is what to read to get the load of a host: its key, or the
+// leases of its pods
+type hostLoadRead struct {
+	hostname string
+	keys     []string
+	leased   bool
+}
+
+func getHostLoadRead(hostname string, source LoadSource, podnames []string) hostLoadRead {
+	if source.LeasePrefix == "" {
+		return hostLoadRead{hostname: hostname, keys: []string{source.GetKey()}}
+	}
+	read := hostLoadRead{hostname: hostname, leased: true}
+	for _, podname := range podnames {
+		read.keys = append(read.keys, getLeaseKey(source.LeasePrefix, podname))
+	}
+	return read
+}
+
+func getLeaseKey(leasePrefix string, podname string) string {
+	return leasePrefix + ":" + podname
+}
+
+// getHostLoadPoll sums up the values read for a host; a missing key of a
+// leased host is a pod without a live lease, which has no load
+func getHostLoadPoll(read hostLoadRead, cmds []*redis.StringCmd, latency time.Duration) LoadPoll {
+	load := 0
+	live := 0
+	for i, cmd := range cmds {
+		value, err := cmd.Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return LoadPoll{Status: pollError, Err: err, Latency: latency}
+		}
+		podLoad, err := strconv.Atoi(value)
+		if err != nil {
+			return LoadPoll{Status: pollError, Err: fmt.Errorf("invalid load %q in %s", value, read.keys[i]), Latency: latency}
+		}
+		load += podLoad
+		live++
+	}
+	if live == 0 {
+		if read.leased && len(read.keys) == 0 {
+			return LoadPoll{Status: pollOK, Latency: latency}
+		}
+		if read.leased {
+			return LoadPoll{Status: pollNoData, Err: fmt.Errorf("none of its %d pods has a live lease", len(read.keys)), Latency: latency}
+		}
+		return LoadPoll{Status: pollNoData, Err: fmt.Errorf("%s does not exist", read.keys[0]), Latency: latency}
+	}
+	return LoadPoll{Status: pollOK, Load: load, Latency: latency}
+}
+
+// pollEndpoint reads the loads of the given hosts from an endpoint in one
+// pipeline
+func (l *LoadSources) pollEndpoint(ctx context.Context, endpoint LoadSource, reads []hostLoadRead) map[string]LoadPoll {
+
+	conn := l.getEndpointToPoll(endpoint)
+
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+
+	start := time.Now()
+	pipe := conn.client.Pipeline()
+	cmds := make([][]*redis.StringCmd, len(reads))
+	for i, read := range reads {
+		for _, key := range read.keys {
+			if read.leased {
+				cmds[i] = append(cmds[i], pipe.HGet(ctx, key, "inflight"))
+			} else {
+				cmds[i] = append(cmds[i], pipe.Get(ctx, key))
+			}
+		}
+	}
+	var err error
+	if pipe.Len() > 0 {
+		_, err = pipe.Exec(ctx)
+	}
+	latency := time.Since(start)
+
+	polls := make(map[string]LoadPoll)
+
+	// a missing key (or a key of the wrong type) fails the pipeline too, but
+	// doesn't break the endpoint
+	var replyErr redis.Error
+	if err != nil && err != redis.Nil && !errors.As(err, &replyErr) {
+		l.recordEndpointResult(conn, err)
+		for _, read := range reads {
+			polls[read.hostname] = LoadPoll{
+				Status:  getPollStatus(err),
+				Err:     fmt.Errorf("couldn't read from %s: %w", endpoint.Address, err),
+				Latency: latency,
+			}
+		}
+		return polls
+	}
+	l.recordEndpointResult(conn, nil)
+
+	for i, read := range reads {
+		polls[read.hostname] = getHostLoadPoll(read, cmds[i], latency)
+	}
+	return polls
+}
+
+// PollLoads polls the load of every host concurrently, and returns a result
+// for every host by the deadline
+func (l *LoadSources) PollLoads() map[string]LoadPoll {
+
+	l.mu.Lock()
+	hostsOfEndpoints := make(map[LoadSource][]string)
+	for hostname, source := range l.sources {
+		endpoint := source.getEndpoint()
+		hostsOfEndpoints[endpoint] = append(hostsOfEndpoints[endpoint], hostname)
+	}
+	sources := make(map[string]LoadSource)
+	for hostname, source := range l.sources {
+		sources[hostname] = source
+	}
+	podsOfHosts := make(map[string][]string)
+	for hostname, podnames := range l.podsOfHosts {
+		podsOfHosts[hostname] = podnames
+	}
+	l.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.deadline)
+	defer cancel()
+
+	start := time.Now()
+	results := make(chan map[string]LoadPoll, len(hostsOfEndpoints))
+	slots := make(chan struct{}, l.concurrency)
+
+	for endpoint, hostnames := range hostsOfEndpoints {
+		sort.Strings(hostnames)
+		reads := make([]hostLoadRead, len(hostnames))
+		for i, hostname := range hostnames {
+			reads[i] = getHostLoadRead(hostname, sources[hostname], podsOfHosts[hostname])
+		}
+
+		go func(endpoint LoadSource, reads []hostLoadRead) {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+				results <- l.pollEndpoint(ctx, endpoint, reads)
+			case <-ctx.Done():
+				results <- nil
+			}
+		}(endpoint, reads)
+	}
+
+	polls := make(map[string]LoadPoll)
+collect:
+	for i := 0; i < len(hostsOfEndpoints); i++ {
+		select {
+		case endpointPolls := <-results:
+			for hostname, poll := range endpointPolls {
+				polls[hostname] = poll
+			}
+		case <-ctx.Done():
+			// the endpoints that are still being polled will time out on
+			// their own; we don't wait for them
+			break collect
+		}
+	}
+
+	// the hosts whose endpoint did not answer by the deadline
+	for hostname := range sources {
+		if _, ok := polls[hostname]; !ok {
+			polls[hostname] = LoadPoll{
+				Status:  pollTimeout,
+				Err:     fmt.Errorf("no answer within the poll deadline of %s", l.deadline),
+				Latency: time.Since(start),
+			}
+		}
+	}
+
+	l.recordPolls(polls)
+
+	return polls
+}
+
+func (l *LoadSources) recordPolls(polls map[string]LoadPoll) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for hostname, poll := range polls {
+		stats, ok := l.stats[hostname]
+		if !ok {
+			continue
+		}
+		if stats.lastPoll == "" {
+			stats.smoothLatency = poll.Latency
+		} else {
+			stats.smoothLatency = time.Duration(pollLatencySmoothing*float64(stats.smoothLatency) + (1-pollLatencySmoothing)*float64(poll.Latency))
+		}
+		stats.lastPoll = poll.Status
+		stats.lastLatency = poll.Latency
+	}
+}
+
+func (l *LoadSources) GetStatus() map[string]LoadSourceStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	status := make(map[string]LoadSourceStatus)
+	for hostname, source := range l.sources {
+		conn := l.endpoints[source.getEndpoint()]
+		hostStatus := LoadSourceStatus{
+			LoadSource:  source,
+			Connected:   conn.connected,
+			LastError:   conn.lastError,
+			ConnectedAt: conn.connectedAt,
+		}
+		if stats, ok := l.stats[hostname]; ok {
+			hostStatus.LastPoll = stats.lastPoll
+			hostStatus.LastLatencyMs = float64(stats.lastLatency.Microseconds()) / 1000
+			hostStatus.SmoothLatencyMs = float64(stats.smoothLatency.Microseconds()) / 1000
+		}
+		status[hostname] = hostStatus
+	}
+	return status
+}
+
+func registerLoadSourceHandlers(mux *http.ServeMux, loadSources *LoadSources) {
+	mux.HandleFunc("/loadsources", func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, loadSources.GetStatus())
+	})
+}
+
+// getHostsWithoutLoadSource returns (sorted) the hosts that use the default
+// load source
+func getHostsWithoutLoadSource(hosts map[string]HostProps) []string {
+	var hostnames []string
+	for hostname, host := range hosts {
+		if host.LoadSource == nil {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+	sort.Strings(hostnames)
+	return hostnames
+}
+
+/*
+getLoadSources builds the load sources configured by the environment, and
+checks that every host's load source can be reached:
+  - LOAD_SOURCE_DEFAULT_ADDR:         load source of hosts without one, default "localhost:6379"
+  - LOAD_SOURCE_DEFAULT_DB:           default 0
+  - LOAD_SOURCE_DEFAULT_KEY:          default "outstanding_requests"
+  - LOAD_SOURCE_DEFAULT_LEASE_PREFIX: prefix of the pods' leases, default none (read the key)
+  - LOAD_SOURCE_DEFAULT_USERNAME:     default none
+  - LOAD_SOURCE_DEFAULT_PASSWORD_ENV: env var holding the password, default none
+  - LOAD_SOURCE_TIMEOUT_MS:           timeout of connecting to and polling an endpoint, default 1000
+  - LOAD_SOURCE_RECONNECT_MS:         time between reconnects to an unreachable endpoint, default 5000
+  - LOAD_SOURCE_STRICT:               "true" to refuse to start if a load source is unreachable
+  - LOAD_POLL_DEADLINE_MS:            deadline of polling all hosts, default half the interval
+  - LOAD_POLL_CONCURRENCY:            endpoints polled at a time, default 64
+*/
+func getLoadSources(hosts map[string]HostProps, interval time.Duration) *LoadSources {
+	defaultSource := LoadSource{
+		Address:     getEnvString("LOAD_SOURCE_DEFAULT_ADDR", "localhost:6379"),
+		DB:          int(getEnvFloat("LOAD_SOURCE_DEFAULT_DB", 0)),
+		Key:         getEnvString("LOAD_SOURCE_DEFAULT_KEY", defaultLoadKey),
+		LeasePrefix: os.Getenv("LOAD_SOURCE_DEFAULT_LEASE_PREFIX"),
+		Username:    os.Getenv("LOAD_SOURCE_DEFAULT_USERNAME"),
+		PasswordEnv: os.Getenv("LOAD_SOURCE_DEFAULT_PASSWORD_ENV"),
+	}
+	if problems := validateLoadSource("(default)", &defaultSource); len(problems) > 0 {
+		log.Fatal(getProblemsAsError(problems))
+	}
+
+	if hostnames := getHostsWithoutLoadSource(hosts); len(hostnames) > 0 {
+		log.Printf("Load source: hosts %v use the default load source %s\n", hostnames, defaultSource.Address)
+	}
+
+	concurrency := int(getEnvFloat("LOAD_POLL_CONCURRENCY", 64))
+	if concurrency <= 0 {
+		log.Fatalf("LOAD_POLL_CONCURRENCY must be positive, got %d", concurrency)
+	}
+
+	loadSources := NewLoadSources(
+		defaultSource,
+		time.Duration(getEnvFloat("LOAD_SOURCE_TIMEOUT_MS", 1000))*time.Millisecond,
+		time.Duration(getEnvFloat("LOAD_POLL_DEADLINE_MS", float64(interval.Milliseconds())/2))*time.Millisecond,
+		concurrency,
+		time.Duration(getEnvFloat("LOAD_SOURCE_RECONNECT_MS", 5000))*time.Millisecond,
+	)
+	if err := loadSources.Validate(hosts); err != nil {
+		if os.Getenv("LOAD_SOURCE_STRICT") == "true" {
+			log.Fatal(err)
+		}
+		log.Printf("Warning: %s\n", err)
+	}
+	return loadSources
+}
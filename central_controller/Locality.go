@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+/*
+Locality:
+
+	hosts carry the zone and region they are in, and so do LBs
+	sending an LB's traffic to a host has a transfer cost, the first of
+		- the network cost of the LB (or its zone) to the host (or its zone)
+		- sameZoneCost, sameRegionCost or crossRegionCost
+	an LB or host without a zone is taken to be in the same zone
+	an LB is assigned by its cost on a host plus weight * transfer cost, over
+	the hosts allowed by the policy:
+		- "cost":      all hosts
+		- "strict":    only the hosts in the LB's zone (if the LB has an
+		               available pod on any of them)
+		- "spillover": only the hosts in the LB's zone (as for strict),
+		               unless all of them are saturated (their load is at
+		               least spilloverUtilisation of their capacity), then
+		               all hosts
+*/
+type Locality struct {
+	policy               string
+	weight               float64
+	sameZoneCost         float64
+	sameRegionCost       float64
+	crossRegionCost      float64
+	spilloverUtilisation float64
+
+	// network costs by LB name or zone, then host name or zone
+	networkCosts map[string]map[string]float64
+}
+
+func NewLocality(
+	policy string,
+	weight float64,
+	sameZoneCost float64,
+	sameRegionCost float64,
+	crossRegionCost float64,
+	spilloverUtilisation float64,
+	networkCosts map[string]map[string]float64) (*Locality, error) {
+
+	if policy != "cost" && policy != "strict" && policy != "spillover" {
+		return nil, fmt.Errorf("invalid locality policy %q (must be cost, strict or spillover)", policy)
+	}
+	if spilloverUtilisation <= 0 {
+		return nil, fmt.Errorf("spillover utilisation must be positive, got %f", spilloverUtilisation)
+	}
+	return &Locality{
+		policy:               policy,
+		weight:               weight,
+		sameZoneCost:         sameZoneCost,
+		sameRegionCost:       sameRegionCost,
+		crossRegionCost:      crossRegionCost,
+		spilloverUtilisation: spilloverUtilisation,
+		networkCosts:         networkCosts,
+	}, nil
+}
+
+func (l *Locality) getNetworkCost(from []string, to []string) (float64, bool) {
+	for _, fromKey := range from {
+		for _, toKey := range to {
+			if cost, ok := l.networkCosts[fromKey][toKey]; ok && fromKey != "" && toKey != "" {
+				return cost, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// getTransferCost returns the cost of sending the LB's traffic to the host
+func (l *Locality) getTransferCost(LB LBProps, host HostProps) float64 {
+	if cost, ok := l.getNetworkCost([]string{LB.Name, LB.Zone}, []string{host.Name, host.Zone}); ok {
+		return cost
+	}
+	if LB.Zone == "" || host.Zone == "" || LB.Zone == host.Zone {
+		return l.sameZoneCost
+	}
+	if LB.Region != "" && LB.Region == host.Region {
+		return l.sameRegionCost
+	}
+	return l.crossRegionCost
+}
+
+// isZoneSaturated tells if every host of the zone is loaded to at least
+// spilloverUtilisation of its capacity (a host whose load we don't know,
+// e.g. one of another shard, is not)
+func (l *Locality) isZoneSaturated(zone string, hosts map[string]HostProps, hostLoads map[string]int) bool {
+	for hostname, host := range hosts {
+		if host.Zone != zone {
+			continue
+		}
+		load, ok := hostLoads[hostname]
+		if !ok || float64(load) < l.spilloverUtilisation*float64(host.LoadCapacity) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasLocalPod tells if the LB has an available pod on one of the hosts of
+// its zone that it has a cost on
+func hasLocalPod(
+	LB LBProps,
+	hosts map[string]HostProps,
+	pods map[string]PodProps,
+	health *HealthTracker,
+	costs map[string]float64) bool {
+
+	for _, podname := range LB.PodNames {
+		hostname := pods[podname].HostName
+		if _, ok := costs[hostname]; !ok || hosts[hostname].Zone != LB.Zone {
+			continue
+		}
+		if health.IsHostAvailable(hostname) && health.IsPodAvailable(podname) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddTransferCosts adds the transfer costs to the costs of every LB on the
+// hosts, leaving out the hosts the policy does not allow. hosts are all the
+// hosts of the topology (not only this shard's).
+func (l *Locality) AddTransferCosts(
+	LBs map[string]LBProps,
+	hosts map[string]HostProps,
+	pods map[string]PodProps,
+	hostLoads map[string]int,
+	health *HealthTracker,
+	costsForLBs map[string]map[string]float64) map[string]map[string]float64 {
+
+	if l == nil {
+		return costsForLBs
+	}
+
+	saturatedZones := make(map[string]bool)
+	if l.policy == "spillover" {
+		for _, host := range hosts {
+			if _, ok := saturatedZones[host.Zone]; !ok && host.Zone != "" {
+				saturatedZones[host.Zone] = l.isZoneSaturated(host.Zone, hosts, hostLoads)
+				if saturatedZones[host.Zone] {
+					log.Printf("Locality: zone %s is saturated, its LBs can spill over\n", host.Zone)
+				}
+			}
+		}
+	}
+
+	newCostsForLBs := make(map[string]map[string]float64)
+
+	for lbName, costs := range costsForLBs {
+		LB := LBs[lbName]
+
+		// an LB without an available pod in its zone can only go elsewhere
+		localOnly := LB.Zone != "" &&
+			(l.policy == "strict" || (l.policy == "spillover" && !saturatedZones[LB.Zone])) &&
+			hasLocalPod(LB, hosts, pods, health, costs)
+
+		newCosts := make(map[string]float64)
+		for hostname, cost := range costs {
+			host, ok := hosts[hostname]
+			if !ok {
+				newCosts[hostname] = cost
+				continue
+			}
+			if localOnly && host.Zone != LB.Zone {
+				continue
+			}
+			newCosts[hostname] = cost + l.weight*l.getTransferCost(LB, host)
+		}
+		newCostsForLBs[lbName] = newCosts
+	}
+
+	return newCostsForLBs
+}
+
+/*
+getLocality builds the locality configured by the environment:
+  - LOCALITY_POLICY:                "cost" (default), "strict" or "spillover"
+  - LOCALITY_WEIGHT:                weight of transfer costs against prices, default 1.0
+  - LOCALITY_SAME_ZONE_COST:        default 0
+  - LOCALITY_SAME_REGION_COST:      default 0.5
+  - LOCALITY_CROSS_REGION_COST:     default 2.0
+  - LOCALITY_SPILLOVER_UTILISATION: load/capacity at which a host is saturated, default 1.0
+  - NETWORK_COSTS:                  JSON {"<LB or zone>": {"<host or zone>": cost}}
+*/
+func getLocality() *Locality {
+
+	networkCosts := make(map[string]map[string]float64)
+	if networkCostsJSON := os.Getenv("NETWORK_COSTS"); networkCostsJSON != "" {
+		if err := json.Unmarshal([]byte(networkCostsJSON), &networkCosts); err != nil {
+			log.Fatalf("Error: couldn't parse NETWORK_COSTS: %s\n", err)
+		}
+	}
+
+	locality, err := NewLocality(
+		getEnvString("LOCALITY_POLICY", "cost"),
+		getEnvFloat("LOCALITY_WEIGHT", 1.0),
+		getEnvFloat("LOCALITY_SAME_ZONE_COST", 0),
+		getEnvFloat("LOCALITY_SAME_REGION_COST", 0.5),
+		getEnvFloat("LOCALITY_CROSS_REGION_COST", 2.0),
+		getEnvFloat("LOCALITY_SPILLOVER_UTILISATION", 1.0),
+		networkCosts,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return locality
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStrictLocalityNeedsAnAvailableLocalPod(t *testing.T) {
+	hosts := map[string]HostProps{
+		"host1": {Name: "host1", Zone: "a", LoadCapacity: 10, PodNames: []string{"pod1"}},
+		"host2": {Name: "host2", Zone: "b", LoadCapacity: 10, PodNames: []string{"pod2", "pod3"}},
+		"host3": {Name: "host3", Zone: "a", LoadCapacity: 10, PodNames: []string{}},
+	}
+	pods := map[string]PodProps{
+		"pod1": {Name: "pod1", HostName: "host1", LBname: "lb1"},
+		"pod2": {Name: "pod2", HostName: "host2", LBname: "lb1"},
+		"pod3": {Name: "pod3", HostName: "host2", LBname: "lb2"},
+	}
+	LBs := map[string]LBProps{
+		"lb1": {Name: "lb1", Zone: "a", PodNames: []string{"pod1", "pod2"}},
+		"lb2": {Name: "lb2", Zone: "a", PodNames: []string{"pod3"}},
+	}
+	costsForLBs := map[string]map[string]float64{
+		"lb1": {"host1": 1, "host2": 1, "host3": 1},
+		"lb2": {"host1": 1, "host2": 1, "host3": 1},
+	}
+
+	locality, err := NewLocality("strict", 1.0, 0, 0.5, 2.0, 1.0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	health := NewHealthTracker(1, time.Minute, time.Hour, 0, 0.5)
+	health.Reconcile(hosts, pods)
+
+	// lb1 stays in its zone; lb2 has no pod there, however many hosts the
+	// zone has
+	newCostsForLBs := locality.AddTransferCosts(LBs, hosts, pods, map[string]int{}, health, costsForLBs)
+	expected := map[string]map[string]float64{
+		"lb1": {"host1": 1, "host3": 1},
+		"lb2": {"host1": 1, "host2": 3, "host3": 1},
+	}
+	if !reflect.DeepEqual(newCostsForLBs, expected) {
+		t.Errorf("costs with healthy pods: got %v, expected %v", newCostsForLBs, expected)
+	}
+
+	// once lb1's local pod is unhealthy, lb1 can go elsewhere
+	if err := health.RecordLBObservation("lb1", "pod1", 10, 10); err != nil {
+		t.Fatal(err)
+	}
+	newCostsForLBs = locality.AddTransferCosts(LBs, hosts, pods, map[string]int{}, health, costsForLBs)
+	expected["lb1"] = map[string]float64{"host1": 1, "host2": 3, "host3": 1}
+	if !reflect.DeepEqual(newCostsForLBs, expected) {
+		t.Errorf("costs with an unhealthy local pod: got %v, expected %v", newCostsForLBs, expected)
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Operator overrides:
+	- drain a host: its effective price (the one the LBs are assigned by)
+	  doubles every round while LBs are still assigned to it, until none is
+	  (starting from minDrainedPrice if it is lower, so that a free host
+	  gets expensive too); the drain then reports the host as empty
+	- cordon a host: LBs that are not already on the host are not assigned to
+	  it
+	- pin an LB to a host: the LB is assigned to (its pods on) the host no
+	  matter the prices
+	every override expires after its duration (default defaultTTL), and the
+	prices computed by the controller are never changed by an override
+
+Overrides API:
+	GET    /overrides                                           all overrides, and whether drained hosts are empty
+	POST   /overrides/drain?host=<host>[&duration_ms=<ms>]
+	DELETE /overrides/drain?host=<host>
+	POST   /overrides/cordon?host=<host>[&duration_ms=<ms>]
+	DELETE /overrides/cordon?host=<host>
+	POST   /overrides/pin?lb=<lb>&host=<host>&duration_ms=<ms>
+	DELETE /overrides/pin?lb=<lb>
+*/
+
+// minDrainedPrice is the price the drain penalty of a host starts from if its
+// price is lower
+const minDrainedPrice = 0.001
+
+type HostDrain struct {
+	Host           string    `json:"host"`
+	Since          time.Time `json:"since"`
+	ExpiresAt      time.Time `json:"expiresAt"`
+	RoundsDraining int       `json:"roundsDraining"`
+	AssignedLBs    []string  `json:"assignedLBs"`
+	Empty          bool      `json:"empty"`
+	EmptySince     time.Time `json:"emptySince,omitempty"`
+}
+
+type HostCordon struct {
+	Host      string    `json:"host"`
+	Since     time.Time `json:"since"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type LBPin struct {
+	LB        string    `json:"lb"`
+	Host      string    `json:"host"`
+	Since     time.Time `json:"since"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type OverridesStatus struct {
+	Drains  map[string]HostDrain  `json:"drains"`
+	Cordons map[string]HostCordon `json:"cordons"`
+	Pins    map[string]LBPin      `json:"pins"`
+}
+
+type Overrides struct {
+	mu         sync.Mutex
+	defaultTTL time.Duration
+
+	drains  map[string]*HostDrain
+	cordons map[string]*HostCordon
+	pins    map[string]*LBPin
+}
+
+func NewOverrides(defaultTTL time.Duration) *Overrides {
+	return &Overrides{
+		defaultTTL: defaultTTL,
+		drains:     make(map[string]*HostDrain),
+		cordons:    make(map[string]*HostCordon),
+		pins:       make(map[string]*LBPin),
+	}
+}
+
+func (o *Overrides) getTTL(duration time.Duration) time.Duration {
+	if duration <= 0 {
+		return o.defaultTTL
+	}
+	return duration
+}
+
+func (o *Overrides) Drain(hostname string, duration time.Duration) HostDrain {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	drain, ok := o.drains[hostname]
+	if !ok {
+		drain = &HostDrain{Host: hostname, Since: now}
+		o.drains[hostname] = drain
+	}
+	drain.ExpiresAt = now.Add(o.getTTL(duration))
+	log.Printf("Overrides: draining host %s until %s\n", hostname, drain.ExpiresAt)
+	return *drain
+}
+
+func (o *Overrides) Cordon(hostname string, duration time.Duration) HostCordon {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	cordon, ok := o.cordons[hostname]
+	if !ok {
+		cordon = &HostCordon{Host: hostname, Since: now}
+		o.cordons[hostname] = cordon
+	}
+	cordon.ExpiresAt = now.Add(o.getTTL(duration))
+	log.Printf("Overrides: cordoning host %s until %s\n", hostname, cordon.ExpiresAt)
+	return *cordon
+}
+
+func (o *Overrides) Pin(lbName string, hostname string, duration time.Duration) LBPin {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	pin := &LBPin{LB: lbName, Host: hostname, Since: now, ExpiresAt: now.Add(duration)}
+	o.pins[lbName] = pin
+	log.Printf("Overrides: pinning LB %s to host %s until %s\n", lbName, hostname, pin.ExpiresAt)
+	return *pin
+}
+
+func (o *Overrides) Undrain(hostname string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, ok := o.drains[hostname]; !ok {
+		return fmt.Errorf("host %s is not drained", hostname)
+	}
+	delete(o.drains, hostname)
+	log.Printf("Overrides: stopped draining host %s\n", hostname)
+	return nil
+}
+
+func (o *Overrides) Uncordon(hostname string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, ok := o.cordons[hostname]; !ok {
+		return fmt.Errorf("host %s is not cordoned", hostname)
+	}
+	delete(o.cordons, hostname)
+	log.Printf("Overrides: uncordoned host %s\n", hostname)
+	return nil
+}
+
+func (o *Overrides) Unpin(lbName string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, ok := o.pins[lbName]; !ok {
+		return fmt.Errorf("LB %s is not pinned", lbName)
+	}
+	delete(o.pins, lbName)
+	log.Printf("Overrides: unpinned LB %s\n", lbName)
+	return nil
+}
+
+// Reconcile drops the overrides that expired, or whose host or LB is no
+// longer in the topology
+func (o *Overrides) Reconcile(hosts map[string]HostProps, LBs map[string]LBProps) {
+	if o == nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	for hostname, drain := range o.drains {
+		if _, ok := hosts[hostname]; !ok || now.After(drain.ExpiresAt) {
+			log.Printf("Overrides: drain of host %s ended\n", hostname)
+			delete(o.drains, hostname)
+		}
+	}
+	for hostname, cordon := range o.cordons {
+		if _, ok := hosts[hostname]; !ok || now.After(cordon.ExpiresAt) {
+			log.Printf("Overrides: cordon of host %s ended\n", hostname)
+			delete(o.cordons, hostname)
+		}
+	}
+	for lbName, pin := range o.pins {
+		_, hostOk := hosts[pin.Host]
+		if _, ok := LBs[lbName]; !ok || !hostOk || now.After(pin.ExpiresAt) {
+			log.Printf("Overrides: pin of LB %s to host %s ended\n", lbName, pin.Host)
+			delete(o.pins, lbName)
+		}
+	}
+}
+
+// GetPricesForLBs returns the host prices that each LB is assigned by: the
+// given prices (costs) of the LB with drained hosts priced up, cordoned hosts
+// left out (unless the LB is already on them), and only the pinned host for
+// pinned LBs
+func (o *Overrides) GetPricesForLBs(
+	costsForLBs map[string]map[string]float64,
+	currentHostsForLBs map[string]string) map[string]map[string]float64 {
+
+	if o == nil {
+		return costsForLBs
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	pricesForLBs := make(map[string]map[string]float64)
+
+	for lbName, costs := range costsForLBs {
+		prices := make(map[string]float64)
+		for hostname, price := range costs {
+			if drain, ok := o.drains[hostname]; ok {
+				price = math.Max(price, minDrainedPrice) * math.Pow(2, math.Min(float64(drain.RoundsDraining+1), 64))
+			}
+			if _, ok := o.cordons[hostname]; ok && currentHostsForLBs[lbName] != hostname {
+				continue
+			}
+			prices[hostname] = price
+		}
+
+		if pin, ok := o.pins[lbName]; ok {
+			if price, ok := costs[pin.Host]; ok {
+				prices = map[string]float64{pin.Host: price}
+			} else {
+				log.Printf("Error: LB %s is pinned to host %s, which has no price\n", lbName, pin.Host)
+			}
+		}
+
+		pricesForLBs[lbName] = prices
+	}
+
+	return pricesForLBs
+}
+
+// UpdateDrains records which LBs are still assigned to each drained host,
+// and reports the drained hosts that became empty
+func (o *Overrides) UpdateDrains(assignments map[string]Assignment, pods map[string]PodProps) {
+	if o == nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.drains) == 0 {
+		return
+	}
+
+	hostsOfIPs := make(map[string]string)
+	for _, pod := range pods {
+		hostsOfIPs[pod.IPAddress] = pod.HostName
+	}
+
+	assignedLBs := make(map[string][]string)
+	for lbName, assignment := range assignments {
+		hostnames := map[string]bool{assignment.Host: true}
+		for _, endpoint := range assignment.Endpoints {
+			hostnames[hostsOfIPs[endpoint]] = true
+		}
+		for hostname := range hostnames {
+			assignedLBs[hostname] = append(assignedLBs[hostname], lbName)
+		}
+	}
+
+	for hostname, drain := range o.drains {
+		drain.AssignedLBs = assignedLBs[hostname]
+		if len(drain.AssignedLBs) > 0 {
+			drain.RoundsDraining++
+			drain.Empty = false
+			continue
+		}
+		if !drain.Empty {
+			drain.Empty = true
+			drain.EmptySince = time.Now()
+			log.Printf("Overrides: drained host %s is empty after %d rounds\n", hostname, drain.RoundsDraining)
+		}
+	}
+}
+
+func (o *Overrides) GetStatus() OverridesStatus {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	status := OverridesStatus{
+		Drains:  make(map[string]HostDrain),
+		Cordons: make(map[string]HostCordon),
+		Pins:    make(map[string]LBPin),
+	}
+	for hostname, drain := range o.drains {
+		status.Drains[hostname] = *drain
+	}
+	for hostname, cordon := range o.cordons {
+		status.Cordons[hostname] = *cordon
+	}
+	for lbName, pin := range o.pins {
+		status.Pins[lbName] = *pin
+	}
+	return status
+}
+
+func getDurationParam(r *http.Request) (time.Duration, error) {
+	durationStr := r.URL.Query().Get("duration_ms")
+	if durationStr == "" {
+		return 0, nil
+	}
+	durationMs, err := strconv.Atoi(durationStr)
+	if err != nil || durationMs <= 0 {
+		return 0, fmt.Errorf("invalid duration_ms %q", durationStr)
+	}
+	return time.Duration(durationMs) * time.Millisecond, nil
+}
+
+func handleHostOverride(
+	overrides *Overrides,
+	topology *Topology,
+	set func(string, time.Duration) interface{},
+	unset func(string) error,
+	w http.ResponseWriter,
+	r *http.Request) {
+
+	hostname := r.URL.Query().Get("host")
+
+	switch r.Method {
+	case http.MethodPost:
+		hosts, _, _ := topology.Get()
+		if _, ok := hosts[hostname]; !ok {
+			respondWithError(w, fmt.Sprintf("host %s does not exist", hostname))
+			return
+		}
+		duration, err := getDurationParam(r)
+		if err != nil {
+			respondWithError(w, err.Error())
+			return
+		}
+		respondWithJSON(w, set(hostname, duration))
+	case http.MethodDelete:
+		if err := unset(hostname); err != nil {
+			respondWithError(w, err.Error())
+			return
+		}
+		respondWithJSON(w, overrides.GetStatus())
+	default:
+		respondWithMethodNotAllowed(w, r)
+	}
+}
+
+func handlePinOverride(overrides *Overrides, topology *Topology, w http.ResponseWriter, r *http.Request) {
+
+	lbName := r.URL.Query().Get("lb")
+
+	switch r.Method {
+	case http.MethodPost:
+		hostname := r.URL.Query().Get("host")
+		_, pods, LBs := topology.Get()
+		LB, ok := LBs[lbName]
+		if !ok {
+			respondWithError(w, fmt.Sprintf("LB %s does not exist", lbName))
+			return
+		}
+		hasPodOnHost := false
+		for _, podname := range LB.PodNames {
+			if pods[podname].HostName == hostname {
+				hasPodOnHost = true
+			}
+		}
+		if !hasPodOnHost {
+			respondWithError(w, fmt.Sprintf("LB %s has no pod on host %s", lbName, hostname))
+			return
+		}
+		duration, err := getDurationParam(r)
+		if err != nil {
+			respondWithError(w, err.Error())
+			return
+		}
+		if duration == 0 {
+			respondWithError(w, "a pin needs a duration_ms")
+			return
+		}
+		respondWithJSON(w, overrides.Pin(lbName, hostname, duration))
+	case http.MethodDelete:
+		if err := overrides.Unpin(lbName); err != nil {
+			respondWithError(w, err.Error())
+			return
+		}
+		respondWithJSON(w, overrides.GetStatus())
+	default:
+		respondWithMethodNotAllowed(w, r)
+	}
+}
+
+func registerOverrideHandlers(mux *http.ServeMux, overrides *Overrides, topology *Topology, replica *Replica) {
+	mux.HandleFunc("/overrides", func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, overrides.GetStatus())
+	})
+	mux.HandleFunc("/overrides/drain", forwardWritesToLeader(replica, func(w http.ResponseWriter, r *http.Request) {
+		handleHostOverride(overrides, topology,
+			func(hostname string, duration time.Duration) interface{} { return overrides.Drain(hostname, duration) },
+			overrides.Undrain, w, r)
+	}))
+	mux.HandleFunc("/overrides/cordon", forwardWritesToLeader(replica, func(w http.ResponseWriter, r *http.Request) {
+		handleHostOverride(overrides, topology,
+			func(hostname string, duration time.Duration) interface{} { return overrides.Cordon(hostname, duration) },
+			overrides.Uncordon, w, r)
+	}))
+	mux.HandleFunc("/overrides/pin", forwardWritesToLeader(replica, func(w http.ResponseWriter, r *http.Request) {
+		handlePinOverride(overrides, topology, w, r)
+	}))
+}
+
+/*
+getOverrides builds the operator overrides configured by the environment:
+  - OVERRIDE_TTL_MS: duration of a drain or cordon made without a duration_ms, default 3600000
+*/
+func getOverrides() *Overrides {
+	return NewOverrides(time.Duration(getEnvFloat("OVERRIDE_TTL_MS", 3600000)) * time.Millisecond)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+)
+
+// PriceUpdater computes the next price of every host from its previous price,
+// the load that arrived at it and its load capacity. All maps are keyed by
+// hostname.
+type PriceUpdater interface {
+	GetNewPrices(
+		oldPrices map[string]float64,
+		loads map[string]float64,
+		capacities map[string]float64) map[string]float64
+}
+
+/*
+SrikanthPriceUpdater is the original pricing rule of the controller:
+
+	p(k+1) = | p(k) + epsilon * (load - capacity + 1/sum(p(k))) |
+
+The absolute value keeps the prices positive.
+*/
+type SrikanthPriceUpdater struct {
+	epsilon float64
+}
+
+func (u *SrikanthPriceUpdater) GetNewPrices(
+	oldPrices map[string]float64,
+	loads map[string]float64,
+	capacities map[string]float64) map[string]float64 {
+
+	newPrices := make(map[string]float64)
+
+	sumOfOldPrices := getSumOfPrices(oldPrices)
+
+	for hostname, capacity := range capacities {
+		newPrices[hostname] = getNewHostPrice(
+			oldPrices[hostname],
+			u.epsilon,
+			loads[hostname],
+			capacity,
+			sumOfOldPrices,
+		)
+	}
+
+	return newPrices
+}
+
+/*
+DualAscentPriceUpdater takes a projected (sub)gradient step on the dual of the
+load balancing problem:
+
+	p(k+1) = max(minPrice, p(k) + step(k) * (load - capacity + 1/sum(p(k))))
+
+The step size follows one of the step rules below:
+  - "constant":    step(k) = epsilon
+  - "diminishing": step(k) = epsilon / sqrt(k+1)
+  - "adaptive":    step(k) = epsilon / sqrt(sum of squared gradients seen by the host)
+*/
+type DualAscentPriceUpdater struct {
+	epsilon  float64
+	stepRule string
+	minPrice float64
+
+	round          int
+	sumSqGradients map[string]float64
+}
+
+// PriceUpdaterState is what a price updater carries from one round to the
+// next besides the prices (snapshotted and replicated with them, so that a
+// new leader continues with the same step sizes)
+type PriceUpdaterState struct {
+	Round          int                `json:"round"`
+	SumSqGradients map[string]float64 `json:"sumSqGradients,omitempty"`
+}
+
+// statefulPriceUpdater is implemented by the price updaters with a state
+type statefulPriceUpdater interface {
+	GetState() PriceUpdaterState
+	SetState(state PriceUpdaterState)
+}
+
+// getPriceUpdaterState returns the state of the price updater, or nil if it
+// has none
+func getPriceUpdaterState(priceUpdater PriceUpdater) *PriceUpdaterState {
+	stateful, ok := priceUpdater.(statefulPriceUpdater)
+	if !ok {
+		return nil
+	}
+	state := stateful.GetState()
+	return &state
+}
+
+// setPriceUpdaterState restores the state of the price updater, resetting it
+// if the state is nil (e.g. in snapshots taken before it was kept)
+func setPriceUpdaterState(priceUpdater PriceUpdater, state *PriceUpdaterState) {
+	stateful, ok := priceUpdater.(statefulPriceUpdater)
+	if !ok {
+		return
+	}
+	if state == nil {
+		state = &PriceUpdaterState{}
+	}
+	stateful.SetState(*state)
+}
+
+// checkEpsilon rejects step sizes that would keep the prices from moving
+// (or move them against the load), and NaN
+func checkEpsilon(epsilon float64) error {
+	if !(epsilon > 0) {
+		return fmt.Errorf("epsilon must be positive, got %f", epsilon)
+	}
+	return nil
+}
+
+func NewDualAscentPriceUpdater(epsilon float64, stepRule string, minPrice float64) (*DualAscentPriceUpdater, error) {
+	if stepRule != "constant" && stepRule != "diminishing" && stepRule != "adaptive" {
+		return nil, fmt.Errorf("invalid step rule %q (must be constant, diminishing or adaptive)", stepRule)
+	}
+	if err := checkEpsilon(epsilon); err != nil {
+		return nil, err
+	}
+	// written so that NaN fails too
+	if !(minPrice > 0) {
+		return nil, fmt.Errorf("min price must be positive, got %f", minPrice)
+	}
+	return &DualAscentPriceUpdater{
+		epsilon:        epsilon,
+		stepRule:       stepRule,
+		minPrice:       minPrice,
+		sumSqGradients: make(map[string]float64),
+	}, nil
+}
+
+func (u *DualAscentPriceUpdater) GetState() PriceUpdaterState {
+	state := PriceUpdaterState{Round: u.round, SumSqGradients: make(map[string]float64)}
+	for key, sumSqGradient := range u.sumSqGradients {
+		state.SumSqGradients[key] = sumSqGradient
+	}
+	return state
+}
+
+func (u *DualAscentPriceUpdater) SetState(state PriceUpdaterState) {
+	u.round = state.Round
+	u.sumSqGradients = make(map[string]float64)
+	for key, sumSqGradient := range state.SumSqGradients {
+		u.sumSqGradients[key] = sumSqGradient
+	}
+}
+
+func (u *DualAscentPriceUpdater) getStepSize(hostname string, gradient float64) float64 {
+	switch u.stepRule {
+	case "diminishing":
+		return u.epsilon / math.Sqrt(float64(u.round+1))
+	case "adaptive":
+		u.sumSqGradients[hostname] += gradient * gradient
+		if u.sumSqGradients[hostname] == 0 {
+			return u.epsilon
+		}
+		return u.epsilon / math.Sqrt(u.sumSqGradients[hostname])
+	default:
+		return u.epsilon
+	}
+}
+
+func (u *DualAscentPriceUpdater) GetNewPrices(
+	oldPrices map[string]float64,
+	loads map[string]float64,
+	capacities map[string]float64) map[string]float64 {
+
+	newPrices := make(map[string]float64)
+
+	sumOfOldPrices := getSumOfPrices(oldPrices)
+
+	for hostname, capacity := range capacities {
+		gradient := loads[hostname] - capacity + (1 / sumOfOldPrices)
+		step := u.getStepSize(hostname, gradient)
+		newPrices[hostname] = math.Max(u.minPrice, oldPrices[hostname]+step*gradient)
+	}
+
+	// forget the gradient history of hosts removed from the topology (the
+	// old prices cover every host of the topology, including the ones with
+	// no load this round, e.g. because their poll timed out)
+	for hostname := range u.sumSqGradients {
+		if _, ok := oldPrices[hostname]; !ok {
+			delete(u.sumSqGradients, hostname)
+		}
+	}
+
+	u.round++
+
+	return newPrices
+}
+
+func getEnvFloat(name string, defaultValue float64) float64 {
+	valueStr := os.Getenv(name)
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		log.Fatalf("Error: couldn't parse %s=%s as a number: %s\n", name, valueStr, err)
+	}
+	return value
+}
+
+func getEnvString(name string, defaultValue string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+/*
+getPriceUpdater builds the pricing algorithm selected by the environment:
+  - PRICE_UPDATER:   "srikanth" (default) or "dual_ascent"
+  - PRICE_EPSILON:   (initial) step size, default 1.0
+  - PRICE_STEP_RULE: step rule of dual_ascent, default "diminishing"
+  - PRICE_MIN:       price floor of dual_ascent, default 0.001
+*/
+func getPriceUpdater() PriceUpdater {
+	priceUpdater, err := newPriceUpdater(
+		getEnvString("PRICE_UPDATER", "srikanth"),
+		getEnvFloat("PRICE_EPSILON", 1.0),
+		getEnvString("PRICE_STEP_RULE", "diminishing"),
+		getEnvFloat("PRICE_MIN", 0.001),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return priceUpdater
+}
+
+func newPriceUpdater(name string, epsilon float64, stepRule string, minPrice float64) (PriceUpdater, error) {
+	switch name {
+	case "srikanth":
+		if err := checkEpsilon(epsilon); err != nil {
+			return nil, err
+		}
+		return &SrikanthPriceUpdater{epsilon: epsilon}, nil
+	case "dual_ascent":
+		return NewDualAscentPriceUpdater(epsilon, stepRule, minPrice)
+	default:
+		return nil, fmt.Errorf("invalid price updater %q (must be srikanth or dual_ascent)", name)
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+/*
+Replication:
+	several controller replicas form a Raft cluster
+	only the leader runs the control rounds; after every round it replicates
+	the round number, host prices, LB assignments and the step size state of
+	the price updater through Raft, and only pushes the assignments to the
+	LBs once they are committed
+	a replica that becomes leader continues from the replicated state
+	pod reports can be sent to any replica; followers forward them to the
+	leader, and so they do with every other request that changes the state
+	the rounds use (topology edits, drains, cordons and pins, capacity
+	locks, health reports and coordination shares)
+	that state is not replicated: a new leader starts from its own copy of
+	it
+*/
+
+// controllerFSM keeps the latest controller state committed through Raft
+type controllerFSM struct {
+	mu       sync.Mutex
+	state    ControllerSnapshot
+	hasState bool
+}
+
+func (f *controllerFSM) Apply(l *raft.Log) interface{} {
+	var state ControllerSnapshot
+	if err := json.Unmarshal(l.Data, &state); err != nil {
+		log.Printf("Error: couldn't apply replicated state at index %d: %s\n", l.Index, err)
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state = state
+	f.hasState = true
+
+	return nil
+}
+
+func (f *controllerFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.hasState {
+		return &controllerFSMSnapshot{}, nil
+	}
+	data, err := json.Marshal(f.state)
+	if err != nil {
+		return nil, err
+	}
+	return &controllerFSMSnapshot{data: data}, nil
+}
+
+func (f *controllerFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(data) == 0 {
+		f.state = ControllerSnapshot{}
+		f.hasState = false
+		return nil
+	}
+	if err := json.Unmarshal(data, &f.state); err != nil {
+		return err
+	}
+	f.hasState = true
+	return nil
+}
+
+func (f *controllerFSM) GetState() (ControllerSnapshot, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state, f.hasState
+}
+
+type controllerFSMSnapshot struct {
+	data []byte
+}
+
+func (s *controllerFSMSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s.data); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *controllerFSMSnapshot) Release() {}
+
+type ReplicaPeer struct {
+	ID       string
+	RaftAddr string
+	HTTPAddr string
+}
+
+type Replica struct {
+	id        string
+	raft      *raft.Raft
+	fsm       *controllerFSM
+	httpAddrs map[raft.ServerID]string
+}
+
+func (r *Replica) IsLeader() bool {
+	return r.raft.State() == raft.Leader
+}
+
+// GetLeaderHTTPAddr returns the address of the leader's HTTP server, or ""
+// if there is no known leader
+func (r *Replica) GetLeaderHTTPAddr() string {
+	_, leaderID := r.raft.LeaderWithID()
+	return r.httpAddrs[leaderID]
+}
+
+// SyncAsLeader waits until every entry committed by previous leaders has been
+// applied, and returns the latest replicated state
+func (r *Replica) SyncAsLeader(timeout time.Duration) (ControllerSnapshot, bool, error) {
+	if err := r.raft.Barrier(timeout).Error(); err != nil {
+		return ControllerSnapshot{}, false, err
+	}
+	state, ok := r.fsm.GetState()
+	return state, ok, nil
+}
+
+// Replicate commits the controller state of a round to the cluster
+func (r *Replica) Replicate(state ControllerSnapshot, timeout time.Duration) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return r.raft.Apply(data, timeout).Error()
+}
+
+func newRaftConfig(id string) *raft.Config {
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(id)
+	return config
+}
+
+func getRaftConfiguration(peers []ReplicaPeer) raft.Configuration {
+	var configuration raft.Configuration
+	for _, peer := range peers {
+		configuration.Servers = append(configuration.Servers, raft.Server{
+			Suffrage: raft.Voter,
+			ID:       raft.ServerID(peer.ID),
+			Address:  raft.ServerAddress(peer.RaftAddr),
+		})
+	}
+	return configuration
+}
+
+func getHTTPAddrs(peers []ReplicaPeer) map[raft.ServerID]string {
+	httpAddrs := make(map[raft.ServerID]string)
+	for _, peer := range peers {
+		httpAddrs[raft.ServerID(peer.ID)] = peer.HTTPAddr
+	}
+	return httpAddrs
+}
+
+// NewReplica starts the Raft replica id of the cluster made of peers, keeping
+// its log in dir (or in memory if dir is "")
+func NewReplica(id string, peers []ReplicaPeer, dir string) (*Replica, error) {
+
+	var self *ReplicaPeer
+	for i := range peers {
+		if peers[i].ID == id {
+			self = &peers[i]
+		}
+	}
+	if self == nil {
+		return nil, fmt.Errorf("replica %s is not one of the peers %v", id, peers)
+	}
+
+	transport, err := raft.NewTCPTransport(self.RaftAddr, nil, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen on %s: %w", self.RaftAddr, err)
+	}
+
+	var logStore raft.LogStore
+	var stableStore raft.StableStore
+	var snapshotStore raft.SnapshotStore
+	if dir == "" {
+		inmemStore := raft.NewInmemStore()
+		logStore, stableStore = inmemStore, inmemStore
+		snapshotStore = raft.NewInmemSnapshotStore()
+	} else {
+		boltStore, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't open raft log in %s: %w", dir, err)
+		}
+		logStore, stableStore = boltStore, boltStore
+		snapshotStore, err = raft.NewFileSnapshotStore(dir, 2, os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't open raft snapshots in %s: %w", dir, err)
+		}
+	}
+
+	return startReplica(id, peers, logStore, stableStore, snapshotStore, transport)
+}
+
+func startReplica(
+	id string,
+	peers []ReplicaPeer,
+	logStore raft.LogStore,
+	stableStore raft.StableStore,
+	snapshotStore raft.SnapshotStore,
+	transport raft.Transport) (*Replica, error) {
+
+	config := newRaftConfig(id)
+	fsm := &controllerFSM{}
+
+	hasState, err := raft.HasExistingState(logStore, stableStore, snapshotStore)
+	if err != nil {
+		return nil, err
+	}
+	if !hasState {
+		// every replica bootstraps with the same configuration, so it does not
+		// matter which one wins
+		err := raft.BootstrapCluster(config, logStore, stableStore, snapshotStore, transport, getRaftConfiguration(peers))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't bootstrap replica %s: %w", id, err)
+		}
+	}
+
+	r, err := raft.NewRaft(config, fsm, logStore, stableStore, snapshotStore, transport)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't start replica %s: %w", id, err)
+	}
+
+	return &Replica{
+		id:        id,
+		raft:      r,
+		fsm:       fsm,
+		httpAddrs: getHTTPAddrs(peers),
+	}, nil
+}
+
+// NewInmemReplicaCluster starts a cluster of replicas that talk to each other
+// over in-memory transports, so that the whole cluster runs in one process
+func NewInmemReplicaCluster(peers []ReplicaPeer) ([]*Replica, error) {
+
+	transports := make([]*raft.InmemTransport, len(peers))
+	for i, peer := range peers {
+		_, transports[i] = raft.NewInmemTransport(raft.ServerAddress(peer.RaftAddr))
+	}
+	for i := range transports {
+		for j := range transports {
+			if i != j {
+				transports[i].Connect(transports[j].LocalAddr(), transports[j])
+			}
+		}
+	}
+
+	replicas := make([]*Replica, len(peers))
+	for i, peer := range peers {
+		inmemStore := raft.NewInmemStore()
+		replica, err := startReplica(peer.ID, peers, inmemStore, inmemStore, raft.NewInmemSnapshotStore(), transports[i])
+		if err != nil {
+			return nil, err
+		}
+		replicas[i] = replica
+	}
+
+	return replicas, nil
+}
+
+// parseReplicaPeers parses peers given as "id=raftAddr=httpAddr,..."
+func parseReplicaPeers(peersStr string) ([]ReplicaPeer, error) {
+	var peers []ReplicaPeer
+	for _, peerStr := range strings.Split(peersStr, ",") {
+		fields := strings.Split(strings.TrimSpace(peerStr), "=")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid peer %q (must be id=raftAddr=httpAddr)", peerStr)
+		}
+		peers = append(peers, ReplicaPeer{ID: fields[0], RaftAddr: fields[1], HTTPAddr: fields[2]})
+	}
+	return peers, nil
+}
+
+/*
+getReplica starts the replica configured by the environment, or returns nil
+if the controller is not replicated:
+  - RAFT_ID:    id of this replica
+  - RAFT_PEERS: all replicas (including this one) as "id=raftAddr=httpAddr,..."
+  - RAFT_DIR:   directory for the raft log, kept in memory if unset
+*/
+func getReplica() *Replica {
+	id := os.Getenv("RAFT_ID")
+	if id == "" {
+		return nil
+	}
+
+	peers, err := parseReplicaPeers(os.Getenv("RAFT_PEERS"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	replica, err := NewReplica(id, peers, os.Getenv("RAFT_DIR"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Replica %s started with peers %v\n", id, peers)
+	return replica
+}
+
+/*
+getInmemReplicas starts RAFT_INMEM_REPLICAS replicas in this process, the
+i-th one serving HTTP on port+i, or returns nil if it is not set
+*/
+func getInmemReplicas(port int) []*Replica {
+	numReplicas := int(getEnvFloat("RAFT_INMEM_REPLICAS", 0))
+	if numReplicas <= 0 {
+		return nil
+	}
+
+	peers := make([]ReplicaPeer, numReplicas)
+	for i := range peers {
+		peers[i] = ReplicaPeer{
+			ID:       fmt.Sprintf("cc%d", i),
+			RaftAddr: fmt.Sprintf("inmem-cc%d", i),
+			HTTPAddr: fmt.Sprintf("localhost:%d", port+i),
+		}
+	}
+
+	replicas, err := NewInmemReplicaCluster(peers)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Started %d in-memory replicas\n", numReplicas)
+	return replicas
+}
+
+// forwardReqToLeader sends a pod report received by a follower to the leader
+func forwardReqToLeader(replica *Replica, report Req, w http.ResponseWriter, r *http.Request) {
+
+	// the report is forwarded as query parameters, whichever way it came
+	query := url.Values{}
+	query.Set("podname", report.podname)
+	query.Set("k", strconv.Itoa(report.k))
+	query.Set("a", strconv.Itoa(report.a))
+	forwardToLeader(replica, http.MethodGet, "/?"+query.Encode(), nil, "", w, r)
+}
+
+// forwardWritesToLeader makes a follower hand the requests of a handler that
+// change the controller's state (anything but GET) over to the leader, which
+// is the replica that uses that state in its rounds
+func forwardWritesToLeader(replica *Replica, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if replica == nil || replica.IsLeader() || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			handler(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			respondWithError(w, fmt.Sprintf("couldn't read request: %s", err))
+			return
+		}
+		forwardToLeader(replica, r.Method, r.URL.RequestURI(), body, r.Header.Get("Content-Type"), w, r)
+	}
+}
+
+// forwardToLeader sends a request received by a follower to the leader, and
+// responds with the leader's response
+func forwardToLeader(
+	replica *Replica,
+	method string,
+	uri string,
+	body []byte,
+	contentType string,
+	w http.ResponseWriter,
+	r *http.Request) {
+
+	// don't bounce requests between replicas that disagree about the leader
+	if r.Header.Get("X-Forwarded-By") != "" {
+		respondWithStatus(w, http.StatusServiceUnavailable, fmt.Sprintf("replica %s is not the leader", replica.id))
+		return
+	}
+
+	leaderHTTPAddr := replica.GetLeaderHTTPAddr()
+	if leaderHTTPAddr == "" {
+		respondWithStatus(w, http.StatusServiceUnavailable, "no leader elected")
+		return
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", leaderHTTPAddr, uri), bytes.NewReader(body))
+	if err != nil {
+		respondWithStatus(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Connection", "close")
+	req.Header.Set("X-Forwarded-By", replica.id)
+
+	client := &http.Client{
+		Timeout: 500 * time.Millisecond,
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		respondWithStatus(w, http.StatusBadGateway, fmt.Sprintf("couldn't forward to leader at %s: %s", leaderHTTPAddr, err))
+		return
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		respondWithStatus(w, http.StatusBadGateway, fmt.Sprintf("couldn't read response of leader at %s: %s", leaderHTTPAddr, err))
+		return
+	}
+
+	if resContentType := res.Header.Get("Content-Type"); resContentType != "" {
+		w.Header().Set("Content-Type", resContentType)
+	}
+	respondWithStatus(w, res.StatusCode, string(resBody))
+}
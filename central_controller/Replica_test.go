@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func startTestReplicaCluster(t *testing.T, numReplicas int) []*Replica {
+	t.Helper()
+
+	httpAddrs := make([]string, numReplicas)
+	for i := range httpAddrs {
+		httpAddrs[i] = fmt.Sprintf("localhost:%d", 3000+i)
+	}
+	return startTestReplicaClusterAt(t, httpAddrs)
+}
+
+// startTestReplicaClusterAt starts a replica serving HTTP at each address
+func startTestReplicaClusterAt(t *testing.T, httpAddrs []string) []*Replica {
+	t.Helper()
+
+	peers := make([]ReplicaPeer, len(httpAddrs))
+	for i := range peers {
+		peers[i] = ReplicaPeer{
+			ID:       fmt.Sprintf("cc%d", i),
+			RaftAddr: fmt.Sprintf("inmem-cc%d", i),
+			HTTPAddr: httpAddrs[i],
+		}
+	}
+
+	replicas, err := NewInmemReplicaCluster(peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, replica := range replicas {
+			replica.raft.Shutdown().Error()
+		}
+	})
+	return replicas
+}
+
+// waitForLeader waits until exactly one of the replicas is the leader
+func waitForLeader(t *testing.T, replicas []*Replica, timeout time.Duration) *Replica {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		var leaders []*Replica
+		for _, replica := range replicas {
+			if replica.IsLeader() {
+				leaders = append(leaders, replica)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no leader elected among %d replicas in %s", len(replicas), timeout)
+	return nil
+}
+
+// waitForState waits until the replica has applied the state of the round
+func waitForState(t *testing.T, replica *Replica, round int, timeout time.Duration) ControllerSnapshot {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if state, ok := replica.fsm.GetState(); ok && state.Round == round {
+			return state
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("replica %s did not apply round %d in %s", replica.id, round, timeout)
+	return ControllerSnapshot{}
+}
+
+func getTestSnapshot(round int, priceUpdater PriceUpdater) ControllerSnapshot {
+	hosts := map[string]HostProps{
+		"host1": {Name: "host1", LoadCapacity: 10},
+		"host2": {Name: "host2", LoadCapacity: 20},
+	}
+	resourcePrices := map[string]map[string]float64{
+		"host1": {requestsResource: 1.5 * float64(round)},
+		"host2": {requestsResource: 0.5 * float64(round)},
+	}
+	assignments := map[string]string{"lb1": "host1", "lb2": "host2"}
+	return NewControllerSnapshot(round, hosts, resourcePrices, assignments, priceUpdater)
+}
+
+func TestInmemReplicaClusterReplicatesAndFailsOver(t *testing.T) {
+	replicas := startTestReplicaCluster(t, 3)
+
+	leader := waitForLeader(t, replicas, 5*time.Second)
+	leaderHTTPAddr := leader.httpAddrs[raft.ServerID(leader.id)]
+	deadline := time.Now().Add(5 * time.Second)
+	for _, replica := range replicas {
+		for replica.GetLeaderHTTPAddr() != leaderHTTPAddr && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if replica.GetLeaderHTTPAddr() != leaderHTTPAddr {
+			t.Errorf("replica %s has leader at %q, expected %q", replica.id, replica.GetLeaderHTTPAddr(), leaderHTTPAddr)
+		}
+	}
+
+	// the leader's rounds reach every follower, with the price updater state
+	priceUpdater, err := NewDualAscentPriceUpdater(1.0, "adaptive", 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priceUpdater.GetNewPrices(
+		map[string]float64{"host1/requests": 1, "host2/requests": 1},
+		map[string]float64{"host1/requests": 15, "host2/requests": 5},
+		map[string]float64{"host1/requests": 10, "host2/requests": 20},
+	)
+	snapshot := getTestSnapshot(1, priceUpdater)
+	if err := leader.Replicate(snapshot, time.Second); err != nil {
+		t.Fatalf("couldn't replicate: %s", err)
+	}
+	for _, replica := range replicas {
+		state := waitForState(t, replica, 1, 5*time.Second)
+		if !reflect.DeepEqual(state.ResourcePrices, snapshot.ResourcePrices) ||
+			!reflect.DeepEqual(state.Assignments, snapshot.Assignments) ||
+			!reflect.DeepEqual(state.PriceUpdaterState, snapshot.PriceUpdaterState) {
+			t.Errorf("replica %s applied %+v, expected %+v", replica.id, state, snapshot)
+		}
+	}
+
+	// a follower takes over when the leader stops, and continues from the
+	// replicated state
+	if err := leader.raft.Shutdown().Error(); err != nil {
+		t.Fatal(err)
+	}
+	var followers []*Replica
+	for _, replica := range replicas {
+		if replica != leader {
+			followers = append(followers, replica)
+		}
+	}
+	newLeader := waitForLeader(t, followers, 10*time.Second)
+
+	state, ok, err := newLeader.SyncAsLeader(time.Second)
+	if err != nil || !ok {
+		t.Fatalf("new leader %s couldn't sync: ok=%t, err=%v", newLeader.id, ok, err)
+	}
+	if state.Round != 1 || !reflect.DeepEqual(state.ResourcePrices, snapshot.ResourcePrices) {
+		t.Errorf("new leader %s synced %+v, expected round 1 with %+v", newLeader.id, state, snapshot.ResourcePrices)
+	}
+
+	newPriceUpdater, err := NewDualAscentPriceUpdater(1.0, "adaptive", 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setPriceUpdaterState(newPriceUpdater, state.PriceUpdaterState)
+	if !reflect.DeepEqual(newPriceUpdater.GetState(), priceUpdater.GetState()) {
+		t.Errorf("new leader restored price updater state %+v, expected %+v", newPriceUpdater.GetState(), priceUpdater.GetState())
+	}
+
+	// the new leader's rounds reach the remaining follower
+	if err := newLeader.Replicate(getTestSnapshot(2, newPriceUpdater), time.Second); err != nil {
+		t.Fatalf("new leader %s couldn't replicate: %s", newLeader.id, err)
+	}
+	for _, replica := range followers {
+		waitForState(t, replica, 2, 5*time.Second)
+	}
+}
+
+func TestFollowerForwardsWritesToLeader(t *testing.T) {
+
+	// every replica has its own state, served by its own HTTP server
+	listeners := make([]net.Listener, 2)
+	httpAddrs := make([]string, len(listeners))
+	for i := range listeners {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = listener
+		httpAddrs[i] = listener.Addr().String()
+	}
+	replicas := startTestReplicaClusterAt(t, httpAddrs)
+
+	topologies := make([]*Topology, len(replicas))
+	overrides := make([]*Overrides, len(replicas))
+	for i, replica := range replicas {
+		topologies[i] = NewTopology(
+			map[string]HostProps{"host1": {Name: "host1", LoadCapacity: 10, PodNames: []string{}}},
+			map[string]PodProps{},
+			map[string]LBProps{},
+		)
+		overrides[i] = NewOverrides(time.Hour)
+
+		mux := http.NewServeMux()
+		registerTopologyHandlers(mux, topologies[i], "", replica)
+		registerOverrideHandlers(mux, overrides[i], topologies[i], replica)
+		server := httptest.NewUnstartedServer(mux)
+		server.Listener.Close()
+		server.Listener = listeners[i]
+		server.Start()
+		t.Cleanup(server.Close)
+	}
+
+	leader := waitForLeader(t, replicas, 5*time.Second)
+	var follower *Replica
+	var leaderIndex, followerIndex int
+	for i, replica := range replicas {
+		if replica == leader {
+			leaderIndex = i
+		} else {
+			follower, followerIndex = replica, i
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for follower.GetLeaderHTTPAddr() != httpAddrs[leaderIndex] && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a drain sent to the follower is made on the leader
+	res, err := http.Post(fmt.Sprintf("http://%s/overrides/drain?host=host1", httpAddrs[followerIndex]), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("drain through the follower responded %d", res.StatusCode)
+	}
+	if _, ok := overrides[leaderIndex].GetStatus().Drains["host1"]; !ok {
+		t.Errorf("leader has no drain of host1: %+v", overrides[leaderIndex].GetStatus())
+	}
+	if drains := overrides[followerIndex].GetStatus().Drains; len(drains) != 0 {
+		t.Errorf("follower made the drain itself: %+v", drains)
+	}
+
+	// and so is a topology edit, body included
+	host, err := json.Marshal(HostProps{Name: "host2", LoadCapacity: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = http.Post(fmt.Sprintf("http://%s/topology/hosts", httpAddrs[followerIndex]), "application/json", bytes.NewReader(host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config TopologyConfig
+	err = json.NewDecoder(res.Body).Decode(&config)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("host added through the follower: status %d, err %v", res.StatusCode, err)
+	}
+	if hosts, _, _ := topologies[leaderIndex].Get(); hosts["host2"].LoadCapacity != 20 {
+		t.Errorf("leader has no host2 with capacity 20: %+v", hosts)
+	}
+	if hosts, _, _ := topologies[followerIndex].Get(); len(hosts) != 1 {
+		t.Errorf("follower added the host itself: %+v", hosts)
+	}
+
+	// reads are served by the follower from its own state
+	res, err = http.Get(fmt.Sprintf("http://%s/overrides", httpAddrs[followerIndex]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status OverridesStatus
+	err = json.NewDecoder(res.Body).Decode(&status)
+	res.Body.Close()
+	if err != nil || len(status.Drains) != 0 {
+		t.Errorf("follower's overrides: %+v, err %v", status, err)
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+Report sources:
+	pods report their state (podname, k, a) through one of these transports
+	(see REPORT_TRANSPORT of the pods), and the controller consumes all of the
+	ones it is configured for:
+		- HTTP (always): GET /?podname=&k=&a=, or POST / with the JSON body
+		  {"podname": "<pod>", "k": <k>, "a": <a>}
+		- "redis_stream": the entries of a Redis stream, with the JSON report
+		  in the field "report", read with XREADGROUP as a consumer of a
+		  consumer group and acknowledged once queued; a new leader first
+		  reads what is pending for it, then claims (XAUTOCLAIM) what is
+		  pending for the other consumers, i.e. what previous leaders read
+		  but did not acknowledge
+		- "nats": the JSON reports published on a NATS subject, received in a
+		  queue group
+	only the leader of the replicas consumes the stream and the subject (the
+	followers forward HTTP reports to it); replicas share a consumer group
+	(and queue group), so every report is consumed once, by the leader.
+	Controllers that each need all of the reports (e.g. shards) must use
+	different groups
+*/
+
+// PodReport is the state a pod reports
+type PodReport struct {
+	Podname string `json:"podname"`
+	K       int    `json:"k"`
+	A       int    `json:"a"`
+}
+
+// ReportSource consumes pod reports from a transport, and queues them for
+// the rounds until it is closed
+type ReportSource interface {
+	Name() string
+	Run(chListenReqs chan Req)
+	Close()
+}
+
+func parsePodReport(data []byte) (Req, error) {
+	var report PodReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return Req{}, fmt.Errorf("invalid report: %w", err)
+	}
+	if report.Podname == "" {
+		return Req{}, fmt.Errorf("invalid report: no podname")
+	}
+	return Req{report.Podname, report.K, report.A}, nil
+}
+
+// getReportFromRequest reads a report from the query parameters of a GET,
+// or the JSON body of a POST
+func getReportFromRequest(r *http.Request) (Req, error) {
+	if r.Method != http.MethodPost {
+		podname, k, a, err := getQueryParams(r)
+		return Req{podname, k, a}, err
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return Req{}, fmt.Errorf("couldn't read report: %w", err)
+	}
+	return parsePodReport(data)
+}
+
+// queueReport queues a report for the next round without blocking, and
+// fails if the controller is falling behind
+func queueReport(chListenReqs chan Req, req Req) error {
+	select {
+	case chListenReqs <- req:
+		return nil
+	default:
+		return fmt.Errorf("Report queue full, dropped req [for %s w/ k=%d & a=%d]", req.podname, req.k, req.a)
+	}
+}
+
+// RedisStreamReportSource consumes the reports of a Redis stream
+type RedisStreamReportSource struct {
+	client   *redis.Client
+	stream   string
+	group    string
+	consumer string
+	block    time.Duration
+	isLeader func() bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewRedisStreamReportSource(
+	client *redis.Client,
+	stream string,
+	group string,
+	consumer string,
+	block time.Duration,
+	isLeader func() bool) *RedisStreamReportSource {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &RedisStreamReportSource{
+		client:   client,
+		stream:   stream,
+		group:    group,
+		consumer: consumer,
+		block:    block,
+		isLeader: isLeader,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+func (s *RedisStreamReportSource) Name() string {
+	return fmt.Sprintf("redis stream %s (group %s)", s.stream, s.group)
+}
+
+func (s *RedisStreamReportSource) createGroup() error {
+	err := s.client.XGroupCreateMkStream(s.ctx, s.stream, s.group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// queue queues the reports of the entries and acknowledges them
+func (s *RedisStreamReportSource) queue(chListenReqs chan Req, messages []redis.XMessage) error {
+	var ids []string
+	for _, message := range messages {
+		data, _ := message.Values["report"].(string)
+		req, err := parsePodReport([]byte(data))
+		if err != nil {
+			log.Printf("Error: dropping entry %s of stream %s: %s\n", message.ID, s.stream, err)
+		} else if err := queueReport(chListenReqs, req); err != nil {
+			log.Println(err)
+		}
+		// a report that can't be queued is as stale by the next read as one
+		// that is dropped, so it is acknowledged either way
+		ids = append(ids, message.ID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return s.client.XAck(s.ctx, s.stream, s.group, ids...).Err()
+}
+
+// read reads the entries of the stream from the given ID ("0" for the ones
+// delivered to us but not acknowledged, ">" for new ones), and queues them
+func (s *RedisStreamReportSource) read(chListenReqs chan Req, id string) (int, error) {
+	streams, err := s.client.XReadGroup(s.ctx, &redis.XReadGroupArgs{
+		Group:    s.group,
+		Consumer: s.consumer,
+		Streams:  []string{s.stream, id},
+		Count:    int64(cap(chListenReqs)),
+		Block:    s.block,
+	}).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	read := 0
+	for _, stream := range streams {
+		read += len(stream.Messages)
+		if err := s.queue(chListenReqs, stream.Messages); err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// takeOver queues what is pending in the group when we become the leader:
+// first the entries delivered to us, then the ones delivered to any other
+// consumer (claimed whatever their idle time, since only the leader reads
+// and the previous leader is gone; a report it is still queueing would at
+// worst be queued twice, which the rounds don't mind)
+func (s *RedisStreamReportSource) takeOver(chListenReqs chan Req) error {
+	for {
+		read, err := s.read(chListenReqs, "0")
+		if err != nil {
+			return err
+		}
+		if read == 0 {
+			break
+		}
+	}
+
+	start := "0-0"
+	for {
+		messages, next, err := s.client.XAutoClaim(s.ctx, &redis.XAutoClaimArgs{
+			Stream:   s.stream,
+			Group:    s.group,
+			Consumer: s.consumer,
+			Start:    start,
+			Count:    int64(cap(chListenReqs)),
+		}).Result()
+		if err != nil {
+			return err
+		}
+		if len(messages) > 0 {
+			log.Printf("Reports: claimed %d pending entries of stream %s\n", len(messages), s.stream)
+		}
+		if err := s.queue(chListenReqs, messages); err != nil {
+			return err
+		}
+		if next == "0-0" {
+			return nil
+		}
+		start = next
+	}
+}
+
+func (s *RedisStreamReportSource) Run(chListenReqs chan Req) {
+	wasLeader := false
+	for s.ctx.Err() == nil {
+		if !s.isLeader() {
+			wasLeader = false
+			time.Sleep(s.block)
+			continue
+		}
+
+		if !wasLeader {
+			if err := s.createGroup(); err != nil {
+				log.Printf("Error: couldn't create group %s of stream %s: %s\n", s.group, s.stream, err)
+				time.Sleep(s.block)
+				continue
+			}
+			// first pick up what previous leaders left
+			if err := s.takeOver(chListenReqs); err != nil {
+				if s.ctx.Err() == nil {
+					log.Printf("Error: couldn't take over the pending entries of stream %s: %s\n", s.stream, err)
+					time.Sleep(s.block)
+				}
+				continue
+			}
+			wasLeader = true
+		}
+
+		if _, err := s.read(chListenReqs, ">"); err != nil && s.ctx.Err() == nil {
+			log.Printf("Error: couldn't read stream %s: %s\n", s.stream, err)
+			wasLeader = false
+			time.Sleep(s.block)
+		}
+	}
+}
+
+func (s *RedisStreamReportSource) Close() {
+	s.cancel()
+	s.client.Close()
+}
+
+// NATSReportSource consumes the reports published on a NATS subject
+type NATSReportSource struct {
+	conn     *nats.Conn
+	subject  string
+	queue    string
+	isLeader func() bool
+	done     chan struct{}
+}
+
+func NewNATSReportSource(conn *nats.Conn, subject string, queue string, isLeader func() bool) *NATSReportSource {
+	return &NATSReportSource{
+		conn:     conn,
+		subject:  subject,
+		queue:    queue,
+		isLeader: isLeader,
+		done:     make(chan struct{}),
+	}
+}
+
+func (s *NATSReportSource) Name() string {
+	return fmt.Sprintf("NATS subject %s (queue %s)", s.subject, s.queue)
+}
+
+func (s *NATSReportSource) subscribe(chListenReqs chan Req) (*nats.Subscription, error) {
+	return s.conn.QueueSubscribe(s.subject, s.queue, func(msg *nats.Msg) {
+		req, err := parsePodReport(msg.Data)
+		if err != nil {
+			log.Printf("Error: dropping message on %s: %s\n", msg.Subject, err)
+			return
+		}
+		if err := queueReport(chListenReqs, req); err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+// Run subscribes while we are the leader (a follower in the queue group
+// would take reports away from the leader)
+func (s *NATSReportSource) Run(chListenReqs chan Req) {
+	var sub *nats.Subscription
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		isLeader := s.isLeader()
+		if isLeader && sub == nil {
+			var err error
+			if sub, err = s.subscribe(chListenReqs); err != nil {
+				log.Printf("Error: couldn't subscribe to %s: %s\n", s.subject, err)
+				sub = nil
+			}
+		} else if !isLeader && sub != nil {
+			if err := sub.Unsubscribe(); err != nil {
+				log.Printf("Error: couldn't unsubscribe from %s: %s\n", s.subject, err)
+			}
+			sub = nil
+		}
+
+		select {
+		case <-s.done:
+			if sub != nil {
+				sub.Unsubscribe()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *NATSReportSource) Close() {
+	close(s.done)
+	s.conn.Drain()
+}
+
+// startReportSources runs the report sources in the background
+func startReportSources(sources []ReportSource, chListenReqs chan Req) {
+	for _, source := range sources {
+		log.Printf("Reports: consuming %s\n", source.Name())
+		go source.Run(chListenReqs)
+	}
+}
+
+/*
+getReportSources builds the report sources (besides HTTP) configured by the
+environment:
+  - REPORT_SOURCES:        comma-separated list of "redis_stream" and "nats", default none
+  - REPORT_STREAM_ADDR:    Redis (host:port) of the stream
+  - REPORT_STREAM:         name of the stream, default "pod_reports"
+  - REPORT_STREAM_GROUP:   consumer group, default "central_controller"
+  - REPORT_STREAM_BLOCK_MS: longest wait for new entries, default 1000
+  - REPORT_NATS_URL:       NATS server, default nats://localhost:4222
+  - REPORT_NATS_SUBJECT:   subject of the reports, default "pod_reports"
+  - REPORT_NATS_QUEUE:     queue group, default "central_controller"
+*/
+func getReportSources(consumer string, isLeader func() bool) []ReportSource {
+	var sources []ReportSource
+
+	for _, name := range strings.Split(os.Getenv("REPORT_SOURCES"), ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "redis_stream":
+			addr := os.Getenv("REPORT_STREAM_ADDR")
+			if addr == "" {
+				log.Fatal("REPORT_STREAM_ADDR must be set to consume a redis_stream")
+			}
+			sources = append(sources, NewRedisStreamReportSource(
+				redis.NewClient(&redis.Options{Addr: addr}),
+				getEnvString("REPORT_STREAM", "pod_reports"),
+				getEnvString("REPORT_STREAM_GROUP", "central_controller"),
+				consumer,
+				time.Duration(getEnvFloat("REPORT_STREAM_BLOCK_MS", 1000))*time.Millisecond,
+				isLeader,
+			))
+		case "nats":
+			url := getEnvString("REPORT_NATS_URL", nats.DefaultURL)
+			conn, err := nats.Connect(url, nats.MaxReconnects(-1))
+			if err != nil {
+				log.Fatalf("couldn't connect to NATS at %s: %s", url, err)
+			}
+			sources = append(sources, NewNATSReportSource(
+				conn,
+				getEnvString("REPORT_NATS_SUBJECT", "pod_reports"),
+				getEnvString("REPORT_NATS_QUEUE", "central_controller"),
+				isLeader,
+			))
+		default:
+			log.Fatalf("invalid report source %q in REPORT_SOURCES (must be redis_stream or nats)", name)
+		}
+	}
+
+	return sources
+}
+
+// getReportConsumerName names this controller in consumer groups
+func getReportConsumerName(replica *Replica, port int) string {
+	if replica != nil {
+		return replica.id
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "controller"
+	}
+	return hostname + "-" + strconv.Itoa(port)
+}
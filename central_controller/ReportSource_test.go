@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+)
+
+// sinkReport is the report as the pods' report sinks (go_server_local's
+// ReportSink.go) encode it
+type sinkReport struct {
+	Podname string `json:"podname"`
+	K       int64  `json:"k"`
+	A       int    `json:"a"`
+}
+
+func encodeSinkReport(t *testing.T, podname string, k int64, a int) []byte {
+	t.Helper()
+	data, err := json.Marshal(sinkReport{Podname: podname, K: k, A: a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// addStreamReport adds a report to the stream the way RedisStreamReportSink
+// does
+func addStreamReport(t *testing.T, client *redis.Client, stream string, podname string, k int64, a int) {
+	t.Helper()
+	err := client.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: 10000,
+		Approx: true,
+		Values: map[string]interface{}{"report": string(encodeSinkReport(t, podname, k, a))},
+	}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reportCollector keeps every report queued on its channel
+type reportCollector struct {
+	ch   chan Req
+	mu   sync.Mutex
+	reqs []Req
+	done chan struct{}
+}
+
+func newReportCollector(size int) *reportCollector {
+	c := &reportCollector{ch: make(chan Req, size), done: make(chan struct{})}
+	go func() {
+		for {
+			select {
+			case req := <-c.ch:
+				c.mu.Lock()
+				c.reqs = append(c.reqs, req)
+				c.mu.Unlock()
+			case <-c.done:
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func (c *reportCollector) get() []Req {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Req{}, c.reqs...)
+}
+
+// waitFor waits until the collector has n reports, and returns them sorted
+func (c *reportCollector) waitFor(t *testing.T, n int, timeout time.Duration) []Req {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if reqs := c.get(); len(reqs) >= n {
+			sort.Slice(reqs, func(i, j int) bool { return reqs[i].podname < reqs[j].podname })
+			return reqs
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("got %d reports in %s, expected %d", len(c.get()), timeout, n)
+	return nil
+}
+
+func getPendingCount(t *testing.T, client *redis.Client, stream string, group string) int64 {
+	t.Helper()
+	pending, err := client.XPending(context.Background(), stream, group).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pending.Count
+}
+
+func TestGetReportFromRequest(t *testing.T) {
+	// http_query
+	req, err := getReportFromRequest(httptest.NewRequest("GET", "/?podname=pod1&k=3&a=7", nil))
+	if err != nil || req != (Req{"pod1", 3, 7}) {
+		t.Errorf("got %+v (err %v) from the query, expected {pod1 3 7}", req, err)
+	}
+
+	// http_json
+	body := strings.NewReader(string(encodeSinkReport(t, "pod2", 4, 9)))
+	req, err = getReportFromRequest(httptest.NewRequest("POST", "/", body))
+	if err != nil || req != (Req{"pod2", 4, 9}) {
+		t.Errorf("got %+v (err %v) from the body, expected {pod2 4 9}", req, err)
+	}
+
+	if _, err := getReportFromRequest(httptest.NewRequest("POST", "/", strings.NewReader(`{"k": 1}`))); err == nil {
+		t.Errorf("a report without a podname was accepted")
+	}
+}
+
+func TestRedisStreamReportSourceConsumesReports(t *testing.T) {
+	mr := miniredis.RunT(t)
+	sinkClient := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer sinkClient.Close()
+
+	var isLeader atomic.Bool
+	isLeader.Store(true)
+	source := NewRedisStreamReportSource(
+		redis.NewClient(&redis.Options{Addr: mr.Addr()}),
+		"pod_reports", "central_controller", "cc0", 50*time.Millisecond, isLeader.Load)
+	defer source.Close()
+
+	collector := newReportCollector(16)
+	defer close(collector.done)
+	go source.Run(collector.ch)
+
+	// the group is created from the end of the stream, so wait for it before
+	// the pods report
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		groups, err := sinkClient.XInfoGroups(context.Background(), "pod_reports").Result()
+		if err == nil && len(groups) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("group was not created: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	addStreamReport(t, sinkClient, "pod_reports", "pod1", 1, 10)
+	addStreamReport(t, sinkClient, "pod_reports", "pod2", 1, 20)
+	// an invalid entry is dropped (and acknowledged)
+	sinkClient.XAdd(context.Background(), &redis.XAddArgs{Stream: "pod_reports", Values: map[string]interface{}{"report": "{"}})
+
+	reqs := collector.waitFor(t, 2, 5*time.Second)
+	if len(reqs) != 2 || reqs[0] != (Req{"pod1", 1, 10}) || reqs[1] != (Req{"pod2", 1, 20}) {
+		t.Errorf("got reports %+v, expected pod1 and pod2", reqs)
+	}
+
+	deadline = time.Now().Add(5 * time.Second)
+	for getPendingCount(t, sinkClient, "pod_reports", "central_controller") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("entries were not acknowledged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedisStreamReportSourceTakesOverPendingEntries(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	bg := context.Background()
+
+	if err := client.XGroupCreateMkStream(bg, "pod_reports", "central_controller", "$").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a previous leader cc0 read 3 reports and failed before acknowledging
+	// them, and 5 were delivered to cc1 (e.g. before it restarted)
+	readAs := func(consumer string, podnames ...string) {
+		for _, podname := range podnames {
+			addStreamReport(t, client, "pod_reports", podname, 1, 1)
+		}
+		err := client.XReadGroup(bg, &redis.XReadGroupArgs{
+			Group:    "central_controller",
+			Consumer: consumer,
+			Streams:  []string{"pod_reports", ">"},
+			Count:    int64(len(podnames)),
+		}).Err()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	readAs("cc0", "pod1", "pod2", "pod3")
+	readAs("cc1", "pod4", "pod5", "pod6", "pod7", "pod8")
+	if pending := getPendingCount(t, client, "pod_reports", "central_controller"); pending != 8 {
+		t.Fatalf("%d entries pending before the takeover, expected 8", pending)
+	}
+
+	// cc1 becomes leader; its queue takes fewer reports than it has pending,
+	// so it has to read its own pending entries more than once (cc0's fit in
+	// one XAUTOCLAIM, as miniredis skips the entry at the cursor it returns)
+	var isLeader atomic.Bool
+	source := NewRedisStreamReportSource(
+		redis.NewClient(&redis.Options{Addr: mr.Addr()}),
+		"pod_reports", "central_controller", "cc1", 50*time.Millisecond, isLeader.Load)
+	defer source.Close()
+
+	collector := newReportCollector(4)
+	defer close(collector.done)
+	go source.Run(collector.ch)
+
+	time.Sleep(100 * time.Millisecond)
+	if reqs := collector.get(); len(reqs) != 0 {
+		t.Fatalf("a follower consumed reports %+v", reqs)
+	}
+	isLeader.Store(true)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for getPendingCount(t, client, "pod_reports", "central_controller") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d entries still pending after the takeover", getPendingCount(t, client, "pod_reports", "central_controller"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// then it consumes new reports
+	addStreamReport(t, client, "pod_reports", "pod9", 2, 5)
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		reqs := collector.get()
+		if len(reqs) > 0 && reqs[len(reqs)-1] == (Req{"pod9", 2, 5}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("new report was not consumed after the takeover, got %+v", reqs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func runTestNATSServer(t *testing.T) *server.Server {
+	t.Helper()
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server did not start")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+func connectTestNATS(t *testing.T, ns *server.Server) *nats.Conn {
+	t.Helper()
+	conn, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// publishUntilReceived publishes reports the way NATSReportSink does until
+// the collector has n of them
+func publishUntilReceived(t *testing.T, conn *nats.Conn, collector *reportCollector, podname string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for k := int64(0); len(collector.get()) < n; k++ {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d reports, expected %d", len(collector.get()), n)
+		}
+		if err := conn.Publish("pod_reports", encodeSinkReport(t, podname, k, 1)); err != nil {
+			t.Fatal(err)
+		}
+		conn.Flush()
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestNATSReportSourceFollowsLeadership(t *testing.T) {
+	ns := runTestNATSServer(t)
+	publisher := connectTestNATS(t, ns)
+	defer publisher.Close()
+
+	var isLeader0, isLeader1 atomic.Bool
+	isLeader0.Store(true)
+	source0 := NewNATSReportSource(connectTestNATS(t, ns), "pod_reports", "central_controller", isLeader0.Load)
+	defer source0.Close()
+	source1 := NewNATSReportSource(connectTestNATS(t, ns), "pod_reports", "central_controller", isLeader1.Load)
+	defer source1.Close()
+
+	collector0 := newReportCollector(64)
+	defer close(collector0.done)
+	collector1 := newReportCollector(64)
+	defer close(collector1.done)
+	go source0.Run(collector0.ch)
+	go source1.Run(collector1.ch)
+
+	// only the leader is in the queue group
+	publishUntilReceived(t, publisher, collector0, "pod1", 5)
+	if reqs := collector1.get(); len(reqs) != 0 {
+		t.Errorf("follower got reports %+v", reqs)
+	}
+	for _, req := range collector0.get() {
+		if req.podname != "pod1" || req.a != 1 {
+			t.Errorf("leader got report %+v, expected one of pod1", req)
+		}
+	}
+
+	// the old leader unsubscribes when it loses the leadership, and the new
+	// one subscribes
+	isLeader0.Store(false)
+	isLeader1.Store(true)
+	time.Sleep(300 * time.Millisecond)
+	before := len(collector0.get())
+	publishUntilReceived(t, publisher, collector1, "pod2", 5)
+	if after := len(collector0.get()); after != before {
+		t.Errorf("old leader got %d reports after losing the leadership", after-before)
+	}
+}
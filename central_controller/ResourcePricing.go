@@ -0,0 +1,302 @@
+package main
+
+import "log"
+
+/*
+Multi-resource pricing:
+	a host has a capacity of every resource it declares in capacities (e.g.
+	"cpu", "memory", "network"), and a capacity of loadCapacity "requests"
+	a request to an LB's pods demands demand[r] of every resource r, and 1
+	"requests" unless the demand says otherwise; a pod can declare its own
+	demand, otherwise it has the demand of its LB
+	the load of a resource on a host is the host's outstanding requests,
+	split over its pods by the requests they reported this round (evenly if
+	none did), times the pods' demands
+	every (host, resource) pair gets its own dual price from the price
+	updater, and the cost of an LB on a host is
+		sum over r of demand[r] * price(host, r)
+	where the demand is the one of the LB's pods on the host (the LB spreads
+	its requests over them evenly); the shards share the prices of every
+	resource, so hosts of other shards are costed in the same way
+	the price of a host (kept in snapshots and shown in logs) is the cost of
+	a plain request, i.e. its "requests" price
+*/
+
+const requestsResource = "requests"
+
+// getHostCapacities returns the capacity of every resource of a host
+func getHostCapacities(host HostProps) map[string]float64 {
+	capacities := make(map[string]float64)
+	for resource, capacity := range host.Capacities {
+		capacities[resource] = capacity
+	}
+	if _, ok := capacities[requestsResource]; !ok {
+		capacities[requestsResource] = float64(host.LoadCapacity)
+	}
+	return capacities
+}
+
+// getDemand returns the demand of a request with the given declared demand
+func getDemand(declared map[string]float64) map[string]float64 {
+	demand := make(map[string]float64)
+	for resource, amount := range declared {
+		demand[resource] = amount
+	}
+	if _, ok := demand[requestsResource]; !ok {
+		demand[requestsResource] = 1
+	}
+	return demand
+}
+
+func getPodDemand(pod PodProps, LBs map[string]LBProps) map[string]float64 {
+	if len(pod.Demand) > 0 {
+		return getDemand(pod.Demand)
+	}
+	return getDemand(LBs[pod.LBname].Demand)
+}
+
+// getLBDemands returns the demand of a request of the LB on every host its
+// pods run on: the mean demand of its pods there
+func getLBDemands(LB LBProps, pods map[string]PodProps, LBs map[string]LBProps) map[string]map[string]float64 {
+	demands := make(map[string]map[string]float64)
+	numPods := make(map[string]int)
+	for _, podname := range LB.PodNames {
+		pod, ok := pods[podname]
+		if !ok {
+			continue
+		}
+		if _, ok := demands[pod.HostName]; !ok {
+			demands[pod.HostName] = make(map[string]float64)
+		}
+		for resource, amount := range getPodDemand(pod, LBs) {
+			demands[pod.HostName][resource] += amount
+		}
+		numPods[pod.HostName]++
+	}
+	for hostname, demand := range demands {
+		for resource := range demand {
+			demand[resource] /= float64(numPods[hostname])
+		}
+	}
+	return demands
+}
+
+// getCost returns the cost of a request with the given demand at the given
+// resource prices
+func getCost(resourcePrices map[string]float64, demand map[string]float64) float64 {
+	cost := 0.0
+	for resource, amount := range demand {
+		cost += amount * resourcePrices[resource]
+	}
+	return cost
+}
+
+func copyResourcePrices(resourcePrices map[string]map[string]float64) map[string]map[string]float64 {
+	copied := make(map[string]map[string]float64)
+	for hostname, prices := range resourcePrices {
+		copied[hostname] = make(map[string]float64)
+		for resource, price := range prices {
+			copied[hostname][resource] = price
+		}
+	}
+	return copied
+}
+
+func getInitResourcePrices(host HostProps) map[string]float64 {
+
+	initPrice := 1.0
+
+	initPrices := make(map[string]float64)
+
+	for resource := range getHostCapacities(host) {
+		initPrices[resource] = initPrice
+	}
+
+	return initPrices
+}
+
+// reconcileResourcePrices initialises the prices of hosts (and resources)
+// that were added to the topology and forgets the prices of hosts (and
+// resources) that were removed from it
+func reconcileResourcePrices(
+	hosts map[string]HostProps,
+	resourcePrices map[string]map[string]float64) map[string]map[string]float64 {
+
+	if resourcePrices == nil {
+		resourcePrices = make(map[string]map[string]float64)
+	}
+
+	for hostname := range resourcePrices {
+		if _, ok := hosts[hostname]; !ok {
+			log.Printf("Topology: dropping price of host %s that is no longer managed\n", hostname)
+			delete(resourcePrices, hostname)
+		}
+	}
+
+	for hostname, hostProps := range hosts {
+		prices, ok := resourcePrices[hostname]
+		if !ok {
+			log.Printf("Topology: initialising price of newly managed host %s\n", hostname)
+			resourcePrices[hostname] = getInitResourcePrices(hostProps)
+			continue
+		}
+		capacities := getHostCapacities(hostProps)
+		for resource := range prices {
+			if _, ok := capacities[resource]; !ok {
+				delete(prices, resource)
+			}
+		}
+		for resource, initPrice := range getInitResourcePrices(hostProps) {
+			if _, ok := prices[resource]; !ok {
+				log.Printf("Topology: initialising price of %s on host %s\n", resource, hostname)
+				prices[resource] = initPrice
+			}
+		}
+	}
+
+	return resourcePrices
+}
+
+// getHostResourceLoads returns the load of every resource on the hosts whose
+// load we know
+func getHostResourceLoads(
+	hosts map[string]HostProps,
+	pods map[string]PodProps,
+	LBs map[string]LBProps,
+	hostLoads map[string]int,
+	podReports map[string]Req) map[string]map[string]float64 {
+
+	hostResourceLoads := make(map[string]map[string]float64)
+
+	for hostname, hostprops := range hosts {
+		hostLoad, ok := hostLoads[hostname]
+		if !ok {
+			continue
+		}
+
+		// the share of the host's requests that each of its pods has
+		podShares := make(map[string]float64)
+		sumOfReports := 0.0
+		for _, podname := range hostprops.PodNames {
+			if req, ok := podReports[podname]; ok && req.a > 0 {
+				podShares[podname] = float64(req.a)
+				sumOfReports += float64(req.a)
+			}
+		}
+		for _, podname := range hostprops.PodNames {
+			if sumOfReports > 0 {
+				podShares[podname] /= sumOfReports
+			} else {
+				podShares[podname] = 1 / float64(len(hostprops.PodNames))
+			}
+		}
+
+		resourceLoads := make(map[string]float64)
+		for resource := range getHostCapacities(hostprops) {
+			resourceLoads[resource] = 0
+		}
+		if len(hostprops.PodNames) == 0 {
+			resourceLoads[requestsResource] = float64(hostLoad)
+		}
+		for podname, share := range podShares {
+			for resource, amount := range getPodDemand(pods[podname], LBs) {
+				if _, ok := resourceLoads[resource]; ok {
+					resourceLoads[resource] += share * float64(hostLoad) * amount
+				}
+			}
+		}
+
+		hostResourceLoads[hostname] = resourceLoads
+	}
+
+	return hostResourceLoads
+}
+
+func getResourceKey(hostname string, resource string) string {
+	return hostname + "/" + resource
+}
+
+// getNewResourcePrices runs the price updater on every (host, resource) pair
+// whose load we know; the other pairs keep their price until we hear from
+// their host again
+func getNewResourcePrices(
+	hosts map[string]HostProps,
+	pods map[string]PodProps,
+	LBs map[string]LBProps,
+	hostLoads map[string]int,
+	podReports map[string]Req,
+	oldResourcePrices map[string]map[string]float64,
+	priceUpdater PriceUpdater,
+) map[string]map[string]float64 {
+
+	oldPrices := make(map[string]float64)
+	loads := make(map[string]float64)
+	capacities := make(map[string]float64)
+
+	for hostname, prices := range oldResourcePrices {
+		for resource, price := range prices {
+			oldPrices[getResourceKey(hostname, resource)] = price
+		}
+	}
+
+	for hostname, resourceLoads := range getHostResourceLoads(hosts, pods, LBs, hostLoads, podReports) {
+		hostCapacities := getHostCapacities(hosts[hostname])
+		for resource, load := range resourceLoads {
+			key := getResourceKey(hostname, resource)
+			loads[key] = load
+			capacities[key] = hostCapacities[resource]
+		}
+	}
+
+	newPrices := priceUpdater.GetNewPrices(oldPrices, loads, capacities)
+
+	newResourcePrices := make(map[string]map[string]float64)
+	for hostname, prices := range oldResourcePrices {
+		newResourcePrices[hostname] = make(map[string]float64)
+		for resource, price := range prices {
+			if newPrice, ok := newPrices[getResourceKey(hostname, resource)]; ok {
+				price = newPrice
+			}
+			newResourcePrices[hostname][resource] = price
+		}
+	}
+
+	return newResourcePrices
+}
+
+// getHostPrices returns the price of every host, i.e. the cost of a plain
+// request on it
+func getHostPrices(resourcePrices map[string]map[string]float64) map[string]float64 {
+	hostPrices := make(map[string]float64)
+	for hostname, prices := range resourcePrices {
+		hostPrices[hostname] = prices[requestsResource]
+	}
+	return hostPrices
+}
+
+// getCostsForLBs returns the cost of every LB on every host it could use (the
+// hosts of the given resource prices, ours and the other shards' ones), by
+// the demand of the LB's pods on the host
+func getCostsForLBs(
+	LBs map[string]LBProps,
+	pods map[string]PodProps,
+	lbResourcePrices map[string]map[string]float64) map[string]map[string]float64 {
+
+	costsForLBs := make(map[string]map[string]float64)
+
+	for lbName, LB := range LBs {
+		demands := getLBDemands(LB, pods, LBs)
+		costs := make(map[string]float64)
+		for hostname, prices := range lbResourcePrices {
+			demand, ok := demands[hostname]
+			if !ok {
+				// the LB has no pod there to send requests to
+				demand = getDemand(LB.Demand)
+			}
+			costs[hostname] = getCost(prices, demand)
+		}
+		costsForLBs[lbName] = costs
+	}
+
+	return costsForLBs
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+)
+
+/*
+Shadow mode:
+	a candidate policy (price updater and/or traffic splitter) runs next to the
+	live one every round, on the same loads, but its decisions are never sent
+	to any LB
+	the shadow keeps its own prices, starting from the live prices of the hosts
+	when it first sees them, and its own hysteresis (a copy of the live switch
+	tracker taken on its first round), so LBs the live policy holds back on
+	their host are held back by the shadow in the same way
+	for every LB the live and shadow decisions are compared as shares of the
+	LB's traffic per host; their distance is the share of traffic that would
+	go to a different host (0 when they agree, 1 when they share no host)
+	disagreements are logged every round, a summary every summaryEvery rounds
+
+Shadow API:
+	GET /shadow    summary of the disagreements and the decisions of the last round
+*/
+
+type ShadowLBDiff struct {
+	LB       string             `json:"lb"`
+	Live     map[string]float64 `json:"live"`
+	Shadow   map[string]float64 `json:"shadow"`
+	Distance float64            `json:"distance"`
+}
+
+type ShadowRound struct {
+	Round         int                `json:"round"`
+	ShadowPrices  map[string]float64 `json:"shadowPrices"`
+	MaxPriceDiff  float64            `json:"maxPriceDiff"`
+	Disagreements []ShadowLBDiff     `json:"disagreements"`
+}
+
+type ShadowSummary struct {
+	Policy                 string      `json:"policy"`
+	Rounds                 int         `json:"rounds"`
+	RoundsWithDisagreement int         `json:"roundsWithDisagreement"`
+	LBDecisions            int         `json:"lbDecisions"`
+	LBDisagreements        int         `json:"lbDisagreements"`
+	DisagreementRate       float64     `json:"disagreementRate"`
+	MeanDistance           float64     `json:"meanDistance"`
+	MaxDistance            float64     `json:"maxDistance"`
+	MeanMaxPriceDiff       float64     `json:"meanMaxPriceDiff"`
+	MaxPriceDiff           float64     `json:"maxPriceDiff"`
+	LastRound              ShadowRound `json:"lastRound"`
+
+	sumOfDistances    float64
+	sumOfMaxPriceDiff float64
+}
+
+type ShadowPolicy struct {
+	mu           sync.Mutex
+	description  string
+	priceUpdater PriceUpdater
+	splitter     *TrafficSplitter
+	summaryEvery int
+
+	resourcePrices     map[string]map[string]float64
+	optimalHostsForLBs map[string]string
+	switches           *SwitchTracker
+	summary            ShadowSummary
+}
+
+func NewShadowPolicy(
+	description string,
+	priceUpdater PriceUpdater,
+	splitter *TrafficSplitter,
+	summaryEvery int) *ShadowPolicy {
+
+	return &ShadowPolicy{
+		description:        description,
+		priceUpdater:       priceUpdater,
+		splitter:           splitter,
+		summaryEvery:       summaryEvery,
+		resourcePrices:     make(map[string]map[string]float64),
+		optimalHostsForLBs: make(map[string]string),
+		summary:            ShadowSummary{Policy: description},
+	}
+}
+
+// getHostShares returns the share of an LB's traffic that each host gets
+func getHostShares(
+	LB LBProps,
+	pods map[string]PodProps,
+	hostprices map[string]float64,
+	health *HealthTracker,
+	splitter *TrafficSplitter,
+	optimalHost string) map[string]float64 {
+
+	hostShares := make(map[string]float64)
+	if splitter.IsWeighted() {
+		for podname, weight := range splitter.getPodWeights(LB, pods, hostprices, health) {
+			hostShares[pods[podname].HostName] += weight
+		}
+	} else if optimalHost != "" {
+		hostShares[optimalHost] = 1
+	}
+	return hostShares
+}
+
+// getShareDistance returns the share of traffic that goes to different hosts
+func getShareDistance(a map[string]float64, b map[string]float64) float64 {
+	distance := 0.0
+	for hostname, share := range a {
+		distance += math.Abs(share - b[hostname])
+	}
+	for hostname, share := range b {
+		if _, ok := a[hostname]; !ok {
+			distance += share
+		}
+	}
+	return distance / 2
+}
+
+// ShadowRoundContext is what the shadow policy gets of a round: the inputs
+// of the live policy, which it decides on too, and the live decisions it
+// compares its own with
+type ShadowRoundContext struct {
+	Round      int
+	Hosts      map[string]HostProps
+	Pods       map[string]PodProps
+	LBs        map[string]LBProps
+	HostLoads  map[string]int
+	PodReports map[string]Req
+	Health     *HealthTracker
+	Overrides  *Overrides
+
+	// computes the LBs' costs from the resource prices of every host
+	GetLBCosts func(map[string]map[string]float64) map[string]map[string]float64
+
+	LiveResourcePrices     map[string]map[string]float64
+	LiveLBResourcePrices   map[string]map[string]float64
+	LivePricesForLBs       map[string]map[string]float64
+	LiveOptimalHostsForLBs map[string]string
+	LiveSplitter           *TrafficSplitter
+	LiveSwitches           *SwitchTracker
+}
+
+// Run computes the shadow decisions of a round and compares them with the
+// live ones
+func (s *ShadowPolicy) Run(rc ShadowRoundContext) {
+
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.switches == nil {
+		if s.switches = rc.LiveSwitches.Copy(); s.switches != nil {
+			s.switches.logPrefix = "Shadow: "
+		}
+	}
+	s.switches.Reconcile(rc.LBs)
+
+	// follow the topology, starting new hosts at their live prices
+	for hostname := range s.resourcePrices {
+		if _, ok := rc.Hosts[hostname]; !ok {
+			delete(s.resourcePrices, hostname)
+		}
+	}
+	for hostname := range rc.Hosts {
+		if _, ok := s.resourcePrices[hostname]; !ok {
+			s.resourcePrices[hostname] = make(map[string]float64)
+			for resource, price := range rc.LiveResourcePrices[hostname] {
+				s.resourcePrices[hostname][resource] = price
+			}
+		}
+	}
+	s.resourcePrices = reconcileResourcePrices(rc.Hosts, s.resourcePrices)
+
+	s.resourcePrices = getNewResourcePrices(rc.Hosts, rc.Pods, rc.LBs, rc.HostLoads, rc.PodReports, s.resourcePrices, s.priceUpdater)
+	hostPrices := getHostPrices(s.resourcePrices)
+	liveHostPrices := getHostPrices(rc.LiveResourcePrices)
+
+	// the prices of other shards' hosts are the same for both
+	lbResourcePrices := copyResourcePrices(rc.LiveLBResourcePrices)
+	for hostname, prices := range copyResourcePrices(s.resourcePrices) {
+		lbResourcePrices[hostname] = prices
+	}
+	shadowRound := ShadowRound{
+		Round:        rc.Round,
+		ShadowPrices: make(map[string]float64),
+	}
+	for hostname, price := range hostPrices {
+		shadowRound.ShadowPrices[hostname] = price
+		shadowRound.MaxPriceDiff = math.Max(shadowRound.MaxPriceDiff, math.Abs(price-liveHostPrices[hostname]))
+	}
+
+	// the LBs' costs are computed, and the operator's overrides apply, in the
+	// same way for both
+	pricesForLBs := rc.Overrides.GetPricesForLBs(rc.GetLBCosts(lbResourcePrices), s.optimalHostsForLBs)
+	s.optimalHostsForLBs = make(map[string]string)
+
+	for lbName, LB := range rc.LBs {
+		liveShares := getHostShares(LB, rc.Pods, rc.LivePricesForLBs[lbName], rc.Health, rc.LiveSplitter, rc.LiveOptimalHostsForLBs[lbName])
+
+		prices := pricesForLBs[lbName]
+		shadowOptimalHost := getLeastPricedHost(LB.PodNames, rc.Pods, prices, rc.Health)
+		// a tie with the live host is not a disagreement
+		if liveOptimalHost := rc.LiveOptimalHostsForLBs[lbName]; liveOptimalHost != "" && prices[liveOptimalHost] == prices[shadowOptimalHost] {
+			if _, ok := prices[liveOptimalHost]; ok {
+				shadowOptimalHost = liveOptimalHost
+			}
+		}
+		shadowOptimalHost = s.switches.GetHost(rc.Round, lbName, shadowOptimalHost, prices, getIsHostUsable(LB, rc.Pods, rc.Health))
+		s.optimalHostsForLBs[lbName] = shadowOptimalHost
+		shadowShares := getHostShares(LB, rc.Pods, prices, rc.Health, s.splitter, shadowOptimalHost)
+
+		distance := getShareDistance(liveShares, shadowShares)
+		s.summary.LBDecisions++
+		s.summary.sumOfDistances += distance
+		s.summary.MaxDistance = math.Max(s.summary.MaxDistance, distance)
+
+		if distance > 1e-3 {
+			s.summary.LBDisagreements++
+			shadowRound.Disagreements = append(shadowRound.Disagreements, ShadowLBDiff{lbName, liveShares, shadowShares, distance})
+			log.Printf("Shadow: round %d: LB %s live %v shadow %v (distance %.3f)\n", rc.Round, lbName, liveShares, shadowShares, distance)
+		}
+	}
+
+	s.summary.Rounds++
+	if len(shadowRound.Disagreements) > 0 {
+		s.summary.RoundsWithDisagreement++
+	}
+	s.summary.sumOfMaxPriceDiff += shadowRound.MaxPriceDiff
+	s.summary.MaxPriceDiff = math.Max(s.summary.MaxPriceDiff, shadowRound.MaxPriceDiff)
+	s.summary.LastRound = shadowRound
+
+	if s.summary.LBDecisions > 0 {
+		s.summary.DisagreementRate = float64(s.summary.LBDisagreements) / float64(s.summary.LBDecisions)
+		s.summary.MeanDistance = s.summary.sumOfDistances / float64(s.summary.LBDecisions)
+	}
+	s.summary.MeanMaxPriceDiff = s.summary.sumOfMaxPriceDiff / float64(s.summary.Rounds)
+
+	if s.summary.Rounds%s.summaryEvery == 0 {
+		log.Printf("Shadow: %s after %d rounds: %d/%d LB decisions disagreed (%.1f%%) in %d rounds, distance mean %.3f max %.3f, price diff mean %.3f max %.3f\n",
+			s.description, s.summary.Rounds,
+			s.summary.LBDisagreements, s.summary.LBDecisions, 100*s.summary.DisagreementRate, s.summary.RoundsWithDisagreement,
+			s.summary.MeanDistance, s.summary.MaxDistance,
+			s.summary.MeanMaxPriceDiff, s.summary.MaxPriceDiff)
+	}
+}
+
+func (s *ShadowPolicy) GetSummary() ShadowSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.summary
+}
+
+func registerShadowHandlers(mux *http.ServeMux, shadow *ShadowPolicy) {
+	if shadow == nil {
+		return
+	}
+	mux.HandleFunc("/shadow", func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, shadow.GetSummary())
+	})
+}
+
+/*
+getShadowPolicy builds the shadow policy configured by the environment, or
+returns nil if there is none. The shadow has the live settings except for:
+  - SHADOW_PRICE_UPDATER, SHADOW_PRICE_EPSILON, SHADOW_PRICE_STEP_RULE, SHADOW_PRICE_MIN
+  - SHADOW_SPLIT_POLICY, SHADOW_SPLIT_TEMPERATURE
+  - SHADOW_SUMMARY_ROUNDS: rounds between summaries in the log, default 10
+*/
+func getShadowPolicy() *ShadowPolicy {
+	if os.Getenv("SHADOW_PRICE_UPDATER") == "" && os.Getenv("SHADOW_SPLIT_POLICY") == "" {
+		return nil
+	}
+
+	priceUpdaterName := getEnvString("SHADOW_PRICE_UPDATER", getEnvString("PRICE_UPDATER", "srikanth"))
+	epsilon := getEnvFloat("SHADOW_PRICE_EPSILON", getEnvFloat("PRICE_EPSILON", 1.0))
+	stepRule := getEnvString("SHADOW_PRICE_STEP_RULE", getEnvString("PRICE_STEP_RULE", "diminishing"))
+	minPrice := getEnvFloat("SHADOW_PRICE_MIN", getEnvFloat("PRICE_MIN", 0.001))
+	priceUpdater, err := newPriceUpdater(priceUpdaterName, epsilon, stepRule, minPrice)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	splitPolicy := getEnvString("SHADOW_SPLIT_POLICY", getEnvString("SPLIT_POLICY", "single"))
+	temperature := getEnvFloat("SHADOW_SPLIT_TEMPERATURE", getEnvFloat("SPLIT_TEMPERATURE", 1.0))
+	splitter, err := NewTrafficSplitter(splitPolicy, temperature, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	summaryEvery := int(getEnvFloat("SHADOW_SUMMARY_ROUNDS", 10))
+	if summaryEvery <= 0 {
+		log.Fatal("SHADOW_SUMMARY_ROUNDS must be positive")
+	}
+
+	description := fmt.Sprintf("%s(epsilon=%g, step=%s, min=%g)/%s(temperature=%g)",
+		priceUpdaterName, epsilon, stepRule, minPrice, splitPolicy, temperature)
+	log.Printf("Shadow: running %s\n", description)
+
+	return NewShadowPolicy(description, priceUpdater, splitter, summaryEvery)
+}
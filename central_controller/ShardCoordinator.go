@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Hierarchical mode:
+	hosts and LBs are partitioned into shards, each run by its own controller
+	a coordinator keeps track of the shard controllers and decides which shard
+	owns each host and LB:
+		- hosts are spread over the shards by rendezvous hashing, so adding or
+		  removing a shard only moves the hosts of that shard
+		- an LB is owned by the shard that owns most of the hosts of its pods
+	shard controllers register with the coordinator every round (which also
+	tells them the current assignment); a shard that has not registered for
+	the shard TTL is dropped and its hosts and LBs are rebalanced
+
+Coordinator API:
+	POST   /shards?id=<shard id>&url=<host:port of the shard controller>
+	DELETE /shards?id=<shard id>
+	GET    /shards/assignment
+*/
+
+type ShardAssignment struct {
+	Version    int               `json:"version"`
+	Shards     map[string]string `json:"shards"`
+	HostOwners map[string]string `json:"hostOwners"`
+	LBOwners   map[string]string `json:"lbOwners"`
+}
+
+type shardRegistration struct {
+	URL      string
+	lastSeen time.Time
+}
+
+type ShardCoordinator struct {
+	mu         sync.Mutex
+	topology   *Topology
+	shards     map[string]*shardRegistration
+	ttl        time.Duration
+	assignment ShardAssignment
+}
+
+func NewShardCoordinator(topology *Topology, ttl time.Duration) *ShardCoordinator {
+	return &ShardCoordinator{
+		topology: topology,
+		shards:   make(map[string]*shardRegistration),
+		ttl:      ttl,
+		assignment: ShardAssignment{
+			Shards:     map[string]string{},
+			HostOwners: map[string]string{},
+			LBOwners:   map[string]string{},
+		},
+	}
+}
+
+func (c *ShardCoordinator) Register(id string, url string) ShardAssignment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.shards[id]; !ok {
+		log.Printf("Coordinator: shard %s joined at %s\n", id, url)
+	}
+	c.shards[id] = &shardRegistration{URL: url, lastSeen: time.Now()}
+
+	return c.getAssignment()
+}
+
+func (c *ShardCoordinator) Deregister(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.shards[id]; ok {
+		log.Printf("Coordinator: shard %s left\n", id)
+		delete(c.shards, id)
+	}
+}
+
+func (c *ShardCoordinator) GetAssignment() ShardAssignment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.getAssignment()
+}
+
+// getAssignment rebalances the hosts and LBs over the live shards, and bumps
+// the version of the assignment if anything moved
+func (c *ShardCoordinator) getAssignment() ShardAssignment {
+
+	for id, shard := range c.shards {
+		if time.Since(shard.lastSeen) > c.ttl {
+			log.Printf("Coordinator: shard %s expired (last seen %s ago)\n", id, time.Since(shard.lastSeen).Round(time.Millisecond))
+			delete(c.shards, id)
+		}
+	}
+
+	hosts, pods, LBs := c.topology.Get()
+
+	assignment := ShardAssignment{
+		Version:    c.assignment.Version,
+		Shards:     make(map[string]string),
+		HostOwners: make(map[string]string),
+		LBOwners:   make(map[string]string),
+	}
+	shardIDs := make([]string, 0, len(c.shards))
+	for id, shard := range c.shards {
+		assignment.Shards[id] = shard.URL
+		shardIDs = append(shardIDs, id)
+	}
+	sort.Strings(shardIDs)
+
+	if len(shardIDs) > 0 {
+		for hostname := range hosts {
+			assignment.HostOwners[hostname] = getRendezvousShard(hostname, shardIDs)
+		}
+		for lbName, lbProps := range LBs {
+			assignment.LBOwners[lbName] = getLBOwnerShard(lbProps, pods, assignment.HostOwners, shardIDs)
+		}
+	}
+
+	if !isSameShardAssignment(assignment, c.assignment) {
+		assignment.Version++
+		logShardMoves(c.assignment, assignment)
+		c.assignment = assignment
+	}
+
+	return c.assignment
+}
+
+// getRendezvousShard returns the shard with the highest hash for the key
+func getRendezvousShard(key string, shardIDs []string) string {
+	var maxHash uint64
+	maxShardID := ""
+	for _, shardID := range shardIDs {
+		h := fnv.New64a()
+		h.Write([]byte(shardID + "/" + key))
+		if hash := h.Sum64(); maxShardID == "" || hash > maxHash {
+			maxHash = hash
+			maxShardID = shardID
+		}
+	}
+	return maxShardID
+}
+
+// getLBOwnerShard returns the shard that owns most of the hosts of the LB's
+// pods, breaking ties by shard id
+func getLBOwnerShard(
+	lbProps LBProps,
+	pods map[string]PodProps,
+	hostOwners map[string]string,
+	shardIDs []string) string {
+
+	podsPerShard := make(map[string]int)
+	for _, podname := range lbProps.PodNames {
+		if owner, ok := hostOwners[pods[podname].HostName]; ok {
+			podsPerShard[owner]++
+		}
+	}
+
+	if len(podsPerShard) == 0 {
+		return getRendezvousShard(lbProps.Name, shardIDs)
+	}
+
+	ownerShardID := ""
+	for _, shardID := range shardIDs {
+		if podsPerShard[shardID] > podsPerShard[ownerShardID] {
+			ownerShardID = shardID
+		}
+	}
+	return ownerShardID
+}
+
+func isSameStringMap(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func isSameShardAssignment(a ShardAssignment, b ShardAssignment) bool {
+	return isSameStringMap(a.Shards, b.Shards) &&
+		isSameStringMap(a.HostOwners, b.HostOwners) &&
+		isSameStringMap(a.LBOwners, b.LBOwners)
+}
+
+func logShardMoves(oldAssignment ShardAssignment, newAssignment ShardAssignment) {
+	for hostname, owner := range newAssignment.HostOwners {
+		if oldOwner := oldAssignment.HostOwners[hostname]; oldOwner != owner {
+			log.Printf("Coordinator: host %s moved from shard %q to %q\n", hostname, oldOwner, owner)
+		}
+	}
+	for lbName, owner := range newAssignment.LBOwners {
+		if oldOwner := oldAssignment.LBOwners[lbName]; oldOwner != owner {
+			log.Printf("Coordinator: LB %s moved from shard %q to %q\n", lbName, oldOwner, owner)
+		}
+	}
+	log.Printf("Coordinator: assignment version %d\n", newAssignment.Version)
+}
+
+func handleShards(coordinator *ShardCoordinator, w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		respondWithError(w, "missing shard id")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		url := r.URL.Query().Get("url")
+		if url == "" {
+			respondWithError(w, "missing shard url")
+			return
+		}
+		respondWithJSON(w, coordinator.Register(id, url))
+	case http.MethodDelete:
+		coordinator.Deregister(id)
+		respondWithJSON(w, coordinator.GetAssignment())
+	default:
+		respondWithMethodNotAllowed(w, r)
+	}
+}
+
+/*
+runCoordinator serves the coordinator API on the given port:
+  - SHARD_TTL_MS: time after which a shard that has not registered is dropped, default 10000
+*/
+func runCoordinator(topology *Topology, topologySource string, port int) {
+
+	coordinator := NewShardCoordinator(topology, time.Duration(getEnvFloat("SHARD_TTL_MS", 10000))*time.Millisecond)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/shards", func(w http.ResponseWriter, r *http.Request) {
+		handleShards(coordinator, w, r)
+	})
+	mux.HandleFunc("/shards/assignment", func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, coordinator.GetAssignment())
+	})
+	registerTopologyHandlers(mux, topology, topologySource, nil)
+	fmt.Printf("Coordinator running (port=%d)\n", port)
+
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux); err != nil {
+		log.Fatal(err)
+	}
+}
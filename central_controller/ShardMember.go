@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+ShardMember is the part of a shard controller that talks to the coordinator
+and to the other shards:
+	- it registers with the coordinator every round and keeps the latest
+	  shard assignment
+	- it narrows the topology down to the hosts and LBs of its shard
+	- it serves the prices of every resource of its own hosts on
+	  GET /shards/prices, and fetches the ones of other shards' hosts that
+	  its LBs' pods run on (as {"<host>": {"<resource>": <price>}}), so that
+	  it costs its LBs on every host in the same way
+
+A nil ShardMember owns every host and LB.
+*/
+type ShardMember struct {
+	id             string
+	url            string
+	coordinatorURL string
+	client         *http.Client
+
+	mu         sync.Mutex
+	assignment ShardAssignment
+	ownPrices  map[string]map[string]float64
+	peerPrices map[string]map[string]float64
+}
+
+func NewShardMember(id string, url string, coordinatorURL string) *ShardMember {
+	return &ShardMember{
+		id:             id,
+		url:            url,
+		coordinatorURL: coordinatorURL,
+		client: &http.Client{
+			Timeout: 500 * time.Millisecond,
+		},
+		ownPrices:  make(map[string]map[string]float64),
+		peerPrices: make(map[string]map[string]float64),
+	}
+}
+
+// Sync registers with the coordinator and picks up the latest assignment.
+// The last known assignment is kept if the coordinator can't be reached.
+func (m *ShardMember) Sync() {
+	if m == nil {
+		return
+	}
+
+	reqURL := fmt.Sprintf("http://%s/shards?id=%s&url=%s",
+		m.coordinatorURL, url.QueryEscape(m.id), url.QueryEscape(m.url))
+
+	res, err := m.client.Post(reqURL, "", nil)
+	if err != nil {
+		log.Printf("Shard %s: couldn't register with coordinator: %s\n", m.id, err)
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		log.Printf("Shard %s: coordinator responded with %d\n", m.id, res.StatusCode)
+		return
+	}
+
+	var assignment ShardAssignment
+	if err := json.NewDecoder(res.Body).Decode(&assignment); err != nil {
+		log.Printf("Shard %s: couldn't parse assignment: %s\n", m.id, err)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if assignment.Version != m.assignment.Version {
+		log.Printf("Shard %s: got assignment version %d\n", m.id, assignment.Version)
+	}
+	m.assignment = assignment
+}
+
+// GetShard returns the hosts and LBs owned by this shard
+func (m *ShardMember) GetShard(
+	hosts map[string]HostProps,
+	LBs map[string]LBProps) (map[string]HostProps, map[string]LBProps) {
+
+	if m == nil {
+		return hosts, LBs
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ownedHosts := make(map[string]HostProps)
+	for hostname, hostProps := range hosts {
+		if m.assignment.HostOwners[hostname] == m.id {
+			ownedHosts[hostname] = hostProps
+		}
+	}
+
+	ownedLBs := make(map[string]LBProps)
+	for lbName, lbProps := range LBs {
+		if m.assignment.LBOwners[lbName] == m.id {
+			ownedLBs[lbName] = lbProps
+		}
+	}
+
+	return ownedHosts, ownedLBs
+}
+
+// SetOwnPrices publishes the resource prices of this shard's hosts to the
+// other shards
+func (m *ShardMember) SetOwnPrices(resourcePrices map[string]map[string]float64) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ownPrices = copyResourcePrices(resourcePrices)
+}
+
+func (m *ShardMember) GetOwnPrices() map[string]map[string]float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return copyResourcePrices(m.ownPrices)
+}
+
+// AddPeerPrices returns the resource prices of this shard's hosts together
+// with the ones of the other shards' hosts that the given LBs' pods run on.
+// Hosts whose owner can't be reached keep their last known prices.
+func (m *ShardMember) AddPeerPrices(
+	resourcePrices map[string]map[string]float64,
+	LBs map[string]LBProps,
+	pods map[string]PodProps) map[string]map[string]float64 {
+
+	if m == nil {
+		return resourcePrices
+	}
+
+	m.mu.Lock()
+	assignment := m.assignment
+	m.mu.Unlock()
+
+	// find the shards that own the hosts we need prices of
+	peerShards := make(map[string]bool)
+	for _, lbProps := range LBs {
+		for _, podname := range lbProps.PodNames {
+			owner, ok := assignment.HostOwners[pods[podname].HostName]
+			if ok && owner != m.id {
+				peerShards[owner] = true
+			}
+		}
+	}
+
+	type peerPricesResult struct {
+		shardID string
+		prices  map[string]map[string]float64
+		err     error
+	}
+	chResults := make(chan peerPricesResult)
+	for shardID := range peerShards {
+		go func(shardID string) {
+			prices, err := m.fetchPeerPrices(assignment.Shards[shardID])
+			chResults <- peerPricesResult{shardID, prices, err}
+		}(shardID)
+	}
+
+	// don't hold the lock while waiting for the other shards, which may be
+	// asking for our prices at the same time
+	results := make([]peerPricesResult, 0, len(peerShards))
+	for range peerShards {
+		results = append(results, <-chResults)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, result := range results {
+		if result.err != nil {
+			log.Printf("Shard %s: couldn't get prices of shard %s, using last known prices: %s\n", m.id, result.shardID, result.err)
+			continue
+		}
+		for hostname, prices := range result.prices {
+			if assignment.HostOwners[hostname] == result.shardID {
+				m.peerPrices[hostname] = prices
+			}
+		}
+	}
+
+	allPrices := make(map[string]map[string]float64)
+	for hostname, prices := range m.peerPrices {
+		if owner, ok := assignment.HostOwners[hostname]; ok && owner != m.id {
+			allPrices[hostname] = prices
+		}
+	}
+	for hostname, prices := range resourcePrices {
+		allPrices[hostname] = prices
+	}
+
+	return allPrices
+}
+
+func (m *ShardMember) fetchPeerPrices(peerURL string) (map[string]map[string]float64, error) {
+	if peerURL == "" {
+		return nil, fmt.Errorf("shard has no url")
+	}
+
+	res, err := m.client.Get(fmt.Sprintf("http://%s/shards/prices", peerURL))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("shard at %s responded with %d", peerURL, res.StatusCode)
+	}
+
+	var prices map[string]map[string]float64
+	if err := json.NewDecoder(res.Body).Decode(&prices); err != nil {
+		return nil, err
+	}
+	return prices, nil
+}
+
+func registerShardHandlers(mux *http.ServeMux, shardMember *ShardMember) {
+	if shardMember == nil {
+		return
+	}
+	mux.HandleFunc("/shards/prices", func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, shardMember.GetOwnPrices())
+	})
+}
+
+/*
+getShardMember configures this controller as a shard controller, or returns
+nil if it runs all hosts and LBs by itself:
+  - SHARD_ID:        id of this shard
+  - SHARD_URL:       host:port the other shards reach this controller at
+  - COORDINATOR_URL: host:port of the coordinator
+*/
+func getShardMember() *ShardMember {
+	id := os.Getenv("SHARD_ID")
+	if id == "" {
+		return nil
+	}
+
+	shardURL := os.Getenv("SHARD_URL")
+	coordinatorURL := os.Getenv("COORDINATOR_URL")
+	if shardURL == "" || coordinatorURL == "" {
+		log.Fatal("SHARD_URL and COORDINATOR_URL must be set for shard ", id)
+	}
+
+	return NewShardMember(id, shardURL, coordinatorURL)
+}
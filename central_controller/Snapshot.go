@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+Snapshots:
+	the controller periodically snapshots its host prices, round number and
+	last LB assignments to a file and/or a Redis key, and warm-starts from
+	the newest snapshot on boot if it is
+		- not older than the max snapshot age, and
+		- taken for the same hosts (with the same capacities), i.e. the hosts
+		  of our shard in hierarchical mode
+	otherwise it starts from the initial prices
+*/
+
+const snapshotFormatVersion = 1
+
+type ControllerSnapshot struct {
+	FormatVersion  int                `json:"formatVersion"`
+	TakenAt        time.Time          `json:"takenAt"`
+	Round          int                `json:"round"`
+	HostPrices     map[string]float64 `json:"hostPrices"`
+	HostCapacities map[string]int     `json:"hostCapacities"`
+	Assignments    map[string]string  `json:"assignments"`
+
+	// prices and capacities of every resource of the hosts (missing in
+	// snapshots taken before hosts had more than one resource)
+	ResourcePrices     map[string]map[string]float64 `json:"resourcePrices,omitempty"`
+	ResourceCapacities map[string]map[string]float64 `json:"resourceCapacities,omitempty"`
+
+	// step size state of the price updater, if it has one
+	PriceUpdaterState *PriceUpdaterState `json:"priceUpdaterState,omitempty"`
+}
+
+type Snapshotter struct {
+	path        string
+	redisClient *redis.Client
+	redisKey    string
+	interval    time.Duration
+	maxAge      time.Duration
+
+	lastSaved time.Time
+}
+
+func NewControllerSnapshot(
+	round int,
+	hosts map[string]HostProps,
+	resourcePrices map[string]map[string]float64,
+	assignments map[string]string,
+	priceUpdater PriceUpdater) ControllerSnapshot {
+
+	snapshot := ControllerSnapshot{
+		FormatVersion:      snapshotFormatVersion,
+		TakenAt:            time.Now(),
+		Round:              round,
+		HostPrices:         getHostPrices(resourcePrices),
+		HostCapacities:     make(map[string]int),
+		Assignments:        make(map[string]string),
+		ResourcePrices:     make(map[string]map[string]float64),
+		ResourceCapacities: make(map[string]map[string]float64),
+		PriceUpdaterState:  getPriceUpdaterState(priceUpdater),
+	}
+	for hostname, prices := range resourcePrices {
+		snapshot.ResourcePrices[hostname] = make(map[string]float64)
+		for resource, price := range prices {
+			snapshot.ResourcePrices[hostname][resource] = price
+		}
+	}
+	for hostname, hostProps := range hosts {
+		snapshot.HostCapacities[hostname] = hostProps.LoadCapacity
+		snapshot.ResourceCapacities[hostname] = getHostCapacities(hostProps)
+	}
+	for lbName, hostname := range assignments {
+		snapshot.Assignments[lbName] = hostname
+	}
+	return snapshot
+}
+
+// GetResourcePrices returns the resource prices of the snapshot, taking the
+// host prices as the price of "requests" in older snapshots
+func (snapshot ControllerSnapshot) GetResourcePrices() map[string]map[string]float64 {
+	if snapshot.ResourcePrices != nil {
+		return snapshot.ResourcePrices
+	}
+	resourcePrices := make(map[string]map[string]float64)
+	for hostname, price := range snapshot.HostPrices {
+		resourcePrices[hostname] = map[string]float64{requestsResource: price}
+	}
+	return resourcePrices
+}
+
+func (s *Snapshotter) isEnabled() bool {
+	return s != nil && (s.path != "" || s.redisClient != nil)
+}
+
+// MaybeSave saves the snapshot if the snapshot interval has passed since the
+// last save
+func (s *Snapshotter) MaybeSave(snapshot ControllerSnapshot) {
+	if !s.isEnabled() || time.Since(s.lastSaved) < s.interval {
+		return
+	}
+	if err := s.Save(snapshot); err != nil {
+		log.Printf("Error: couldn't save snapshot: %s\n", err)
+		return
+	}
+	s.lastSaved = time.Now()
+}
+
+func (s *Snapshotter) Save(snapshot ControllerSnapshot) error {
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	if s.path != "" {
+		// write to a temporary file first so that a crash never leaves a
+		// half written snapshot behind
+		tmpPath := filepath.Join(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp")
+		if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmpPath, s.path); err != nil {
+			return err
+		}
+	}
+
+	if s.redisClient != nil {
+		ctxTimeout, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+		defer cancel()
+		if err := s.redisClient.Set(ctxTimeout, s.redisKey, data, 0).Err(); err != nil {
+			return fmt.Errorf("couldn't save snapshot to Redis: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// LoadLatest returns the newest snapshot found in the file or in Redis
+func (s *Snapshotter) LoadLatest() (ControllerSnapshot, bool) {
+
+	var latest ControllerSnapshot
+	found := false
+
+	if s.path != "" {
+		data, err := os.ReadFile(s.path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Error: couldn't read snapshot file %s: %s\n", s.path, err)
+		}
+		if snapshot, ok := parseSnapshot(data, s.path); ok {
+			latest = snapshot
+			found = true
+		}
+	}
+
+	if s.redisClient != nil {
+		ctxTimeout, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+		defer cancel()
+		data, err := s.redisClient.Get(ctxTimeout, s.redisKey).Bytes()
+		if err != nil && err != redis.Nil {
+			log.Printf("Error: couldn't get snapshot from Redis: %s\n", err)
+		}
+		snapshot, ok := parseSnapshot(data, "redis key "+s.redisKey)
+		if ok && (!found || snapshot.TakenAt.After(latest.TakenAt)) {
+			latest = snapshot
+			found = true
+		}
+	}
+
+	return latest, found
+}
+
+func parseSnapshot(data []byte, source string) (ControllerSnapshot, bool) {
+	if len(data) == 0 {
+		return ControllerSnapshot{}, false
+	}
+	var snapshot ControllerSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		log.Printf("Error: couldn't parse snapshot from %s: %s\n", source, err)
+		return ControllerSnapshot{}, false
+	}
+	return snapshot, true
+}
+
+// checkSnapshotCompatibility returns why the snapshot can't be used to warm
+// start a controller with the given hosts, or nil if it can
+func checkSnapshotCompatibility(
+	snapshot ControllerSnapshot,
+	hosts map[string]HostProps,
+	maxAge time.Duration) error {
+
+	if snapshot.FormatVersion != snapshotFormatVersion {
+		return fmt.Errorf("snapshot format version is %d, expected %d", snapshot.FormatVersion, snapshotFormatVersion)
+	}
+
+	age := time.Since(snapshot.TakenAt)
+	if age > maxAge {
+		return fmt.Errorf("snapshot is %s old (max age is %s)", age.Round(time.Millisecond), maxAge)
+	}
+
+	if len(snapshot.HostPrices) != len(hosts) {
+		return fmt.Errorf("snapshot has prices of %d hosts, topology has %d hosts", len(snapshot.HostPrices), len(hosts))
+	}
+	for hostname, hostProps := range hosts {
+		if _, ok := snapshot.HostPrices[hostname]; !ok {
+			return fmt.Errorf("snapshot has no price for host %s", hostname)
+		}
+		if snapshot.HostCapacities[hostname] != hostProps.LoadCapacity {
+			return fmt.Errorf("capacity of host %s was %d in snapshot, is %d now",
+				hostname, snapshot.HostCapacities[hostname], hostProps.LoadCapacity)
+		}
+		if snapshot.ResourceCapacities == nil {
+			continue
+		}
+		capacities := getHostCapacities(hostProps)
+		if len(snapshot.ResourceCapacities[hostname]) != len(capacities) {
+			return fmt.Errorf("host %s had %d resources in snapshot, has %d now",
+				hostname, len(snapshot.ResourceCapacities[hostname]), len(capacities))
+		}
+		for resource, capacity := range capacities {
+			if snapshotCapacity, ok := snapshot.ResourceCapacities[hostname][resource]; !ok || snapshotCapacity != capacity {
+				return fmt.Errorf("capacity of %s on host %s was %g in snapshot, is %g now",
+					resource, hostname, snapshotCapacity, capacity)
+			}
+		}
+	}
+
+	return nil
+}
+
+// getWarmStartState returns the round, resource prices and LB assignments
+// the controller should start with, and restores the state of the price
+// updater
+func getWarmStartState(
+	s *Snapshotter,
+	hosts map[string]HostProps,
+	priceUpdater PriceUpdater) (int, map[string]map[string]float64, map[string]string) {
+
+	initResourcePrices := make(map[string]map[string]float64)
+	for hostname, hostProps := range hosts {
+		initResourcePrices[hostname] = getInitResourcePrices(hostProps)
+	}
+
+	if !s.isEnabled() {
+		return 0, initResourcePrices, make(map[string]string)
+	}
+
+	snapshot, ok := s.LoadLatest()
+	if !ok {
+		log.Printf("Snapshot: none found, starting from initial prices\n")
+		return 0, initResourcePrices, make(map[string]string)
+	}
+
+	if err := checkSnapshotCompatibility(snapshot, hosts, s.maxAge); err != nil {
+		log.Printf("Snapshot: not reusing snapshot of round %d: %s\n", snapshot.Round, err)
+		return 0, initResourcePrices, make(map[string]string)
+	}
+
+	log.Printf("Snapshot: warm starting from round %d taken at %s: prices %v\n",
+		snapshot.Round, snapshot.TakenAt, snapshot.HostPrices)
+
+	setPriceUpdaterState(priceUpdater, snapshot.PriceUpdaterState)
+	return snapshot.Round, snapshot.GetResourcePrices(), snapshot.Assignments
+}
+
+/*
+getSnapshotter builds the snapshotter configured by the environment:
+  - SNAPSHOT_FILE:        file to keep the snapshot in
+  - SNAPSHOT_REDIS_ADDR:  Redis (host:port) to keep the snapshot in
+  - SNAPSHOT_REDIS_KEY:   key of the snapshot, default "central_controller_snapshot"
+  - SNAPSHOT_INTERVAL_MS: time between snapshots, default 5000
+  - SNAPSHOT_MAX_AGE_MS:  max age of a snapshot to warm start from, default 60000
+*/
+func getSnapshotter() *Snapshotter {
+	snapshotter := &Snapshotter{
+		path:     os.Getenv("SNAPSHOT_FILE"),
+		redisKey: getEnvString("SNAPSHOT_REDIS_KEY", "central_controller_snapshot"),
+		interval: time.Duration(getEnvFloat("SNAPSHOT_INTERVAL_MS", 5000)) * time.Millisecond,
+		maxAge:   time.Duration(getEnvFloat("SNAPSHOT_MAX_AGE_MS", 60000)) * time.Millisecond,
+	}
+
+	if redisAddr := os.Getenv("SNAPSHOT_REDIS_ADDR"); redisAddr != "" {
+		snapshotter.redisClient = redis.NewClient(&redis.Options{
+			Addr:     redisAddr,
+			Password: "",
+			DB:       0,
+		})
+	}
+
+	return snapshotter
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sync"
+)
+
+/*
+Hysteresis:
+	an LB stays on its current host unless its least priced host is worth
+	switching to:
+		- the LB has been on its current host for at least minDwellRounds rounds
+		- the new host's price is lower by at least minImprovement (relative
+		  to the current host's price)
+		- the new host's price is lower by more than switchCost
+	ties always keep the current host, so LBs don't flap between equally
+	priced hosts
+	an LB leaves its current host right away if the host (or all of the LB's
+	pods on it) becomes unavailable, or an override takes it away
+	every switch is charged switchCost; a switch back to the host the LB left
+	at its previous switch counts as a flap
+
+Switching API:
+	GET /switching    the current host, switches, flaps and switching cost of every LB
+*/
+
+type LBSwitching struct {
+	Host            string  `json:"host"`
+	SinceRound      int     `json:"sinceRound"`
+	PreviousHost    string  `json:"previousHost,omitempty"`
+	LastSwitchRound int     `json:"lastSwitchRound"`
+	Switches        int     `json:"switches"`
+	Flaps           int     `json:"flaps"`
+	HeldBack        int     `json:"heldBack"`
+	SwitchingCost   float64 `json:"switchingCost"`
+}
+
+type SwitchTracker struct {
+	mu             sync.Mutex
+	minImprovement float64
+	minDwellRounds int
+	switchCost     float64
+	logPrefix      string
+
+	LBs map[string]*LBSwitching
+}
+
+func NewSwitchTracker(minImprovement float64, minDwellRounds int, switchCost float64) *SwitchTracker {
+	return &SwitchTracker{
+		minImprovement: minImprovement,
+		minDwellRounds: minDwellRounds,
+		switchCost:     switchCost,
+		LBs:            make(map[string]*LBSwitching),
+	}
+}
+
+// Copy returns a tracker with the same settings and a copy of the state of
+// every LB
+func (t *SwitchTracker) Copy() *SwitchTracker {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tracker := NewSwitchTracker(t.minImprovement, t.minDwellRounds, t.switchCost)
+	for lbName, state := range t.LBs {
+		stateCopy := *state
+		tracker.LBs[lbName] = &stateCopy
+	}
+	return tracker
+}
+
+// Reconcile forgets the LBs that were removed from the topology
+func (t *SwitchTracker) Reconcile(LBs map[string]LBProps) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for lbName := range t.LBs {
+		if _, ok := LBs[lbName]; !ok {
+			delete(t.LBs, lbName)
+		}
+	}
+}
+
+func (t *SwitchTracker) isWorthSwitching(round int, state *LBSwitching, currentPrice float64, newPrice float64) bool {
+	if round-state.SinceRound < t.minDwellRounds {
+		return false
+	}
+	improvement := currentPrice - newPrice
+	return improvement > 0 && improvement >= t.minImprovement*math.Abs(currentPrice) && improvement > t.switchCost
+}
+
+// GetHost returns the host an LB is assigned to this round: its current
+// host, unless the least priced host is worth switching to or the current
+// host can no longer take the LB's traffic
+func (t *SwitchTracker) GetHost(
+	round int,
+	lbName string,
+	leastPricedHost string,
+	hostprices map[string]float64,
+	isUsable func(string) bool) string {
+
+	if t == nil || leastPricedHost == "" {
+		return leastPricedHost
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.LBs[lbName]
+	if !ok {
+		t.LBs[lbName] = &LBSwitching{Host: leastPricedHost, SinceRound: round, LastSwitchRound: round}
+		return leastPricedHost
+	}
+
+	currentHost := state.Host
+	if currentHost == leastPricedHost {
+		return currentHost
+	}
+
+	currentPrice, ok := hostprices[currentHost]
+	if ok && isUsable(currentHost) && !t.isWorthSwitching(round, state, currentPrice, hostprices[leastPricedHost]) {
+		state.HeldBack++
+		return currentHost
+	}
+
+	state.Switches++
+	if leastPricedHost == state.PreviousHost {
+		state.Flaps++
+	}
+	state.SwitchingCost += t.switchCost
+	state.PreviousHost = currentHost
+	state.Host = leastPricedHost
+	state.SinceRound = round
+	state.LastSwitchRound = round
+	log.Printf("%sSwitching: LB %s %s -> %s (switches: %d, flaps: %d)\n", t.logPrefix, lbName, currentHost, leastPricedHost, state.Switches, state.Flaps)
+
+	return leastPricedHost
+}
+
+func (t *SwitchTracker) GetStatus() map[string]LBSwitching {
+	status := make(map[string]LBSwitching)
+	if t == nil {
+		return status
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for lbName, state := range t.LBs {
+		status[lbName] = *state
+	}
+	return status
+}
+
+func registerSwitchingHandlers(mux *http.ServeMux, switches *SwitchTracker) {
+	mux.HandleFunc("/switching", func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, switches.GetStatus())
+	})
+}
+
+/*
+getSwitchTracker builds the hysteresis configured by the environment:
+  - SWITCH_MIN_IMPROVEMENT:  relative price improvement needed to switch an LB's host, default 0
+  - SWITCH_MIN_DWELL_ROUNDS: rounds an LB stays on a host before it can switch, default 0
+  - SWITCH_COST:             price improvement a switch must beat, charged on every switch, default 0
+*/
+func getSwitchTracker() *SwitchTracker {
+	minImprovement := getEnvFloat("SWITCH_MIN_IMPROVEMENT", 0)
+	minDwellRounds := int(getEnvFloat("SWITCH_MIN_DWELL_ROUNDS", 0))
+	switchCost := getEnvFloat("SWITCH_COST", 0)
+	if minImprovement < 0 || minDwellRounds < 0 || switchCost < 0 {
+		log.Fatal("SWITCH_MIN_IMPROVEMENT, SWITCH_MIN_DWELL_ROUNDS and SWITCH_COST can't be negative")
+	}
+	return NewSwitchTracker(minImprovement, minDwellRounds, switchCost)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+/*
+Topology holds the hosts, pods and LBs the controller manages, and can be
+changed while the controller runs.
+
+The pods are the source of truth for membership: a pod names its host
+(hostName) and its LB (lbName), and the podNames of hosts and LBs are kept in
+sync with the pods by the topology. The controller reads a copy of the
+topology at the start of every round.
+*/
+type Topology struct {
+	mu    sync.RWMutex
+	hosts map[string]HostProps
+	pods  map[string]PodProps
+	LBs   map[string]LBProps
+}
+
+// TopologyConfig is the serialized form of a topology
+type TopologyConfig struct {
+	Hosts []HostProps `json:"hosts"`
+	Pods  []PodProps  `json:"pods"`
+	LBs   []LBProps   `json:"lbs"`
+}
+
+func NewTopology(
+	hosts map[string]HostProps,
+	pods map[string]PodProps,
+	LBs map[string]LBProps) *Topology {
+
+	return &Topology{
+		hosts: copyHosts(hosts),
+		pods:  copyPods(pods),
+		LBs:   copyLBs(LBs),
+	}
+}
+
+// Get returns a copy of the current topology
+func (t *Topology) Get() (map[string]HostProps, map[string]PodProps, map[string]LBProps) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return copyHosts(t.hosts), copyPods(t.pods), copyLBs(t.LBs)
+}
+
+// GetPodnameByAddress returns the name of the pod with the given address
+func (t *Topology) GetPodnameByAddress(address string) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for podname, podProps := range t.pods {
+		if podProps.IPAddress == address {
+			return podname, true
+		}
+	}
+	return "", false
+}
+
+func (t *Topology) GetConfig() TopologyConfig {
+	hosts, pods, LBs := t.Get()
+
+	config := TopologyConfig{
+		Hosts: make([]HostProps, 0, len(hosts)),
+		Pods:  make([]PodProps, 0, len(pods)),
+		LBs:   make([]LBProps, 0, len(LBs)),
+	}
+	for _, hostProps := range hosts {
+		config.Hosts = append(config.Hosts, hostProps)
+	}
+	for _, podProps := range pods {
+		config.Pods = append(config.Pods, podProps)
+	}
+	for _, lbProps := range LBs {
+		config.LBs = append(config.LBs, lbProps)
+	}
+
+	sort.Slice(config.Hosts, func(i, j int) bool { return config.Hosts[i].Name < config.Hosts[j].Name })
+	sort.Slice(config.Pods, func(i, j int) bool { return config.Pods[i].Name < config.Pods[j].Name })
+	sort.Slice(config.LBs, func(i, j int) bool { return config.LBs[i].Name < config.LBs[j].Name })
+
+	return config
+}
+
+// Replace swaps in a whole new topology, which must already be validated
+func (t *Topology) Replace(
+	hosts map[string]HostProps,
+	pods map[string]PodProps,
+	LBs map[string]LBProps) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.hosts = copyHosts(hosts)
+	t.pods = copyPods(pods)
+	t.LBs = copyLBs(LBs)
+}
+
+func (t *Topology) AddHost(host HostProps) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if host.Name == "" {
+		return fmt.Errorf("host has no name")
+	}
+	if _, ok := t.hosts[host.Name]; ok {
+		return fmt.Errorf("host %s already exists", host.Name)
+	}
+
+	// pods are placed on the host by adding them with its hostName
+	host.PodNames = []string{}
+	t.hosts[host.Name] = host
+
+	return nil
+}
+
+func (t *Topology) UpdateHost(host HostProps) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	oldHost, ok := t.hosts[host.Name]
+	if !ok {
+		return fmt.Errorf("host %s does not exist", host.Name)
+	}
+
+	host.PodNames = oldHost.PodNames
+	t.hosts[host.Name] = host
+
+	return nil
+}
+
+func (t *Topology) RemoveHost(hostName string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	host, ok := t.hosts[hostName]
+	if !ok {
+		return fmt.Errorf("host %s does not exist", hostName)
+	}
+	if len(host.PodNames) > 0 {
+		return fmt.Errorf("host %s still has pods %v", hostName, host.PodNames)
+	}
+
+	delete(t.hosts, hostName)
+
+	return nil
+}
+
+func (t *Topology) AddPod(pod PodProps) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if pod.Name == "" {
+		return fmt.Errorf("pod has no name")
+	}
+	if _, ok := t.pods[pod.Name]; ok {
+		return fmt.Errorf("pod %s already exists", pod.Name)
+	}
+	if err := t.checkPodReferences(pod); err != nil {
+		return err
+	}
+
+	t.pods[pod.Name] = pod
+	t.addPodToHostAndLB(pod)
+
+	return nil
+}
+
+func (t *Topology) UpdatePod(pod PodProps) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	oldPod, ok := t.pods[pod.Name]
+	if !ok {
+		return fmt.Errorf("pod %s does not exist", pod.Name)
+	}
+	if err := t.checkPodReferences(pod); err != nil {
+		return err
+	}
+
+	// the pod may have been rescheduled to another host or moved to another LB
+	t.removePodFromHostAndLB(oldPod)
+	t.pods[pod.Name] = pod
+	t.addPodToHostAndLB(pod)
+
+	return nil
+}
+
+func (t *Topology) RemovePod(podName string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pod, ok := t.pods[podName]
+	if !ok {
+		return fmt.Errorf("pod %s does not exist", podName)
+	}
+
+	t.removePodFromHostAndLB(pod)
+	delete(t.pods, podName)
+
+	return nil
+}
+
+func (t *Topology) AddLB(LB LBProps) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if LB.Name == "" {
+		return fmt.Errorf("LB has no name")
+	}
+	if _, ok := t.LBs[LB.Name]; ok {
+		return fmt.Errorf("LB %s already exists", LB.Name)
+	}
+
+	// pods are put behind the LB by adding them with its lbName
+	LB.PodNames = []string{}
+	t.LBs[LB.Name] = LB
+
+	return nil
+}
+
+func (t *Topology) UpdateLB(LB LBProps) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	oldLB, ok := t.LBs[LB.Name]
+	if !ok {
+		return fmt.Errorf("LB %s does not exist", LB.Name)
+	}
+
+	LB.PodNames = oldLB.PodNames
+	t.LBs[LB.Name] = LB
+
+	return nil
+}
+
+func (t *Topology) RemoveLB(LBName string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	LB, ok := t.LBs[LBName]
+	if !ok {
+		return fmt.Errorf("LB %s does not exist", LBName)
+	}
+	if len(LB.PodNames) > 0 {
+		return fmt.Errorf("LB %s still has pods %v", LBName, LB.PodNames)
+	}
+
+	delete(t.LBs, LBName)
+
+	return nil
+}
+
+func (t *Topology) checkPodReferences(pod PodProps) error {
+	if _, ok := t.hosts[pod.HostName]; !ok {
+		return fmt.Errorf("host %s of pod %s does not exist", pod.HostName, pod.Name)
+	}
+	if _, ok := t.LBs[pod.LBname]; pod.LBname != "" && !ok {
+		return fmt.Errorf("LB %s of pod %s does not exist", pod.LBname, pod.Name)
+	}
+	return nil
+}
+
+func (t *Topology) addPodToHostAndLB(pod PodProps) {
+	host := t.hosts[pod.HostName]
+	host.PodNames = append(host.PodNames, pod.Name)
+	t.hosts[pod.HostName] = host
+
+	if LB, ok := t.LBs[pod.LBname]; ok {
+		LB.PodNames = append(LB.PodNames, pod.Name)
+		t.LBs[pod.LBname] = LB
+	}
+}
+
+func (t *Topology) removePodFromHostAndLB(pod PodProps) {
+	if host, ok := t.hosts[pod.HostName]; ok {
+		host.PodNames = removeString(host.PodNames, pod.Name)
+		t.hosts[pod.HostName] = host
+	}
+
+	if LB, ok := t.LBs[pod.LBname]; ok {
+		LB.PodNames = removeString(LB.PodNames, pod.Name)
+		t.LBs[pod.LBname] = LB
+	}
+}
+
+func removeString(arr []string, str string) []string {
+	newArr := make([]string, 0, len(arr))
+	for _, s := range arr {
+		if s != str {
+			newArr = append(newArr, s)
+		}
+	}
+	return newArr
+}
+
+func copyStrings(arr []string) []string {
+	if arr == nil {
+		return nil
+	}
+	return append([]string{}, arr...)
+}
+
+func copyHosts(hosts map[string]HostProps) map[string]HostProps {
+	hostsCopy := make(map[string]HostProps)
+	for hostname, hostProps := range hosts {
+		hostProps.PodNames = copyStrings(hostProps.PodNames)
+		if hostProps.LoadSource != nil {
+			loadSource := *hostProps.LoadSource
+			hostProps.LoadSource = &loadSource
+		}
+		hostsCopy[hostname] = hostProps
+	}
+	return hostsCopy
+}
+
+func copyPods(pods map[string]PodProps) map[string]PodProps {
+	podsCopy := make(map[string]PodProps)
+	for podname, podProps := range pods {
+		podsCopy[podname] = podProps
+	}
+	return podsCopy
+}
+
+func copyLBs(LBs map[string]LBProps) map[string]LBProps {
+	LBsCopy := make(map[string]LBProps)
+	for lbName, lbProps := range LBs {
+		lbProps.PodNames = copyStrings(lbProps.PodNames)
+		LBsCopy[lbName] = lbProps
+	}
+	return LBsCopy
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+/*
+Topology API:
+	GET    /topology          the current topology as {"hosts", "pods", "lbs"}
+	POST   /topology/hosts    add the host in the body (HostProps)
+	PUT    /topology/hosts    update the host in the body (HostProps)
+	DELETE /topology/hosts?name=<hostname>
+	(same for /topology/pods with PodProps and /topology/lbs with LBProps)
+
+The podNames of hosts and LBs are ignored in requests; they follow the
+hostName and lbName of the pods that are added, updated or removed.
+
+When the topology comes from a topology file or from Kubernetes discovery,
+that source replaces the whole topology on every change, so the edits are
+refused with 409 Conflict (edit the source instead); GET still works.
+*/
+
+func respondWithJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error: couldn't encode response: %s\n", err)
+	}
+}
+
+func respondWithMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	w.Header().Set("Connection", "close")
+	fmt.Fprintf(w, "method %s not allowed on %s", r.Method, r.URL.Path)
+}
+
+func handleGetTopology(topology *Topology, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithMethodNotAllowed(w, r)
+		return
+	}
+	respondWithJSON(w, topology.GetConfig())
+}
+
+func handleTopologyHosts(topology *Topology, w http.ResponseWriter, r *http.Request) {
+
+	var err error
+	var host HostProps
+
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		if err = json.NewDecoder(r.Body).Decode(&host); err != nil {
+			respondWithError(w, fmt.Sprintf("invalid host: %s", err))
+			return
+		}
+		if r.Method == http.MethodPost {
+			err = topology.AddHost(host)
+		} else {
+			err = topology.UpdateHost(host)
+		}
+	case http.MethodDelete:
+		host.Name = r.URL.Query().Get("name")
+		err = topology.RemoveHost(host.Name)
+	default:
+		respondWithMethodNotAllowed(w, r)
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, err.Error())
+		return
+	}
+
+	log.Printf("Topology: %s host %s\n", r.Method, host.Name)
+	respondWithJSON(w, topology.GetConfig())
+}
+
+func handleTopologyPods(topology *Topology, w http.ResponseWriter, r *http.Request) {
+
+	var err error
+	var pod PodProps
+
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		if err = json.NewDecoder(r.Body).Decode(&pod); err != nil {
+			respondWithError(w, fmt.Sprintf("invalid pod: %s", err))
+			return
+		}
+		if r.Method == http.MethodPost {
+			err = topology.AddPod(pod)
+		} else {
+			err = topology.UpdatePod(pod)
+		}
+	case http.MethodDelete:
+		pod.Name = r.URL.Query().Get("name")
+		err = topology.RemovePod(pod.Name)
+	default:
+		respondWithMethodNotAllowed(w, r)
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, err.Error())
+		return
+	}
+
+	log.Printf("Topology: %s pod %s\n", r.Method, pod.Name)
+	respondWithJSON(w, topology.GetConfig())
+}
+
+func handleTopologyLBs(topology *Topology, w http.ResponseWriter, r *http.Request) {
+
+	var err error
+	var LB LBProps
+
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		if err = json.NewDecoder(r.Body).Decode(&LB); err != nil {
+			respondWithError(w, fmt.Sprintf("invalid LB: %s", err))
+			return
+		}
+		if r.Method == http.MethodPost {
+			err = topology.AddLB(LB)
+		} else {
+			err = topology.UpdateLB(LB)
+		}
+	case http.MethodDelete:
+		LB.Name = r.URL.Query().Get("name")
+		err = topology.RemoveLB(LB.Name)
+	default:
+		respondWithMethodNotAllowed(w, r)
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, err.Error())
+		return
+	}
+
+	log.Printf("Topology: %s LB %s\n", r.Method, LB.Name)
+	respondWithJSON(w, topology.GetConfig())
+}
+
+// rejectManagedTopologyEdit responds with 409 to edits of a topology that is
+// managed by a source (managedBy, empty if none), and reports whether it did
+func rejectManagedTopologyEdit(managedBy string, w http.ResponseWriter, r *http.Request) bool {
+	if managedBy == "" {
+		return false
+	}
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodDelete:
+		respondWithStatus(w, http.StatusConflict, fmt.Sprintf("the topology is managed by %s, edit it there", managedBy))
+		return true
+	}
+	return false
+}
+
+// registerTopologyHandlers serves the topology API; managedBy names the
+// source of the topology (e.g. "topology file topology.yaml"), or is empty
+// if the API manages it, and replica is nil unless the controller is
+// replicated
+func registerTopologyHandlers(mux *http.ServeMux, topology *Topology, managedBy string, replica *Replica) {
+	mux.HandleFunc("/topology", func(w http.ResponseWriter, r *http.Request) {
+		handleGetTopology(topology, w, r)
+	})
+	mux.HandleFunc("/topology/hosts", forwardWritesToLeader(replica, func(w http.ResponseWriter, r *http.Request) {
+		if rejectManagedTopologyEdit(managedBy, w, r) {
+			return
+		}
+		handleTopologyHosts(topology, w, r)
+	}))
+	mux.HandleFunc("/topology/pods", forwardWritesToLeader(replica, func(w http.ResponseWriter, r *http.Request) {
+		if rejectManagedTopologyEdit(managedBy, w, r) {
+			return
+		}
+		handleTopologyPods(topology, w, r)
+	}))
+	mux.HandleFunc("/topology/lbs", forwardWritesToLeader(replica, func(w http.ResponseWriter, r *http.Request) {
+		if rejectManagedTopologyEdit(managedBy, w, r) {
+			return
+		}
+		handleTopologyLBs(topology, w, r)
+	}))
+}
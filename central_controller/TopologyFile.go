@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+/*
+Topology file:
+	the topology can be read from a JSON or YAML file (by extension) of the form
+		{"hosts": [HostProps...], "pods": [PodProps...], "lbs": [LBProps...]}
+	the file is watched for changes; a changed file replaces the whole
+	topology (including changes made through the topology API) if it is
+	valid, otherwise the controller keeps running on the last good topology
+*/
+
+func parseTopologyConfig(path string, data []byte) (TopologyConfig, error) {
+	var config TopologyConfig
+
+	ext := strings.ToLower(filepath.Ext(path))
+
+	var err error
+	if ext == ".yaml" || ext == ".yml" {
+		err = yaml.UnmarshalStrict(data, &config)
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&config)
+	}
+	if err != nil {
+		return TopologyConfig{}, fmt.Errorf("couldn't parse topology file %s: %w", path, err)
+	}
+
+	return config, nil
+}
+
+func loadTopologyFile(path string) (map[string]HostProps, map[string]PodProps, map[string]LBProps, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("couldn't read topology file %s: %w", path, err)
+	}
+
+	config, err := parseTopologyConfig(path, data)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := checkForDuplicateNames(config); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid topology file %s: %w", path, err)
+	}
+
+	hosts := getHostsListMappedToName(config.Hosts)
+	pods := getPodsListMappedToName(config.Pods)
+	LBs := getLBsListMappedToName(config.LBs)
+
+	if err := validateTopology(hosts, pods, LBs); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid topology file %s: %w", path, err)
+	}
+
+	return hosts, pods, LBs, nil
+}
+
+func checkForDuplicateNames(config TopologyConfig) error {
+	var problems []string
+
+	hostNames := make(map[string]bool)
+	for _, hostProps := range config.Hosts {
+		if hostNames[hostProps.Name] {
+			problems = append(problems, fmt.Sprintf("host %s is defined more than once", hostProps.Name))
+		}
+		hostNames[hostProps.Name] = true
+	}
+
+	podNames := make(map[string]bool)
+	for _, podProps := range config.Pods {
+		if podNames[podProps.Name] {
+			problems = append(problems, fmt.Sprintf("pod %s is defined more than once", podProps.Name))
+		}
+		podNames[podProps.Name] = true
+	}
+
+	lbNames := make(map[string]bool)
+	for _, lbProps := range config.LBs {
+		if lbNames[lbProps.Name] {
+			problems = append(problems, fmt.Sprintf("LB %s is defined more than once", lbProps.Name))
+		}
+		lbNames[lbProps.Name] = true
+	}
+
+	return getProblemsAsError(problems)
+}
+
+// validateTopology checks that the hosts, pods and LBs refer to each other
+// consistently, and reports every problem it finds
+func validateTopology(
+	hosts map[string]HostProps,
+	pods map[string]PodProps,
+	LBs map[string]LBProps) error {
+
+	var problems []string
+
+	for hostname, hostProps := range hosts {
+		if hostname == "" {
+			problems = append(problems, "a host has no name")
+		}
+		if hostProps.LoadCapacity <= 0 {
+			problems = append(problems, fmt.Sprintf("host %s has non-positive loadCapacity %d", hostname, hostProps.LoadCapacity))
+		}
+		for resource, capacity := range hostProps.Capacities {
+			if capacity <= 0 {
+				problems = append(problems, fmt.Sprintf("host %s has non-positive capacity %g of %s", hostname, capacity, resource))
+			}
+		}
+		problems = append(problems, validateLoadSource(hostname, hostProps.LoadSource)...)
+		for _, podname := range hostProps.PodNames {
+			podProps, ok := pods[podname]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("host %s lists pod %s which does not exist", hostname, podname))
+			} else if podProps.HostName != hostname {
+				problems = append(problems, fmt.Sprintf("host %s lists pod %s whose hostName is %s", hostname, podname, podProps.HostName))
+			}
+		}
+	}
+
+	for podname, podProps := range pods {
+		if podname == "" {
+			problems = append(problems, "a pod has no name")
+		}
+		for resource, amount := range podProps.Demand {
+			if amount < 0 {
+				problems = append(problems, fmt.Sprintf("pod %s has negative demand %g of %s", podname, amount, resource))
+			}
+		}
+		hostProps, ok := hosts[podProps.HostName]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("pod %s has hostName %s which does not exist", podname, podProps.HostName))
+		} else if !containsString(hostProps.PodNames, podname) {
+			problems = append(problems, fmt.Sprintf("pod %s has hostName %s which does not list it in podNames", podname, podProps.HostName))
+		}
+		if podProps.LBname != "" {
+			lbProps, ok := LBs[podProps.LBname]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("pod %s has lbName %s which does not exist", podname, podProps.LBname))
+			} else if !containsString(lbProps.PodNames, podname) {
+				problems = append(problems, fmt.Sprintf("pod %s has lbName %s which does not list it in podNames", podname, podProps.LBname))
+			}
+		}
+	}
+
+	for lbName, lbProps := range LBs {
+		if lbName == "" {
+			problems = append(problems, "an LB has no name")
+		}
+		for resource, amount := range lbProps.Demand {
+			if amount < 0 {
+				problems = append(problems, fmt.Sprintf("LB %s has negative demand %g of %s", lbName, amount, resource))
+			}
+		}
+		for _, podname := range lbProps.PodNames {
+			podProps, ok := pods[podname]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("LB %s lists pod %s which does not exist", lbName, podname))
+			} else if podProps.LBname != lbName {
+				problems = append(problems, fmt.Sprintf("LB %s lists pod %s whose lbName is %s", lbName, podname, podProps.LBname))
+			}
+		}
+	}
+
+	return getProblemsAsError(problems)
+}
+
+func getProblemsAsError(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("%d problem(s):\n\t%s", len(problems), strings.Join(problems, "\n\t"))
+}
+
+func containsString(arr []string, str string) bool {
+	for _, s := range arr {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+// watchTopologyFile reloads the topology file whenever its contents change
+func watchTopologyFile(path string, topology *Topology, interval time.Duration) {
+
+	lastData, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Error: couldn't read topology file %s: %s\n", path, err)
+	}
+
+	doEvery(interval, func(time.Time) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Error: couldn't read topology file %s: %s\n", path, err)
+			return
+		}
+		if bytes.Equal(data, lastData) {
+			return
+		}
+		lastData = data
+
+		hosts, pods, LBs, err := loadTopologyFile(path)
+		if err != nil {
+			log.Printf("Error: keeping the last good topology: %s\n", err)
+			return
+		}
+
+		topology.Replace(hosts, pods, LBs)
+		log.Printf("Topology: reloaded from %s\n", path)
+		logTopology(hosts, pods, LBs)
+	})
+}
+
+func getTopologyReloadInterval() time.Duration {
+	return time.Duration(getEnvFloat("TOPOLOGY_RELOAD_MS", 1000)) * time.Millisecond
+}
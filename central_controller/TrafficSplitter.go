@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+)
+
+/*
+Traffic splitting:
+	instead of sending all of an LB's traffic to its least priced host, the
+	LB's traffic can be split over all of its pods on (healthy, priced) hosts,
+	with host h getting the weight
+		- "inverse_price": w(h) = 1 / p(h)
+		- "softmax":       w(h) = exp(-(p(h) - min p) / temperature)
+	split evenly over the LB's pods on h, and all weights normalised to add
+	up to 1
+	a low temperature sends nearly everything to the least priced host, a high
+	one spreads the traffic evenly
+	a split whose weights all moved by less than minChange is not resent, so
+	that small price changes don't reach the LBs every round
+	"single" keeps sending everything to the least priced host
+*/
+type TrafficSplitter struct {
+	policy      string
+	temperature float64
+	minChange   float64
+}
+
+func NewTrafficSplitter(policy string, temperature float64, minChange float64) (*TrafficSplitter, error) {
+	if policy != "single" && policy != "inverse_price" && policy != "softmax" {
+		return nil, fmt.Errorf("invalid split policy %q (must be single, inverse_price or softmax)", policy)
+	}
+	if temperature <= 0 {
+		return nil, fmt.Errorf("split temperature must be positive, got %f", temperature)
+	}
+	return &TrafficSplitter{
+		policy:      policy,
+		temperature: temperature,
+		minChange:   minChange,
+	}, nil
+}
+
+func (s *TrafficSplitter) IsWeighted() bool {
+	return s != nil && s.policy != "single"
+}
+
+func (s *TrafficSplitter) getHostWeight(price float64, minPrice float64) float64 {
+	if s.policy == "softmax" {
+		return math.Exp(-(price - minPrice) / s.temperature)
+	}
+	return 1 / math.Max(price, 1e-9)
+}
+
+// getPodWeights returns the (normalised) weight of each of the LB's pods
+// that can get traffic
+func (s *TrafficSplitter) getPodWeights(
+	LB LBProps,
+	pods map[string]PodProps,
+	hostprices map[string]float64,
+	health *HealthTracker) map[string]float64 {
+
+	podsOnHosts := make(map[string][]string)
+	minPrice := math.MaxFloat64
+	for _, podname := range LB.PodNames {
+		hostname := pods[podname].HostName
+		price, ok := hostprices[hostname]
+		if !ok || !health.IsHostAvailable(hostname) || !health.IsPodAvailable(podname) {
+			continue
+		}
+		podsOnHosts[hostname] = append(podsOnHosts[hostname], podname)
+		minPrice = math.Min(minPrice, price)
+	}
+
+	podWeights := make(map[string]float64)
+	sumOfWeights := 0.0
+	for hostname, podnames := range podsOnHosts {
+		hostWeight := s.getHostWeight(hostprices[hostname], minPrice)
+		for _, podname := range podnames {
+			podWeights[podname] = hostWeight / float64(len(podnames))
+		}
+		sumOfWeights += hostWeight
+	}
+	for podname := range podWeights {
+		podWeights[podname] /= sumOfWeights
+	}
+
+	return podWeights
+}
+
+// GetSplit returns the endpoints of the LB's pods (in pod name order) and
+// their weights
+func (s *TrafficSplitter) GetSplit(
+	LB LBProps,
+	pods map[string]PodProps,
+	hostprices map[string]float64,
+	health *HealthTracker) ([]string, []float64) {
+
+	podWeights := s.getPodWeights(LB, pods, hostprices, health)
+
+	podnames := make([]string, 0, len(podWeights))
+	for podname := range podWeights {
+		podnames = append(podnames, podname)
+	}
+	sort.Strings(podnames)
+
+	endpoints := make([]string, 0, len(podnames))
+	weights := make([]float64, 0, len(podnames))
+	for _, podname := range podnames {
+		weight := math.Round(podWeights[podname]*10000) / 10000
+		if weight == 0 {
+			// not worth sending the pod any traffic (e.g. its host is drained)
+			continue
+		}
+		endpoints = append(endpoints, pods[podname].IPAddress)
+		weights = append(weights, weight)
+	}
+
+	return endpoints, weights
+}
+
+// hasSimilarSplit tells if a split only differs from the one of an assignment
+// by weights that moved less than minChange
+func (s *TrafficSplitter) hasSimilarSplit(assignment Assignment, endpoints []string, weights []float64) bool {
+	if len(assignment.Endpoints) != len(endpoints) || len(assignment.Weights) != len(weights) {
+		return false
+	}
+	for i := range endpoints {
+		if assignment.Endpoints[i] != endpoints[i] || math.Abs(assignment.Weights[i]-weights[i]) >= s.minChange {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+getTrafficSplitter builds the traffic splitter configured by the environment:
+  - SPLIT_POLICY:      "single" (default), "inverse_price" or "softmax"
+  - SPLIT_TEMPERATURE: temperature of softmax, default 1.0
+  - SPLIT_MIN_CHANGE:  smallest change of a weight that is sent to the LB, default 0.01
+*/
+func getTrafficSplitter() *TrafficSplitter {
+	splitter, err := NewTrafficSplitter(
+		getEnvString("SPLIT_POLICY", "single"),
+		getEnvFloat("SPLIT_TEMPERATURE", 1.0),
+		getEnvFloat("SPLIT_MIN_CHANGE", 0.01),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return splitter
+}
@@ -4,16 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"math"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"time"
-
-	"github.com/redis/go-redis/v9"
 )
 
 var ctx = context.Background()
@@ -24,34 +23,51 @@ type Req struct {
 	a       int
 }
 
-type Response struct {
-	ReqNum      int
-	IsError     bool
-	ErrMsg      string
-	StatusCode  int
-	Body        string
-	StartTimeNs int64
-	LatencyNs   int64
-	ReadTimeNs  int64
-}
-
 type HostProps struct {
-	Name         string   `json:"name"`
-	LoadCapacity int      `json:"loadCapacity"`
-	PodNames     []string `json:"podNames"`
+	Name         string             `json:"name"`
+	LoadCapacity int                `json:"loadCapacity"`
+	Capacities   map[string]float64 `json:"capacities,omitempty"`
+	Zone         string             `json:"zone,omitempty"`
+	Region       string             `json:"region,omitempty"`
+	LoadSource   *LoadSource        `json:"loadSource,omitempty"`
+	PodNames     []string           `json:"podNames"`
 }
 
 type PodProps struct {
-	Name      string `json:"name"`
-	IPAddress string `json:"ipAddress"`
-	HostName  string `json:"hostName"`
-	LBname    string `json:"lbName"`
+	Name      string             `json:"name"`
+	IPAddress string             `json:"ipAddress"`
+	HostName  string             `json:"hostName"`
+	LBname    string             `json:"lbName"`
+	Demand    map[string]float64 `json:"demand,omitempty"`
 }
 
 type LBProps struct {
-	Name      string   `json:"name"`
-	IPAddress string   `json:"ipAddress"`
-	PodNames  []string `json:"podNames"`
+	Name      string             `json:"name"`
+	IPAddress string             `json:"ipAddress"`
+	PodNames  []string           `json:"podNames"`
+	Demand    map[string]float64 `json:"demand,omitempty"`
+	Zone      string             `json:"zone,omitempty"`
+	Region    string             `json:"region,omitempty"`
+
+	// address of the LB's control endpoint (CONTROL_PORT of the LB), which
+	// the assignments are pushed to; port 3001 of the LB's host if not set
+	ControlAddress string `json:"controlAddress,omitempty"`
+}
+
+// defaultLBControlPort is the default CONTROL_PORT of load_balancer
+const defaultLBControlPort = "3001"
+
+// getLBControlAddress returns the address the assignments of the LB are
+// pushed to (never ipAddress itself, which proxies what it gets to a pod)
+func getLBControlAddress(LB LBProps) string {
+	if LB.ControlAddress != "" {
+		return LB.ControlAddress
+	}
+	host, _, err := net.SplitHostPort(LB.IPAddress)
+	if err != nil {
+		host = LB.IPAddress
+	}
+	return net.JoinHostPort(host, defaultLBControlPort)
 }
 
 func respondWithError(w http.ResponseWriter, errStr string) {
@@ -60,6 +76,12 @@ func respondWithError(w http.ResponseWriter, errStr string) {
 	fmt.Fprintf(w, "%s", errStr)
 }
 
+func respondWithStatus(w http.ResponseWriter, statusCode int, msg string) {
+	w.WriteHeader(statusCode)
+	w.Header().Set("Connection", "close")
+	fmt.Fprintf(w, "%s", msg)
+}
+
 func respondWithSuccess(w http.ResponseWriter, req Req) {
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Connection", "close")
@@ -81,33 +103,41 @@ func getQueryParams(r *http.Request) (string, int, int, error) {
 	return podname, k, a, nil
 }
 
-func handleRequest(chListenReqs chan Req, w http.ResponseWriter, r *http.Request) {
-	podname, k, a, err := getQueryParams(r)
+func handleRequest(replica *Replica, chListenReqs chan Req, w http.ResponseWriter, r *http.Request) {
+	req, err := getReportFromRequest(r)
 	if err != nil {
 		fmt.Println(err)
 		respondWithError(w, fmt.Sprintf("%s", err))
 		return
 	}
 
-	req := Req{podname, k, a}
-
-	// send request for processing in central controller
-	chListenReqs <- req
+	// only the leader processes requests; the followers hand them over
+	if replica != nil && !replica.IsLeader() {
+		forwardReqToLeader(replica, req, w, r)
+		return
+	}
 
+	// send request for processing in central controller without blocking
+	// the pod if the controller is falling behind
+	if err := queueReport(chListenReqs, req); err != nil {
+		respondWithStatus(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
 	respondWithSuccess(w, req)
 }
 
-func getInitHostPrices(hosts map[string]HostProps) map[string]float64 {
-
-	initPrice := 1.0
-
-	initHostPrices := make(map[string]float64)
-
-	for hostname := range hosts {
-		initHostPrices[hostname] = initPrice
+// drainPodReports returns the latest request of each pod received since the
+// last round
+func drainPodReports(chListenReqs chan Req) map[string]Req {
+	podReports := make(map[string]Req)
+	for {
+		select {
+		case req := <-chListenReqs:
+			podReports[req.podname] = req
+		default:
+			return podReports
+		}
 	}
-
-	return initHostPrices
 }
 
 func getInitPodLoads(pods map[string]PodProps) map[string]int {
@@ -130,34 +160,41 @@ func doEvery(d time.Duration, f func(time.Time)) {
 	}
 }
 
+// getHostLoads polls the load of every host from its load source. Hosts
+// without a load this round are left out (rather than looking idle): the ones
+// whose load source failed or timed out count as failures of the host, the
+// ones whose load source has no data yet don't.
 func getHostLoads(
 	hosts map[string]HostProps,
-	redisClients map[string]*redis.Client) map[string]int {
+	loadSources *LoadSources,
+	health *HealthTracker) map[string]int {
+
+	start := time.Now()
 
 	// get all host loads from all hosts
 	hostLoads := make(map[string]int)
 
-	for hostName, client := range redisClients {
-
-		hostLoad, err := client.Get(ctx, "outstanding_requests").Result()
-		if err == redis.Nil {
-			log.Println("outstanding_requests does not exist")
-			hostLoad = "0"
-		} else if err != nil {
-			hostLoad = "0"
-			log.Printf("Error: couldn't get variable from Redis\n")
+	for hostName, poll := range loadSources.PollLoads() {
+		if _, ok := hosts[hostName]; !ok {
+			continue
 		}
 
-		log.Printf("%s: outstanding_requests = %s\n", hostName, hostLoad)
-
-		hostLoadInt, err2 := strconv.Atoi(hostLoad)
-		if err2 != nil {
-			log.Printf("Error: couldn't convert outstanding_requests (%s) to int\n", hostLoad)
-			continue
+		switch poll.Status {
+		case pollOK:
+			log.Printf("%s: load = %d (polled in %s)\n", hostName, poll.Load, poll.Latency)
+			hostLoads[hostName] = poll.Load
+			health.RecordHostSuccess(hostName)
+		case pollNoData:
+			log.Printf("%s: no load data: %s\n", hostName, poll.Err)
+			health.RecordHostSuccess(hostName)
+		default:
+			log.Printf("Error: couldn't read load of %s (%s after %s): %s\n", hostName, poll.Status, poll.Latency, poll.Err)
+			health.RecordHostFailure(hostName, fmt.Sprintf("couldn't read load: %s", poll.Err))
 		}
-		hostLoads[hostName] = hostLoadInt
 	}
 
+	log.Printf("Polled the load of %d/%d hosts in %s\n", len(hostLoads), len(hosts), time.Since(start))
+
 	return hostLoads
 }
 
@@ -217,47 +254,21 @@ func aggregatePodLoadstoHostLoads(
 func getNewHostPrice(
 	oldPrice float64,
 	epsilon float64,
-	loadArrivedAtHost int,
-	hostLoadCapacity int,
+	loadArrivedAtHost float64,
+	hostLoadCapacity float64,
 	sumOfOldHostPrices float64,
 ) float64 {
 	// Prof. Srikanth's Algorithm is implemented in this function to calculate the new host prices
 
 	newPrice := math.Abs(
 		oldPrice +
-			epsilon*(float64(loadArrivedAtHost)-
-				float64(hostLoadCapacity)+
+			epsilon*(loadArrivedAtHost-
+				hostLoadCapacity+
 				(1/sumOfOldHostPrices)))
 
 	return newPrice
 }
 
-func getNewHostPrices(
-	pods map[string]PodProps,
-	hosts map[string]HostProps,
-	hostLoads map[string]int,
-	oldHostPrices map[string]float64,
-) map[string]float64 {
-
-	loadsArrivedAtHost := hostLoads
-
-	newHostPrices := make(map[string]float64)
-
-	sumOfOldHostPrices := getSumOfPrices(oldHostPrices)
-
-	for hostname, hostprops := range hosts {
-		newHostPrices[hostname] = getNewHostPrice(
-			oldHostPrices[hostname],
-			1.0,
-			loadsArrivedAtHost[hostname],
-			hostprops.LoadCapacity,
-			sumOfOldHostPrices,
-		)
-	}
-
-	return newHostPrices
-}
-
 func getSumOfPrices(oldHostPrices map[string]float64) float64 {
 	sum := 0.0
 	for _, v := range oldHostPrices {
@@ -266,20 +277,43 @@ func getSumOfPrices(oldHostPrices map[string]float64) float64 {
 	return sum
 }
 
-func getOptimalHostsForLBs(LBs map[string]LBProps, pods map[string]PodProps, hostprices map[string]float64) map[string]string {
+func getOptimalHostsForLBs(
+	LBs map[string]LBProps,
+	pods map[string]PodProps,
+	pricesForLBs map[string]map[string]float64,
+	health *HealthTracker,
+	switches *SwitchTracker,
+	round int) map[string]string {
 
 	optimalHosts := make(map[string]string)
 
 	// get optimal for each LB
 	for lbName, lb := range LBs {
-		optimalHost := getLeastPricedHost(lb.PodNames, pods, hostprices)
+		optimalHost := getLeastPricedHost(lb.PodNames, pods, pricesForLBs[lbName], health)
+		// only move the LB if the least priced host is worth it
+		optimalHost = switches.GetHost(round, lbName, optimalHost, pricesForLBs[lbName], getIsHostUsable(lb, pods, health))
+		if optimalHost == "" {
+			log.Printf("Error: LB %s has no healthy pod on a priced host\n", lbName)
+		}
 		optimalHosts[lbName] = optimalHost
 	}
 
 	return optimalHosts
 }
 
-func getLeastPricedHost(podnames []string, pods map[string]PodProps, hostprices map[string]float64) string {
+// getIsHostUsable returns whether a host can take the traffic of the LB
+func getIsHostUsable(lb LBProps, pods map[string]PodProps, health *HealthTracker) func(string) bool {
+	return func(hostname string) bool {
+		_, err := getPodIPsOnGivenHost(hostname, lb, pods, health)
+		return health.IsHostAvailable(hostname) && err == nil
+	}
+}
+
+func getLeastPricedHost(
+	podnames []string,
+	pods map[string]PodProps,
+	hostprices map[string]float64,
+	health *HealthTracker) string {
 
 	// shuffle podnames so that we can break ties randomly
 	podnames = getShuffledArray(podnames)
@@ -289,7 +323,15 @@ func getLeastPricedHost(podnames []string, pods map[string]PodProps, hostprices
 
 	for _, podname := range podnames {
 		hostname := pods[podname].HostName
-		hostprice := hostprices[hostname]
+		if !health.IsHostAvailable(hostname) || !health.IsPodAvailable(podname) {
+			// the host or pod is failing
+			continue
+		}
+		hostprice, ok := hostprices[hostname]
+		if !ok {
+			// we don't know the price of this host (yet)
+			continue
+		}
 		if hostprice <= minPrice {
 			minPrice = hostprice
 			minHost = hostname
@@ -307,147 +349,193 @@ func getShuffledArray(arr []string) []string {
 	return arr
 }
 
-// syncronous
-func makeRequest(reqURL string, podIP string, reqNum int) Response {
-
-	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
-	if err != nil {
-		errMsg := fmt.Sprintf("client: could not create request: %s", err)
-		return Response{reqNum,
-			true, errMsg,
-			0, "",
-			time.Now().UnixNano(), 0, 0}
-	}
-	req.Header.Set("Connection", "close")
-
-	q := req.URL.Query()
-	q.Add("endpoints", podIP)
-	req.URL.RawQuery = q.Encode()
-
-	startReq := time.Now()
-	res, err := http.DefaultClient.Do(req)
-	latency := time.Since(startReq)
-
-	if err != nil {
-		errMsg := fmt.Sprintf("client: error making http request: %s", err)
-		return Response{reqNum,
-			true, errMsg,
-			0, "",
-			startReq.UnixNano(), latency.Nanoseconds(), 0}
-	}
-
-	startRead := time.Now()
-	resBody, err := io.ReadAll(res.Body)
-	readTime := time.Since(startRead)
-
-	if err != nil {
-		errMsg := fmt.Sprintf("client: could not read response body: %s", err)
-		return Response{reqNum,
-			true, errMsg,
-			res.StatusCode, "",
-			startReq.UnixNano(), latency.Nanoseconds(), readTime.Nanoseconds()}
-	}
-
-	return Response{reqNum,
-		false, "",
-		res.StatusCode, string(resBody),
-		startReq.UnixNano(), latency.Nanoseconds(), readTime.Nanoseconds()}
-}
-
-func getPodIPonGivenHost(
+// getPodIPsOnGivenHost returns the IPs of all of the LB's available pods on
+// the given host (in pod name order), so that the LB spreads its traffic over
+// all of them
+func getPodIPsOnGivenHost(
 	optimalHostName string,
 	LB LBProps,
-	pods map[string]PodProps) string {
+	pods map[string]PodProps,
+	health *HealthTracker) ([]string, error) {
 
+	podnames := make([]string, 0)
 	for _, podName := range LB.PodNames {
-		if pods[podName].HostName == optimalHostName {
-			return pods[podName].IPAddress
-
+		if pods[podName].HostName == optimalHostName && health.IsPodAvailable(podName) {
+			podnames = append(podnames, podName)
 		}
 	}
-
-	return ""
-}
-
-// syncronous
-func communicateOptimalPodIPToLB(
-	optimalHostName string,
-	LB LBProps,
-	pods map[string]PodProps,
-	chNotifyReqCompleted chan bool) {
-
-	log.Printf("LB Update: %s -> %s\n", LB.Name, optimalHostName)
-
-	lbUrl := fmt.Sprintf("http://%s", LB.IPAddress)
-	optimalPodIP := getPodIPonGivenHost(optimalHostName, LB, pods)
-	reqNum := 1
-
-	res := makeRequest(lbUrl, optimalPodIP, reqNum)
-	log.Printf("Response sent to %s\n", LB.Name)
-
-	log.Printf("Response received from %s: %d\n", LB.Name, res.StatusCode)
-
-	chNotifyReqCompleted <- true
-}
-
-func communicateOptimalHostsToLBs(
-	LBs map[string]LBProps,
-	optimalHostsForLBs map[string]string,
-	pods map[string]PodProps) {
-	// TO-DO:
-	// for each LB
-	// 		make an async request to its IP:port
-	// 			telling it the IP:port of its optimal host
-
-	numReqsCompleted := 0
-	chNotifyReqCompleted := make(chan bool)
-
-	for LBname, LBProps := range LBs {
-		go communicateOptimalPodIPToLB(optimalHostsForLBs[LBname], LBProps, pods, chNotifyReqCompleted)
+	if len(podnames) == 0 {
+		return nil, fmt.Errorf("LB %s has no healthy pod on host %s", LB.Name, optimalHostName)
 	}
+	sort.Strings(podnames)
 
-	for {
-		<-chNotifyReqCompleted
-		numReqsCompleted++
-
-		if numReqsCompleted == len(LBs) {
-			break
-		}
+	podIPs := make([]string, 0, len(podnames))
+	for _, podName := range podnames {
+		podIPs = append(podIPs, pods[podName].IPAddress)
 	}
 
-	log.Printf("LB Update: --------COMPLETED--------\n")
+	return podIPs, nil
 }
 
 func centralController(
-	hosts map[string]HostProps,
-	pods map[string]PodProps,
-	LBs map[string]LBProps,
+	replica *Replica,
+	topology *Topology,
 	interval time.Duration,
 	chListenReqs chan Req,
-	redisClients map[string]*redis.Client) {
+	loadSources *LoadSources,
+	priceUpdater PriceUpdater,
+	snapshotter *Snapshotter,
+	shardMember *ShardMember,
+	health *HealthTracker,
+	delivery *AssignmentDelivery,
+	hub *AssignmentHub,
+	splitter *TrafficSplitter,
+	shadow *ShadowPolicy,
+	overrides *Overrides,
+	switches *SwitchTracker,
+	locality *Locality,
+	coordination *Coordination,
+	capacityEstimator *CapacityEstimator) {
 
 	// define state at the beginning of the controller
-	hostPrices := getInitHostPrices(hosts)
+	// (from the latest snapshot if there is a compatible one; in hierarchical
+	// mode snapshots only hold the hosts of our shard)
+	allHosts, _, LBs := topology.Get()
+	shardMember.Sync()
+	hosts, _ := shardMember.GetShard(allHosts, LBs)
+	round, resourcePrices, optimalHostsForLBs := getWarmStartState(snapshotter, hosts, priceUpdater)
+	assignments := make(map[string]Assignment)
+
+	wasLeader := false
 
 	for t := range time.Tick(interval) {
 
+		// only the leader runs the rounds; a new leader continues from the
+		// state replicated by the previous one
+		if replica != nil {
+			if !replica.IsLeader() {
+				if wasLeader {
+					// make the watching LBs reconnect to the new leader
+					hub.Reset()
+				}
+				wasLeader = false
+				continue
+			}
+			if !wasLeader {
+				state, ok, err := replica.SyncAsLeader(interval)
+				if err != nil {
+					log.Printf("Replica %s: couldn't sync as leader: %s\n", replica.id, err)
+					continue
+				}
+				if ok {
+					round, resourcePrices, optimalHostsForLBs = state.Round, state.GetResourcePrices(), state.Assignments
+					setPriceUpdaterState(priceUpdater, state.PriceUpdaterState)
+				}
+				// the assignments we sent as a previous leader may be outdated
+				assignments = make(map[string]Assignment)
+				log.Printf("Replica %s: became leader at round %d\n", replica.id, round)
+				wasLeader = true
+			}
+		}
+
+		round++
+
 		// print the current time
-		log.Printf("CC logic starting [time: %s]\n", t)
+		log.Printf("CC logic starting [round: %d, time: %s]\n", round, t)
+
+		// pick up the changes made to the topology since the last round
+		// (in hierarchical mode only the hosts and LBs of this shard are ours)
+		allHosts, pods, LBs := topology.Get()
+		shardMember.Sync()
+		hosts, LBs := shardMember.GetShard(allHosts, LBs)
+		resourcePrices = reconcileResourcePrices(hosts, resourcePrices)
+		loadSources.Reconcile(hosts)
+		health.Reconcile(hosts, pods)
+		overrides.Reconcile(hosts, LBs)
+		switches.Reconcile(LBs)
+
+		podReports := drainPodReports(chListenReqs)
+		log.Printf("Received reqs from %d pods since the last round\n", len(podReports))
+		health.RecordPodReports(podReports)
 
 		// wait for each pod to send state (# of reqs it received in time k)
-		hostLoads := getHostLoads(hosts, redisClients)
+		hostLoads := getHostLoads(hosts, loadSources, health)
+
+		// the hosts and pods whose backoff has passed get another chance
+		health.StartProbations()
+
+		// estimate the capacity of each host from its load and the latency
+		// and errors the LBs saw
+		capacityEstimator.Update(hosts, hostLoads)
+		pricedHosts := capacityEstimator.Apply(hosts)
 
 		// compute price for each host
-		hostPrices = getNewHostPrices(pods, hosts, hostLoads, hostPrices)
+		// (one price per resource of the host)
+		resourcePrices = getNewResourcePrices(pricedHosts, pods, LBs, hostLoads, podReports, resourcePrices, priceUpdater)
+
+		// share our prices with the other shards and get theirs for the hosts our LBs use
+		shardMember.SetOwnPrices(resourcePrices)
+		lbResourcePrices := shardMember.AddPeerPrices(resourcePrices, LBs, pods)
+
+		// the cost of each LB on each host is its cost given its demand plus
+		// the cost of sending its traffic there, scaled by the CPU shares cc
+		// gave its pods there; the operator's drains, cordons and pins apply
+		// on top
+		getLBCosts := func(lbResourcePrices map[string]map[string]float64) map[string]map[string]float64 {
+			costsForLBs := locality.AddTransferCosts(LBs, allHosts, pods, hostLoads, health, getCostsForLBs(LBs, pods, lbResourcePrices))
+			return coordination.AddShareCosts(allHosts, pods, costsForLBs)
+		}
+		pricesForLBs := overrides.GetPricesForLBs(getLBCosts(lbResourcePrices), optimalHostsForLBs)
 
 		// determine what is the optimal hostname for each LB (according to lowest host price)
-		optimalHostsForLBs := getOptimalHostsForLBs(LBs, pods, hostPrices)
+		optimalHostsForLBs = getOptimalHostsForLBs(LBs, pods, pricesForLBs, health, switches, round)
 
-		// communicate optimal hostname to each LB
-		communicateOptimalHostsToLBs(LBs, optimalHostsForLBs, pods)
+		snapshot := NewControllerSnapshot(round, hosts, resourcePrices, optimalHostsForLBs, priceUpdater)
+
+		// commit the round to the other replicas before acting on it
+		if replica != nil {
+			if err := replica.Replicate(snapshot, interval); err != nil {
+				log.Printf("Replica %s: couldn't replicate round %d: %s\n", replica.id, round, err)
+				wasLeader = false
+				continue
+			}
+		}
+
+		// communicate optimal hostname to each LB (in the background, so that
+		// a slow LB doesn't hold up the next round), and to the LBs watching
+		assignments = getAssignments(round, LBs, pods, optimalHostsForLBs, pricesForLBs, health, splitter, assignments)
+		delivery.Publish(LBs, assignments)
+		hub.Publish(assignments)
+
+		// tell cc the load its pods are about to get
+		coordination.SetProjectedLoads(round, getProjectedPodLoads(LBs, pods, podReports, assignments))
+
+		// run the candidate policy on the same loads and compare it with ours
+		shadow.Run(ShadowRoundContext{
+			Round:                  round,
+			Hosts:                  pricedHosts,
+			Pods:                   pods,
+			LBs:                    LBs,
+			HostLoads:              hostLoads,
+			PodReports:             podReports,
+			Health:                 health,
+			Overrides:              overrides,
+			GetLBCosts:             getLBCosts,
+			LiveResourcePrices:     resourcePrices,
+			LiveLBResourcePrices:   lbResourcePrices,
+			LivePricesForLBs:       pricesForLBs,
+			LiveOptimalHostsForLBs: optimalHostsForLBs,
+			LiveSplitter:           splitter,
+			LiveSwitches:           switches,
+		})
+
+		overrides.UpdateDrains(assignments, pods)
 
 		// compute theta for next hosts
 		// (no need to do this here. It is implicitly done in calculating new host prices)
+
+		// persist the state so that a restarted controller can pick up from here
+		snapshotter.MaybeSave(snapshot)
 	}
 }
 
@@ -475,24 +563,30 @@ func getLBsListMappedToName(lbsList []LBProps) map[string]LBProps {
 	return lbsMap
 }
 
-func getTopology() (map[string]HostProps, map[string]PodProps, map[string]LBProps) {
+func getTopology() (map[string]HostProps, map[string]PodProps, map[string]LBProps, error) {
 
 	hostsJSON := os.Getenv("HOSTS")
 	var hostsList []HostProps
-	json.Unmarshal([]byte(hostsJSON), &hostsList)
+	if err := json.Unmarshal([]byte(hostsJSON), &hostsList); err != nil {
+		return nil, nil, nil, fmt.Errorf("couldn't parse HOSTS: %w", err)
+	}
 	hostsMap := getHostsListMappedToName(hostsList)
 
 	podsJSON := os.Getenv("PODS")
 	var podsList []PodProps
-	json.Unmarshal([]byte(podsJSON), &podsList)
+	if err := json.Unmarshal([]byte(podsJSON), &podsList); err != nil {
+		return nil, nil, nil, fmt.Errorf("couldn't parse PODS: %w", err)
+	}
 	podsMap := getPodsListMappedToName(podsList)
 
 	lbsJSON := os.Getenv("LBS")
 	var lbsList []LBProps
-	json.Unmarshal([]byte(lbsJSON), &lbsList)
+	if err := json.Unmarshal([]byte(lbsJSON), &lbsList); err != nil {
+		return nil, nil, nil, fmt.Errorf("couldn't parse LBS: %w", err)
+	}
 	lbsMap := getLBsListMappedToName(lbsList)
 
-	return hostsMap, podsMap, lbsMap
+	return hostsMap, podsMap, lbsMap, nil
 }
 
 func logTopology(
@@ -506,32 +600,6 @@ func logTopology(
 
 }
 
-func getRedisIP(hostName string) string {
-	if hostName == "minikube-m02" {
-		return "10.101.102.101"
-	} else if hostName == "minikube-m03" {
-		return "10.101.102.102"
-	} else if hostName == "minikube-m04" {
-		return "10.101.102.103"
-	} else {
-		return "localhost"
-	}
-}
-
-func getRedisClientsForHosts(hosts map[string]HostProps) map[string]*redis.Client {
-	redisClients := make(map[string]*redis.Client)
-
-	for _, hostProps := range hosts {
-		redisClients[hostProps.Name] = redis.NewClient(&redis.Options{
-			Addr:     fmt.Sprintf("%s:6379", getRedisIP(hostProps.Name)),
-			Password: "",
-			DB:       0,
-		})
-	}
-
-	return redisClients
-}
-
 func getInterval() time.Duration {
 	intervalMs, err := strconv.Atoi(os.Getenv("INTERVAL_MS"))
 	if err != nil {
@@ -540,41 +608,139 @@ func getInterval() time.Duration {
 	return time.Duration(intervalMs) * time.Millisecond
 }
 
-func main() {
-
-	hosts, pods, LBs := getTopology()
-	logTopology(hosts, pods, LBs)
+// serveController runs a controller (or controller replica) and serves its
+// HTTP API on the given port; topologySource names the source that manages
+// the topology, if any
+func serveController(replica *Replica, topology *Topology, topologySource string, port int) {
 
-	chListenReqs := make(chan Req)
+	hosts, _, _ := topology.Get()
 
-	redisClients := getRedisClientsForHosts(hosts)
+	chListenReqs := make(chan Req, int(getEnvFloat("REPORT_QUEUE_SIZE", 1024)))
 
 	interval := getInterval()
 
+	loadSources := getLoadSources(hosts, interval)
+
+	priceUpdater := getPriceUpdater()
+
+	snapshotter := getSnapshotter()
+
+	shardMember := getShardMember()
+
+	health := getHealthTracker()
+
+	var delivery *AssignmentDelivery
+	var hub *AssignmentHub
+	splitter := getTrafficSplitter()
+	shadow := getShadowPolicy()
+	overrides := getOverrides()
+	switches := getSwitchTracker()
+	locality := getLocality()
+	coordination := getCoordination(interval)
+	capacityEstimator := getCapacityEstimator()
+
+	push, watch := getLBNotifyMode()
+	if push {
+		delivery = getAssignmentDelivery()
+	}
+	if watch {
+		hub = NewAssignmentHub()
+	}
+
 	/* start a thread that will process all the price updates coming
 	*  from the hosts
 	 */
-	go centralController(hosts, pods, LBs, interval, chListenReqs, redisClients)
+	isLeader := func() bool { return replica == nil || replica.IsLeader() }
+	startReportSources(getReportSources(getReportConsumerName(replica, port), isLeader), chListenReqs)
 
-	port := 3000
+	go centralController(replica, topology, interval, chListenReqs, loadSources, priceUpdater, snapshotter, shardMember, health, delivery, hub, splitter, shadow, overrides, switches, locality, coordination, capacityEstimator)
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		handleRequest(chListenReqs, w, r)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		handleRequest(replica, chListenReqs, w, r)
 	})
+	registerTopologyHandlers(mux, topology, topologySource, replica)
+	registerShardHandlers(mux, shardMember)
+	registerHealthHandlers(mux, health, capacityEstimator, topology, replica)
+	registerLoadSourceHandlers(mux, loadSources)
+	registerDeliveryHandlers(mux, delivery)
+	registerWatchHandlers(mux, hub, replica, topology)
+	registerShadowHandlers(mux, shadow)
+	registerOverrideHandlers(mux, overrides, topology, replica)
+	registerSwitchingHandlers(mux, switches)
+	registerCoordinationHandlers(mux, coordination, replica)
+	registerCapacityHandlers(mux, capacityEstimator, topology, replica)
 	fmt.Printf("Server running (port=%d), listening for # of requests from pods [http://localhost:%d/?podname=1&a=5]\n", port, port)
 
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux); err != nil {
 		log.Fatal(err)
 	}
 }
 
+func main() {
+
+	topologyFile := os.Getenv("TOPOLOGY_FILE")
+
+	var hosts map[string]HostProps
+	var pods map[string]PodProps
+	var LBs map[string]LBProps
+	var err error
+	var discovery *KubernetesDiscovery
+	stopDiscovery := make(chan struct{})
+	if os.Getenv("TOPOLOGY_SOURCE") == "kubernetes" {
+		discovery = getKubernetesDiscovery()
+		err = discovery.Start(stopDiscovery)
+		if err == nil {
+			hosts, pods, LBs, err = discovery.GetTopology()
+		}
+	} else if topologyFile != "" {
+		hosts, pods, LBs, err = loadTopologyFile(topologyFile)
+	} else {
+		hosts, pods, LBs, err = getTopology()
+		if err == nil {
+			err = validateTopology(hosts, pods, LBs)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	logTopology(hosts, pods, LBs)
+
+	// the topology API only manages topologies that no source replaces
+	topology := NewTopology(hosts, pods, LBs)
+	topologySource := ""
+	if discovery != nil {
+		topologySource = "Kubernetes discovery"
+		go discovery.Watch(topology, stopDiscovery)
+	} else if topologyFile != "" {
+		topologySource = fmt.Sprintf("topology file %s", topologyFile)
+		go watchTopologyFile(topologyFile, topology, getTopologyReloadInterval())
+	}
+
+	port := int(getEnvFloat("PORT", 3000))
+
+	// in hierarchical mode, the coordinator only assigns hosts and LBs to
+	// the shard controllers
+	if os.Getenv("CONTROLLER_ROLE") == "coordinator" {
+		runCoordinator(topology, topologySource, port)
+		return
+	}
+
+	// run a whole replicated controller in this process
+	if replicas := getInmemReplicas(port); replicas != nil {
+		for i, replica := range replicas {
+			go serveController(replica, topology, topologySource, port+i)
+		}
+		select {}
+	}
+
+	serveController(getReplica(), topology, topologySource, port)
+}
+
 /* PROBLEMS:
-*	- We have a fixed topology
 *	- We have to manually figure our the topology
-*	- We ignore failures
 *	- We are not ensuring same k is used for calculations
 *	- We should change Host, Pod, LB to maps of [hostname]HostProps,[podname]PodProps, [LBname]LBProps
 *	- There can be race conditions in the system between requests from pods to controller
 *	- Maybe breaking ties strategy of mine is wasting compute
-*	- Notifiying the LBs their new optimal host is done unreliably (maybe this is better to do)
  */
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+/*
+Round collection logic:
+	pods report (podname, k, a) where k is the epoch (the index of the
+	reporting interval) the load a was measured in
+	reports are bucketed by k; the round of epoch k is closed when
+		- every pod has reported for k, or
+		- the round deadline has passed since the first report for k
+	once epoch k is closed, reports for any epoch <= k are late
+	late reports and pods missing from a closed round are handled by the
+	report policy:
+		"drop":          late reports are discarded
+		"carry_forward": late reports update the pod's last known load, and
+		                 missing pods are counted with their last known load
+		                 for at most maxCarryForwardRounds rounds
+	a missing pod with no load to carry forward is left out of the round's
+	pod loads (rather than counted as 0), so the load of its host is unknown
+	for that round
+*/
+
+type Round struct {
+	K              int
+	PodLoads       map[string]int
+	Missing        []string
+	CarriedForward []string
+}
+
+type openRound struct {
+	podLoads map[string]int
+	deadline time.Time
+}
+
+type lastKnownLoad struct {
+	k             int
+	a             int
+	roundsCarried int
+}
+
+type RoundCollector struct {
+	pods                  map[string]PodProps
+	deadline              time.Duration
+	policy                string
+	maxCarryForwardRounds int
+
+	openRounds map[int]*openRound
+	closedUpTo int
+	hasClosed  bool
+	lastKnown  map[string]*lastKnownLoad
+}
+
+func NewRoundCollector(
+	pods map[string]PodProps,
+	deadline time.Duration,
+	policy string,
+	maxCarryForwardRounds int) (*RoundCollector, error) {
+
+	if policy != "drop" && policy != "carry_forward" {
+		return nil, fmt.Errorf("invalid report policy %q (must be drop or carry_forward)", policy)
+	}
+
+	return &RoundCollector{
+		pods:                  pods,
+		deadline:              deadline,
+		policy:                policy,
+		maxCarryForwardRounds: maxCarryForwardRounds,
+		openRounds:            make(map[int]*openRound),
+		lastKnown:             make(map[string]*lastKnownLoad),
+	}, nil
+}
+
+// collect ingests pod reports and publishes every closed round on chRounds.
+// Only the latest closed round is kept if the controller falls behind.
+func (rc *RoundCollector) collect(chListenReqs chan Req, chRounds chan Round) {
+
+	// one timer, armed for the earliest deadline of the open rounds
+	deadlineTimer := time.NewTimer(rc.deadline)
+	stopTimer(deadlineTimer)
+	var armedFor time.Time
+
+	for {
+		var deadlineCh <-chan time.Time
+		if earliestK, ok := rc.getEarliestDeadlineK(); ok {
+			deadline := rc.openRounds[earliestK].deadline
+			if !deadline.Equal(armedFor) {
+				stopTimer(deadlineTimer)
+				deadlineTimer.Reset(time.Until(deadline))
+				armedFor = deadline
+			}
+			deadlineCh = deadlineTimer.C
+		}
+
+		select {
+		case req := <-chListenReqs:
+			if round, ok := rc.addReport(req); ok {
+				publishRound(chRounds, round)
+			}
+
+		case <-deadlineCh:
+			armedFor = time.Time{}
+			if round, ok := rc.closeExpiredRound(time.Now()); ok {
+				publishRound(chRounds, round)
+			}
+		}
+	}
+}
+
+// stopTimer stops the timer and drains its channel if it already fired
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
+
+func publishRound(chRounds chan Round, round Round) {
+	for {
+		select {
+		case chRounds <- round:
+			return
+		default:
+			// drop the stale round that the controller has not picked up yet
+			select {
+			case staleRound := <-chRounds:
+				log.Printf("Round k=%d superseded by k=%d before being processed\n", staleRound.K, round.K)
+			default:
+			}
+		}
+	}
+}
+
+func (rc *RoundCollector) getEarliestDeadlineK() (int, bool) {
+	earliestK := 0
+	found := false
+	for k, round := range rc.openRounds {
+		if !found || round.deadline.Before(rc.openRounds[earliestK].deadline) {
+			earliestK = k
+			found = true
+		}
+	}
+	return earliestK, found
+}
+
+func (rc *RoundCollector) addReport(req Req) (Round, bool) {
+
+	// ignore this if its a pod that we don't recognize
+	if _, ok := rc.pods[req.podname]; !ok {
+		log.Printf("Unrecognized pod sent request: [%s, k=%d, a=%d]. Request ignored\n", req.podname, req.k, req.a)
+		return Round{}, false
+	}
+
+	if rc.hasClosed && req.k <= rc.closedUpTo {
+		rc.handleLateReport(req)
+		return Round{}, false
+	}
+
+	round, ok := rc.openRounds[req.k]
+	if !ok {
+		round = &openRound{
+			podLoads: make(map[string]int),
+			deadline: time.Now().Add(rc.deadline),
+		}
+		rc.openRounds[req.k] = round
+	}
+	round.podLoads[req.podname] = req.a
+	rc.updateLastKnown(req)
+
+	// if we have listened from all pods, the round is complete
+	if len(round.podLoads) == len(rc.pods) {
+		return rc.closeRound(req.k), true
+	}
+
+	return Round{}, false
+}
+
+func (rc *RoundCollector) handleLateReport(req Req) {
+	if rc.policy == "drop" {
+		log.Printf("Dropped late report: [%s, k=%d, a=%d] (closed up to k=%d)\n", req.podname, req.k, req.a, rc.closedUpTo)
+		return
+	}
+	rc.updateLastKnown(req)
+	log.Printf("Carrying forward late report: [%s, k=%d, a=%d] (closed up to k=%d)\n", req.podname, req.k, req.a, rc.closedUpTo)
+}
+
+func (rc *RoundCollector) updateLastKnown(req Req) {
+	lastKnown, ok := rc.lastKnown[req.podname]
+	if ok && lastKnown.k > req.k {
+		return
+	}
+	rc.lastKnown[req.podname] = &lastKnownLoad{k: req.k, a: req.a}
+}
+
+func (rc *RoundCollector) closeExpiredRound(now time.Time) (Round, bool) {
+	earliestK, ok := rc.getEarliestDeadlineK()
+	if !ok || now.Before(rc.openRounds[earliestK].deadline) {
+		return Round{}, false
+	}
+	log.Printf("Round k=%d reached its deadline with %d/%d pods reported\n",
+		earliestK, len(rc.openRounds[earliestK].podLoads), len(rc.pods))
+	return rc.closeRound(earliestK), true
+}
+
+func (rc *RoundCollector) closeRound(k int) Round {
+
+	round := Round{K: k, PodLoads: make(map[string]int)}
+
+	reported := rc.openRounds[k].podLoads
+
+	for podname := range rc.pods {
+		if a, ok := reported[podname]; ok {
+			round.PodLoads[podname] = a
+			continue
+		}
+
+		round.Missing = append(round.Missing, podname)
+
+		lastKnown, ok := rc.lastKnown[podname]
+		if rc.policy == "carry_forward" && ok && lastKnown.roundsCarried < rc.maxCarryForwardRounds {
+			lastKnown.roundsCarried++
+			round.PodLoads[podname] = lastKnown.a
+			round.CarriedForward = append(round.CarriedForward, podname)
+		}
+	}
+
+	// reports of this and any older epoch that is still open are now late
+	for openK := range rc.openRounds {
+		if openK <= k {
+			delete(rc.openRounds, openK)
+		}
+	}
+	rc.closedUpTo = k
+	rc.hasClosed = true
+
+	if len(round.Missing) > 0 {
+		log.Printf("Round k=%d closed with missing pods %v (carried forward: %v)\n", k, round.Missing, round.CarriedForward)
+	}
+
+	return round
+}
+
+func getEnvInt(name string, defaultValue int) int {
+	valueStr := os.Getenv(name)
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := strconv.Atoi(valueStr)
+	if err != nil {
+		log.Fatalf("Error: couldn't parse %s=%s as an integer: %s\n", name, valueStr, err)
+	}
+	return value
+}
+
+func getEnvString(name string, defaultValue string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+/*
+getRoundCollector builds the round collector configured by the environment:
+  - ROUND_DEADLINE_MS:        time a round stays open after its first report, default 2000
+  - REPORT_POLICY:            "carry_forward" (default) or "drop"
+  - MAX_CARRY_FORWARD_ROUNDS: rounds a missing pod's last load is reused for, default 3
+*/
+func getRoundCollector(pods map[string]PodProps) *RoundCollector {
+	roundCollector, err := NewRoundCollector(
+		pods,
+		time.Duration(getEnvInt("ROUND_DEADLINE_MS", 2000))*time.Millisecond,
+		getEnvString("REPORT_POLICY", "carry_forward"),
+		getEnvInt("MAX_CARRY_FORWARD_ROUNDS", 3),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return roundCollector
+}
@@ -7,8 +7,11 @@ import (
 	"log"
 	"math"
 	"math/rand"
+	"net"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -46,6 +49,10 @@ type LBProps struct {
 	Name      string   `json:"name"`
 	IPAddress string   `json:"ipAddress"`
 	PodNames  []string `json:"podNames"`
+
+	// address of the LB's control endpoint, port 3001 (the LB's default
+	// CONTROL_PORT) of its host if not set
+	ControlAddress string `json:"controlAddress,omitempty"`
 }
 
 func respondWithError(w http.ResponseWriter, errStr string) {
@@ -60,6 +67,12 @@ func respondWithSuccess(w http.ResponseWriter, req Req) {
 	fmt.Fprintf(w, "Enqueued req for processing [for %s w/ k=%d & a=%d]", req.podname, req.k, req.a)
 }
 
+func respondWithUnavailable(w http.ResponseWriter, req Req) {
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Header().Set("Connection", "close")
+	fmt.Fprintf(w, "Report queue full, dropped req [for %s w/ k=%d & a=%d]", req.podname, req.k, req.a)
+}
+
 func getQueryParams(r *http.Request) (string, int, int, error) {
 	podname := r.URL.Query().Get("podname")
 	kStr := r.URL.Query().Get("k")
@@ -75,6 +88,10 @@ func getQueryParams(r *http.Request) (string, int, int, error) {
 	return podname, k, a, nil
 }
 
+// handleRequest takes a pod report as GET /?podname=&k=&a=, which is the only
+// way the local controller takes reports (its pods must keep REPORT_TRANSPORT
+// at its default, http_query; the other transports are only consumed by
+// central_controller)
 func handleRequest(chListenReqs chan Req, w http.ResponseWriter, r *http.Request) {
 	podname, k, a, err := getQueryParams(r)
 	if err != nil {
@@ -85,10 +102,14 @@ func handleRequest(chListenReqs chan Req, w http.ResponseWriter, r *http.Request
 
 	req := Req{podname, k, a}
 
-	// send request for processing in central controller
-	chListenReqs <- req
-
-	respondWithSuccess(w, req)
+	// send request for processing in central controller without blocking
+	// the pod if the controller is falling behind
+	select {
+	case chListenReqs <- req:
+		respondWithSuccess(w, req)
+	default:
+		respondWithUnavailable(w, req)
+	}
 }
 
 func getInitHostPrices(hosts map[string]HostProps) map[string]float64 {
@@ -104,56 +125,21 @@ func getInitHostPrices(hosts map[string]HostProps) map[string]float64 {
 	return initHostPrices
 }
 
-func getInitPodLoads(pods map[string]PodProps) map[string]int {
-
-	initReqsReceived := -1
-
-	initPodLoads := make(map[string]int)
-
-	for podname := range pods {
-		initPodLoads[podname] = initReqsReceived
-	}
-
-	return initPodLoads
-}
-
-func getAllPodLoads(pods map[string]PodProps, chListenReqs chan Req) map[string]int {
+func getAllPodLoads(chRounds chan Round) map[string]int {
 
 	defer log.Printf("Exited getAllPodLoads\n")
 
-	podLoads := getInitPodLoads(pods)
-
-	uniquePodLoadsReceived := 0
-
-	for {
-
-		// listen for requests
-		req := <-chListenReqs
-
-		// ignore this if its a pod that we don't recognize
-		_, ok := podLoads[req.podname]
-		if !ok {
-			fmt.Printf("Unrecognized pod sent request: [%s, k=%d, a=%d]. Request ignored\n", req.podname, req.k, req.a)
-			continue
-		}
-
-		// check if the sender is a pod we have not heard from before in this loop
-		if podLoads[req.podname] == -1 {
-			uniquePodLoadsReceived++
-		}
-
-		// update the state
-		podLoads[req.podname] = req.a
+	// wait for the next round to be closed by the round collector
+	round := <-chRounds
 
-		// if we have listened from all pods, break from loop
-		if uniquePodLoadsReceived == len(pods) {
-			break
-		}
-	}
+	log.Printf("Got pod loads for k=%d (missing: %v, carried forward: %v)\n",
+		round.K, round.Missing, round.CarriedForward)
 
-	return podLoads
+	return round.PodLoads
 }
 
+// aggregatePodLoadstoHostLoads sums the pod loads of every host, leaving out
+// the hosts with a pod whose load is unknown this round
 func aggregatePodLoadstoHostLoads(
 	hosts map[string]HostProps,
 	podLoads map[string]int,
@@ -162,10 +148,17 @@ func aggregatePodLoadstoHostLoads(
 	hostLoads := make(map[string]int)
 
 	for hostname, hostprops := range hosts {
-		hostLoads[hostname] = 0
+		hostLoad, known := 0, true
 		for j := 0; j < len(hostprops.PodNames); j++ {
-			podname := hostprops.PodNames[j]
-			hostLoads[hostname] += podLoads[podname]
+			podLoad, ok := podLoads[hostprops.PodNames[j]]
+			if !ok {
+				known = false
+				break
+			}
+			hostLoad += podLoad
+		}
+		if known {
+			hostLoads[hostname] = hostLoad
 		}
 	}
 
@@ -204,10 +197,17 @@ func getNewHostPrices(
 	sumOfOldHostPrices := getSumOfPrices(oldHostPrices)
 
 	for hostname, hostprops := range hosts {
+		loadArrivedAtHost, ok := loadsArrivedAtHost[hostname]
+		if !ok {
+			// keep the price of a host whose load is unknown this round
+			log.Printf("Load of host %s unknown this round, keeping its price\n", hostname)
+			newHostPrices[hostname] = oldHostPrices[hostname]
+			continue
+		}
 		newHostPrices[hostname] = getNewHostPrice(
 			oldHostPrices[hostname],
 			1.0,
-			loadsArrivedAtHost[hostname],
+			loadArrivedAtHost,
 			hostprops.LoadCapacity,
 			sumOfOldHostPrices,
 		)
@@ -266,7 +266,7 @@ func getShuffledArray(arr []string) []string {
 }
 
 // syncronous
-func makeRequest(reqURL string, podIP string, reqNum int) Response {
+func makeRequest(reqURL string, podIPs string, reqNum int) Response {
 
 	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
 	if err != nil {
@@ -279,7 +279,9 @@ func makeRequest(reqURL string, podIP string, reqNum int) Response {
 	req.Header.Set("Connection", "close")
 
 	q := req.URL.Query()
-	q.Add("endpoints", podIP)
+	q.Add("endpoints", podIPs)
+	// we keep no assignment versions, so the time orders our updates
+	q.Add("version", strconv.FormatInt(time.Now().UnixNano(), 10))
 	req.URL.RawQuery = q.Encode()
 
 	startReq := time.Now()
@@ -312,19 +314,30 @@ func makeRequest(reqURL string, podIP string, reqNum int) Response {
 		startReq.UnixNano(), latency.Nanoseconds(), readTime.Nanoseconds()}
 }
 
-func getPodIPonGivenHost(
+// getPodIPsOnGivenHost returns the IPs of all of the LB's pods on the given
+// host (in pod name order)
+func getPodIPsOnGivenHost(
 	optimalHostName string,
 	LB LBProps,
-	pods map[string]PodProps) string {
+	pods map[string]PodProps) ([]string, error) {
 
+	podnames := make([]string, 0)
 	for _, podName := range LB.PodNames {
 		if pods[podName].HostName == optimalHostName {
-			return pods[podName].IPAddress
-
+			podnames = append(podnames, podName)
 		}
 	}
+	if len(podnames) == 0 {
+		return nil, fmt.Errorf("LB %s has no pod on host %s", LB.Name, optimalHostName)
+	}
+	sort.Strings(podnames)
 
-	return ""
+	podIPs := make([]string, 0, len(podnames))
+	for _, podName := range podnames {
+		podIPs = append(podIPs, pods[podName].IPAddress)
+	}
+
+	return podIPs, nil
 }
 
 // syncronous
@@ -336,11 +349,24 @@ func communicateOptimalPodIPToLB(
 
 	log.Printf("LB Update: %s -> %s\n", LB.Name, optimalHostName)
 
-	lbUrl := fmt.Sprintf("http://%s", LB.IPAddress)
-	optimalPodIP := getPodIPonGivenHost(optimalHostName, LB, pods)
+	lbAddress := LB.ControlAddress
+	if lbAddress == "" {
+		host, _, err := net.SplitHostPort(LB.IPAddress)
+		if err != nil {
+			host = LB.IPAddress
+		}
+		lbAddress = net.JoinHostPort(host, "3001")
+	}
+	lbUrl := fmt.Sprintf("http://%s", lbAddress)
+	optimalPodIPs, err := getPodIPsOnGivenHost(optimalHostName, LB, pods)
+	if err != nil {
+		log.Printf("Error: not updating %s: %s\n", LB.Name, err)
+		chNotifyReqCompleted <- true
+		return
+	}
 	reqNum := 1
 
-	res := makeRequest(lbUrl, optimalPodIP, reqNum)
+	res := makeRequest(lbUrl, strings.Join(optimalPodIPs, ","), reqNum)
 	log.Printf("Response sent to %s\n", LB.Name)
 
 	log.Printf("Response received from %s: %d\n", LB.Name, res.StatusCode)
@@ -380,7 +406,7 @@ func centralController(
 	hosts map[string]HostProps,
 	pods map[string]PodProps,
 	LBs map[string]LBProps,
-	chListenReqs chan Req) {
+	chRounds chan Round) {
 
 	// define state at the beginning of the controller
 	hostPrices := getInitHostPrices(hosts)
@@ -388,7 +414,7 @@ func centralController(
 	for {
 
 		// wait for each pod to send state (# of reqs it received in time k)
-		podLoads := getAllPodLoads(pods, chListenReqs)
+		podLoads := getAllPodLoads(chRounds)
 
 		// compute price for each host
 		hostPrices = getNewHostPrices(pods, hosts, podLoads, hostPrices)
@@ -432,25 +458,31 @@ func getLBsListMappedToName(lbsList []LBProps) map[string]LBProps {
 	return lbsMap
 }
 
-func getTopology() (map[string]HostProps, map[string]PodProps, map[string]LBProps) {
+func getTopology() (map[string]HostProps, map[string]PodProps, map[string]LBProps, error) {
 
 	hostsJSON := "[{\"name\": \"node1\", \"loadCapacity\": 22, \"podNames\": [\"app1-pod1\"]}, {\"name\": \"node2\", \"loadCapacity\": 22, \"podNames\": [\"app1-pod2\"]}]"
 	podsJSON := "[{\"name\": \"app1-pod2\", \"ipAddress\": \"3334\", \"hostName\": \"node2\", \"lbName\": \"envoy-flask-app1\"}, {\"name\": \"app1-pod1\", \"ipAddress\": \"3333\", \"hostName\": \"node1\", \"lbName\": \"envoy-flask-app1\"}]"
 	lbsJSON := "[{\"name\": \"envoy-flask-app1\", \"ipAddress\": \"localhost:8000\", \"podNames\": [\"app1-pod1\", \"app1-pod2\"]}]"
 
 	var hostsList []HostProps
-	json.Unmarshal([]byte(hostsJSON), &hostsList)
+	if err := json.Unmarshal([]byte(hostsJSON), &hostsList); err != nil {
+		return nil, nil, nil, fmt.Errorf("couldn't parse hosts: %w", err)
+	}
 	hostsMap := getHostsListMappedToName(hostsList)
 
 	var podsList []PodProps
-	json.Unmarshal([]byte(podsJSON), &podsList)
+	if err := json.Unmarshal([]byte(podsJSON), &podsList); err != nil {
+		return nil, nil, nil, fmt.Errorf("couldn't parse pods: %w", err)
+	}
 	podsMap := getPodsListMappedToName(podsList)
 
 	var lbsList []LBProps
-	json.Unmarshal([]byte(lbsJSON), &lbsList)
+	if err := json.Unmarshal([]byte(lbsJSON), &lbsList); err != nil {
+		return nil, nil, nil, fmt.Errorf("couldn't parse lbs: %w", err)
+	}
 	lbsMap := getLBsListMappedToName(lbsList)
 
-	return hostsMap, podsMap, lbsMap
+	return hostsMap, podsMap, lbsMap, nil
 }
 
 func logTopology(
@@ -465,15 +497,25 @@ func logTopology(
 
 func main() {
 
-	hosts, pods, LBs := getTopology()
+	hosts, pods, LBs, err := getTopology()
+	if err != nil {
+		log.Fatal(err)
+	}
 	logTopology(hosts, pods, LBs)
 
-	chListenReqs := make(chan Req)
+	chListenReqs := make(chan Req, getEnvInt("REPORT_QUEUE_SIZE", 1024))
+	chRounds := make(chan Round, 1)
+
+	/* start a thread that groups the reports coming from the pods
+	*  into rounds by their k
+	 */
+	roundCollector := getRoundCollector(pods)
+	go roundCollector.collect(chListenReqs, chRounds)
 
 	/* start a thread that will process all the price updates coming
 	*  from the hosts
 	 */
-	go centralController(hosts, pods, LBs, chListenReqs)
+	go centralController(hosts, pods, LBs, chRounds)
 
 	port := 3000
 
@@ -491,7 +533,6 @@ func main() {
 *	- We have a fixed topology
 *	- We have to manually figure our the topology
 *	- We ignore failures
-*	- We are not ensuring same k is used for calculations
 *	- We should change Host, Pod, LB to maps of [hostname]HostProps,[podname]PodProps, [LBname]LBProps
 *	- There can be race conditions in the system between requests from pods to controller
 *	- Maybe breaking ties strategy of mine is wasting compute
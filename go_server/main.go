@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -9,7 +10,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -82,34 +83,94 @@ func respondWithSuccess(
 }
 
 type RedisClient struct {
-	mu     sync.Mutex
 	client *redis.Client
+	key    string
+
+	// time a request waits for Redis to count it, so that a slow Redis
+	// delays requests only a little
+	callTimeout time.Duration
+
+	// in lease mode, the pod's in-flight requests are counted in memory and
+	// written every flushInterval to the hash leaseKey, which expires
+	// leaseTTL after the last write
+	leaseKey      string
+	leaseTTL      time.Duration
+	flushInterval time.Duration
+	inFlight      atomic.Int64
 }
 
-func (rds *RedisClient) IncrRds(key string) int64 {
-	rds.mu.Lock()
-	numOutstandingReqs, err := rds.client.Incr(ctx, key).Result()
-	rds.mu.Unlock()
+func (rds *RedisClient) IncrRds(key string) (int64, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, rds.callTimeout)
+	defer cancel()
+
+	numOutstandingReqs, err := rds.client.Incr(ctxTimeout, key).Result()
 	if err != nil {
-		log.Printf("Error: couldn't increment variable in Redis\n")
-		numOutstandingReqs = 0
+		log.Printf("Error: couldn't increment variable in Redis: %s\n", err)
 	}
-	return numOutstandingReqs
+	return numOutstandingReqs, err
 }
 
 func (rds *RedisClient) DecrRds(key string) {
-	rds.mu.Lock()
-	_, err := rds.client.Decr(ctx, key).Result()
-	rds.mu.Unlock()
-	if err != nil {
-		log.Printf("Error: couldn't decr variable in Redis\n")
+	ctxTimeout, cancel := context.WithTimeout(ctx, rds.callTimeout)
+	defer cancel()
+
+	if err := rds.client.Decr(ctxTimeout, key).Err(); err != nil {
+		log.Printf("Error: couldn't decr variable in Redis: %s\n", err)
+	}
+}
+
+// writeLease writes the pod's in-flight requests and renews its lease, giving
+// up after a flush interval so that a slow Redis doesn't pile up writes
+func (rds *RedisClient) writeLease() {
+	ctxTimeout, cancel := context.WithTimeout(ctx, rds.flushInterval)
+	defer cancel()
+
+	pipe := rds.client.Pipeline()
+	pipe.HSet(ctxTimeout, rds.leaseKey, "inflight", rds.inFlight.Load(), "heartbeat", time.Now().UnixMilli())
+	pipe.PExpire(ctxTimeout, rds.leaseKey, rds.leaseTTL)
+	if _, err := pipe.Exec(ctxTimeout); err != nil {
+		log.Printf("Error: couldn't write lease %s in Redis: %s\n", rds.leaseKey, err)
+	}
+}
+
+// keepLeaseAlive flushes the pod's in-flight requests to its lease, and so
+// renews it, every flush interval, so that it only expires if the pod is gone
+func (rds *RedisClient) keepLeaseAlive() {
+	for range time.Tick(rds.flushInterval) {
+		rds.writeLease()
+	}
+}
+
+// StartRequest counts a request as outstanding and returns the number of
+// outstanding requests, or -1 if the request is not counted (outstanding
+// requests are not counted, or Redis couldn't count it); only a counted
+// request must be ended
+func (rds *RedisClient) StartRequest() (int64, bool) {
+	if rds == nil {
+		return -1, false
+	}
+	if rds.leaseKey == "" {
+		numOutstandingReqs, err := rds.IncrRds(rds.key)
+		if err != nil {
+			return -1, false
+		}
+		return numOutstandingReqs, true
+	}
+	return rds.inFlight.Add(1), true
+}
+
+// EndRequest stops counting a request as outstanding
+func (rds *RedisClient) EndRequest() {
+	if rds.leaseKey == "" {
+		rds.DecrRds(rds.key)
+		return
 	}
+	rds.inFlight.Add(-1)
 }
 
-func handleRequest(w http.ResponseWriter, r *http.Request) {
+func handleRequest(rds *RedisClient, w http.ResponseWriter, r *http.Request) {
 
-	// numOutstandingReqs := rds.IncrRds("outstanding_requests")
-	numOutstandingReqs := int64(-1)
+	numOutstandingReqs, counted := rds.StartRequest()
 	currentTime := time.Now().UnixNano()
 
 	loopCount := r.URL.Query().Get("loopCount")
@@ -118,12 +179,16 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 
 	loopCountFloat, baseFloat, expFloat, isErr := convParamsToFloat(loopCount, base, exp)
 	if isErr {
-		// rds.DecrRds("outstanding_requests")
+		if counted {
+			rds.EndRequest()
+		}
 		respondWithError(w, loopCount, base, exp, numOutstandingReqs, currentTime)
 	} else {
 		reqResult := processRequest(loopCountFloat, baseFloat, expFloat)
 
-		// rds.DecrRds("outstanding_requests")
+		if counted {
+			rds.EndRequest()
+		}
 		respondWithSuccess(w, loopCount, base, exp, reqResult, numOutstandingReqs, currentTime)
 		// chIncrementNumOfReqs <- true
 	}
@@ -295,68 +360,141 @@ func periodicallyNotifyCentralController(notifTimeInterval time.Duration, chGetA
 	}
 }
 
-func getRedisIPFromNodeName(nodeName string) string {
-	// if nodeName == "minikube-m02" {
-	// 	return "10.101.102.101"
-	// } else if nodeName == "minikube-m03" {
-	// 	return "10.101.102.102"
-	// } else if nodeName == "minikube-m04" {
-	// 	return "10.101.102.103"
-	// } else {
-	// 	return "localhost"
-	// }
-	nodeInt, err := strconv.Atoi(nodeName[10:])
-	// nodeInt, err := strconv.Atoi(nodeName[29:30])
-	if err != nil {
-		panic(err)
+/*
+Load source:
+
+	the outstanding requests of the pod are counted in the Redis of its node
+	(the node's load source, which the central controller reads), given by
+		- LOAD_SOURCES: JSON {"<node name>": {"address": "<host:port>", "db": 0,
+		                "key": "outstanding_requests", "leasePrefix": "", "username": "",
+		                "passwordEnv": "<env var holding the password>"}},
+		                the entry of MY_NODE_NAME is used
+		- or else LOAD_SOURCE_ADDR, LOAD_SOURCE_DB, LOAD_SOURCE_KEY,
+		  LOAD_SOURCE_LEASE_PREFIX, LOAD_SOURCE_USERNAME and LOAD_SOURCE_PASSWORD_ENV
+	without a load source, outstanding requests are not counted
+	with a leasePrefix, the pod keeps its outstanding requests in its own
+	lease, the hash <leasePrefix>:<MY_POD_NAME> {"inflight": n, "heartbeat": unix ms},
+	which it writes (from its count in memory) every LEASE_FLUSH_MS (default
+	LEASE_TTL_MS/3, TTL default 3000) and which expires if the pod crashes,
+	taking its requests out of the node's load; otherwise
+	it increments and decrements the node's key, which drifts if the pod
+	crashes with requests outstanding; a request waits LOAD_SOURCE_TIMEOUT_MS
+	(default 100) for each, and is not counted if the increment fails
+*/
+type LoadSource struct {
+	Address     string `json:"address"`
+	DB          int    `json:"db,omitempty"`
+	Key         string `json:"key,omitempty"`
+	LeasePrefix string `json:"leasePrefix,omitempty"`
+	Username    string `json:"username,omitempty"`
+	PasswordEnv string `json:"passwordEnv,omitempty"`
+}
+
+// getLoadSource returns the load source of this pod's node, if it has one
+func getLoadSource() (LoadSource, bool, error) {
+
+	if loadSourcesJSON := os.Getenv("LOAD_SOURCES"); loadSourcesJSON != "" {
+		var loadSources map[string]LoadSource
+		if err := json.Unmarshal([]byte(loadSourcesJSON), &loadSources); err != nil {
+			return LoadSource{}, false, fmt.Errorf("couldn't parse LOAD_SOURCES: %w", err)
+		}
+		myNodeName := os.Getenv("MY_NODE_NAME")
+		loadSource, ok := loadSources[myNodeName]
+		if !ok {
+			return LoadSource{}, false, fmt.Errorf("LOAD_SOURCES has no load source for node %q", myNodeName)
+		}
+		return loadSource, true, nil
+	}
+
+	addr := os.Getenv("LOAD_SOURCE_ADDR")
+	if addr == "" {
+		return LoadSource{}, false, nil
 	}
-	nodeIPSuffix := nodeInt + 100
-	redisIP := fmt.Sprintf("10.101.102.%d", nodeIPSuffix)
-	return redisIP
+	db := 0
+	if dbStr := os.Getenv("LOAD_SOURCE_DB"); dbStr != "" {
+		var err error
+		if db, err = strconv.Atoi(dbStr); err != nil {
+			return LoadSource{}, false, fmt.Errorf("couldn't parse LOAD_SOURCE_DB=%s: %w", dbStr, err)
+		}
+	}
+	return LoadSource{
+		Address:     addr,
+		DB:          db,
+		Key:         os.Getenv("LOAD_SOURCE_KEY"),
+		LeasePrefix: os.Getenv("LOAD_SOURCE_LEASE_PREFIX"),
+		Username:    os.Getenv("LOAD_SOURCE_USERNAME"),
+		PasswordEnv: os.Getenv("LOAD_SOURCE_PASSWORD_ENV"),
+	}, true, nil
 }
 
-func getRedisClient() *redis.Client {
+// getRedisClient connects to the load source of this pod's node, or returns
+// nil if it has none
+func getRedisClient() (*RedisClient, error) {
 
-	myNodeName := os.Getenv("MY_NODE_NAME")
-	redisIP := getRedisIPFromNodeName(myNodeName)
-	redisPort := ":6379"
+	loadSource, ok, err := getLoadSource()
+	if err != nil || !ok {
+		return nil, err
+	}
+	if loadSource.Key == "" {
+		loadSource.Key = "outstanding_requests"
+	}
 
 	rds := redis.NewClient(&redis.Options{
-		Addr:     redisIP + redisPort,
-		Password: "", // no password set
-		DB:       0,  // use default DB
+		Addr:     loadSource.Address,
+		Username: loadSource.Username,
+		Password: os.Getenv(loadSource.PasswordEnv),
+		DB:       loadSource.DB,
 	})
 
-	log.Printf("Redis client created for %s\n", redisIP+redisPort)
-
-	return rds
-
-	// hostname, err := os.Hostname()
-	// if err != nil {
-	// 	hostname = "error getting hostname"
-	// }
-
-	// // redisIPs := [3]string{"10.101.102.101", "10.101.102.102", "10.101.102.103"}
-	// redisIPs := [3]string{"10.101.102.101", "10.101.102.102", "10.101.102.103"}
-
-	// for _, redisIP := range redisIPs {
-	// 	addr := redisIP + ":6379"
-	// 	rds := redis.NewClient(&redis.Options{
-	// 		Addr:     addr,
-	// 		Password: "", // no password set
-	// 		DB:       0,  // use default DB
-	// 	})
-	// 	if err := rds.Ping(context.Background()).Err(); err != nil {
-	// 		log.Printf("%s: could not connect to redis server at %s [%s]\n",
-	// 			hostname, addr, err)
-	// 	} else {
-	// 		log.Printf("%s: connected to redis server at %s\n", hostname, addr)
-	// 		return rds
-	// 	}
-	// }
-
-	// log.Fatalln("Error: could not connect to any redis server")
-	// return nil
+	// go-redis redials on its own, so an unreachable load source only
+	// delays counting until it is back
+	if err := rds.Ping(ctx).Err(); err != nil {
+		log.Printf("Warning: couldn't connect to load source %s: %s\n", loadSource.Address, err)
+	} else {
+		log.Printf("Redis client created for %s (db %d, key %s)\n", loadSource.Address, loadSource.DB, loadSource.Key)
+	}
+
+	timeoutMs := 100
+	if timeoutStr := os.Getenv("LOAD_SOURCE_TIMEOUT_MS"); timeoutStr != "" {
+		if timeoutMs, err = strconv.Atoi(timeoutStr); err != nil || timeoutMs <= 0 {
+			return nil, fmt.Errorf("LOAD_SOURCE_TIMEOUT_MS must be a positive number, got %s", timeoutStr)
+		}
+	}
+
+	client := &RedisClient{client: rds, key: loadSource.Key, callTimeout: time.Duration(timeoutMs) * time.Millisecond}
+	if loadSource.LeasePrefix == "" {
+		return client, nil
+	}
+
+	// the topology names the pod by its Kubernetes name, which is also
+	// its hostname
+	myPodName := os.Getenv("MY_POD_NAME")
+	if myPodName == "" {
+		myPodName = getHostName()
+	}
+	leaseTTLMs := 3000
+	if leaseTTLStr := os.Getenv("LEASE_TTL_MS"); leaseTTLStr != "" {
+		if leaseTTLMs, err = strconv.Atoi(leaseTTLStr); err != nil || leaseTTLMs <= 0 {
+			return nil, fmt.Errorf("LEASE_TTL_MS must be a positive number, got %s", leaseTTLStr)
+		}
+	}
+	flushMs := leaseTTLMs / 3
+	if flushStr := os.Getenv("LEASE_FLUSH_MS"); flushStr != "" {
+		if flushMs, err = strconv.Atoi(flushStr); err != nil || flushMs <= 0 || flushMs >= leaseTTLMs {
+			return nil, fmt.Errorf("LEASE_FLUSH_MS must be a positive number below LEASE_TTL_MS, got %s", flushStr)
+		}
+	}
+	client.leaseKey = loadSource.LeasePrefix + ":" + myPodName
+	client.leaseTTL = time.Duration(leaseTTLMs) * time.Millisecond
+	client.flushInterval = time.Duration(math.Max(1, float64(flushMs))) * time.Millisecond
+
+	// a restarted pod has no requests in flight, whatever its lease says
+	client.writeLease()
+	go client.keepLeaseAlive()
+
+	log.Printf("Keeping outstanding requests in lease %s (ttl %s, flushed every %s)\n", client.leaseKey, client.leaseTTL, client.flushInterval)
+
+	return client, nil
 }
 
 // func main() {
@@ -374,10 +512,13 @@ func main() {
 	// go manageNumOfReqs(chIncrementNumOfReqs, chGetAndFlushNumOfReqs)
 	// go periodicallyNotifyCentralController(notifTimeInterval, chGetAndFlushNumOfReqs, centralControllerURL)
 
-	// rds := RedisClient{client: getRedisClient()}
+	rds, err := getRedisClient()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		handleRequest(w, r)
+		handleRequest(rds, w, r)
 	})
 	fmt.Printf("Server running (port=%d), route: http://localhost:%d/?loopCount=1&base=8&exp=7.7\n", portToListenOn, portToListenOn)
 
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+Report transport:
+	the state of the pod (podname, k, a) is reported to the central controller
+	by the ReportSink selected by REPORT_TRANSPORT:
+		- "http_query":   GET <controller>/?podname=&k=&a= (default)
+		- "http_json":    POST <controller>/ with the JSON report as body
+		- "redis_stream": XADD to the stream REPORT_STREAM (default "pod_reports")
+		                  of the Redis REPORT_STREAM_ADDR, with the JSON report
+		                  in the field "report", trimmed to about
+		                  REPORT_STREAM_MAXLEN (default 10000) entries
+		- "nats":         publish the JSON report on the subject
+		                  REPORT_NATS_SUBJECT (default "pod_reports") of the
+		                  NATS server REPORT_NATS_URL (default nats://localhost:4222)
+	central_controller_local only takes http_query reports; central_controller
+	takes http_query and http_json, and redis_stream and nats if it is
+	configured to consume them (see its REPORT_SOURCES)
+*/
+
+// PodReport is the state a pod reports to the central controller
+type PodReport struct {
+	Podname string `json:"podname"`
+	K       int64  `json:"k"`
+	A       int    `json:"a"`
+}
+
+type ReportSink interface {
+	Send(report PodReport, tryNum int) Response
+}
+
+// HTTPReportSink reports to the central controller's HTTP API, as query
+// parameters or as a JSON body
+type HTTPReportSink struct {
+	url  string
+	json bool
+}
+
+func (s *HTTPReportSink) Send(report PodReport, tryNum int) Response {
+	if s.json {
+		body, err := json.Marshal(report)
+		if err != nil {
+			return getErrorResponse(tryNum, fmt.Sprintf("client: could not encode report: %s", err), time.Now())
+		}
+		return sendStateToCentralController(s.url, http.MethodPost, body, report, tryNum)
+	}
+	return sendStateToCentralController(s.url, http.MethodGet, nil, report, tryNum)
+}
+
+// RedisStreamReportSink appends reports to a Redis stream
+type RedisStreamReportSink struct {
+	client *redis.Client
+	stream string
+	maxLen int64
+}
+
+func (s *RedisStreamReportSink) Send(report PodReport, tryNum int) Response {
+	start := time.Now()
+	body, err := json.Marshal(report)
+	if err != nil {
+		return getErrorResponse(tryNum, fmt.Sprintf("client: could not encode report: %s", err), start)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	id, err := s.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: s.stream,
+		MaxLen: s.maxLen,
+		Approx: true,
+		Values: map[string]interface{}{"report": string(body)},
+	}).Result()
+	if err != nil {
+		return getErrorResponse(tryNum, fmt.Sprintf("client: could not add report to stream %s: %s", s.stream, err), start)
+	}
+	return Response{tryNum, false, "", 0, id, start.UnixNano(), time.Since(start).Nanoseconds(), 0}
+}
+
+// NATSReportSink publishes reports on a NATS subject
+type NATSReportSink struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func (s *NATSReportSink) Send(report PodReport, tryNum int) Response {
+	start := time.Now()
+	body, err := json.Marshal(report)
+	if err != nil {
+		return getErrorResponse(tryNum, fmt.Sprintf("client: could not encode report: %s", err), start)
+	}
+	if err := s.conn.Publish(s.subject, body); err != nil {
+		return getErrorResponse(tryNum, fmt.Sprintf("client: could not publish report on %s: %s", s.subject, err), start)
+	}
+	return Response{tryNum, false, "", 0, "", start.UnixNano(), time.Since(start).Nanoseconds(), 0}
+}
+
+func getErrorResponse(tryNum int, errMsg string, start time.Time) Response {
+	return Response{tryNum,
+		true, errMsg,
+		0, "",
+		start.UnixNano(), time.Since(start).Nanoseconds(), 0}
+}
+
+func getEnvString(name string, defaultValue string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// getReportSink builds the report sink configured by the environment
+func getReportSink(centralControllerURL string) (ReportSink, error) {
+	transport := getEnvString("REPORT_TRANSPORT", "http_query")
+
+	switch transport {
+	case "http_query":
+		return &HTTPReportSink{url: centralControllerURL}, nil
+
+	case "http_json":
+		return &HTTPReportSink{url: centralControllerURL, json: true}, nil
+
+	case "redis_stream":
+		addr := os.Getenv("REPORT_STREAM_ADDR")
+		if addr == "" {
+			return nil, fmt.Errorf("REPORT_STREAM_ADDR must be set for the redis_stream transport")
+		}
+		maxLen, err := strconv.ParseInt(getEnvString("REPORT_STREAM_MAXLEN", "10000"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse REPORT_STREAM_MAXLEN: %w", err)
+		}
+		log.Printf("Reporting to stream %s of %s\n", getEnvString("REPORT_STREAM", "pod_reports"), addr)
+		return &RedisStreamReportSink{
+			client: redis.NewClient(&redis.Options{Addr: addr}),
+			stream: getEnvString("REPORT_STREAM", "pod_reports"),
+			maxLen: maxLen,
+		}, nil
+
+	case "nats":
+		url := getEnvString("REPORT_NATS_URL", nats.DefaultURL)
+		conn, err := nats.Connect(url, nats.MaxReconnects(-1))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't connect to NATS at %s: %w", url, err)
+		}
+		log.Printf("Reporting to subject %s of %s\n", getEnvString("REPORT_NATS_SUBJECT", "pod_reports"), url)
+		return &NATSReportSink{conn: conn, subject: getEnvString("REPORT_NATS_SUBJECT", "pod_reports")}, nil
+	}
+
+	return nil, fmt.Errorf("invalid REPORT_TRANSPORT %q (must be http_query, http_json, redis_stream or nats)", transport)
+}
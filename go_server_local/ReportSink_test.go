@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestHTTPReportSink(t *testing.T) {
+	var method, query string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, query = r.Method, r.URL.RawQuery
+		body, _ = io.ReadAll(r.Body)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	report := PodReport{Podname: "pod1", K: 3, A: 7}
+
+	// http_query
+	sink := &HTTPReportSink{url: server.URL}
+	if res := sink.Send(report, 1); res.IsError {
+		t.Fatalf("couldn't send report: %s", res.ErrMsg)
+	}
+	if method != http.MethodGet || query != "a=7&k=3&podname=pod1" {
+		t.Errorf("sent %s ?%s, expected GET ?a=7&k=3&podname=pod1", method, query)
+	}
+
+	// http_json
+	sink = &HTTPReportSink{url: server.URL, json: true}
+	if res := sink.Send(report, 1); res.IsError {
+		t.Fatalf("couldn't send report: %s", res.ErrMsg)
+	}
+	var sent PodReport
+	if err := json.Unmarshal(body, &sent); err != nil || method != http.MethodPost || sent != report {
+		t.Errorf("sent %s %s, expected POST with %+v", method, body, report)
+	}
+}
+
+func TestRedisStreamReportSink(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	sink := &RedisStreamReportSink{client: client, stream: "pod_reports", maxLen: 10000}
+	reports := []PodReport{{Podname: "pod1", K: 1, A: 10}, {Podname: "pod2", K: 1, A: 20}}
+	for _, report := range reports {
+		if res := sink.Send(report, 1); res.IsError {
+			t.Fatalf("couldn't send report: %s", res.ErrMsg)
+		}
+	}
+
+	// the controller's RedisStreamReportSource reads the JSON report in the
+	// field "report" of each entry
+	messages, err := client.XRange(context.Background(), "pod_reports", "-", "+").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != len(reports) {
+		t.Fatalf("stream has %d entries, expected %d", len(messages), len(reports))
+	}
+	for i, message := range messages {
+		data, _ := message.Values["report"].(string)
+		var sent PodReport
+		if err := json.Unmarshal([]byte(data), &sent); err != nil || sent != reports[i] {
+			t.Errorf("entry %s has report %q, expected %+v", message.ID, data, reports[i])
+		}
+	}
+
+	mr.Close()
+	if res := sink.Send(reports[0], 2); !res.IsError || res.ReqNum != 2 {
+		t.Errorf("got %+v with Redis down, expected an error for try 2", res)
+	}
+}
+
+func TestNATSReportSink(t *testing.T) {
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	defer ns.Shutdown()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server did not start")
+	}
+
+	// the controller's NATSReportSource takes the JSON report of each
+	// message on the subject
+	subConn, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subConn.Close()
+	sub, err := subConn.SubscribeSync("pod_reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subConn.Flush()
+
+	conn, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &NATSReportSink{conn: conn, subject: "pod_reports"}
+
+	report := PodReport{Podname: "pod1", K: 2, A: 30}
+	if res := sink.Send(report, 1); res.IsError {
+		t.Fatalf("couldn't send report: %s", res.ErrMsg)
+	}
+	msg, err := sub.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatalf("no report on the subject: %s", err)
+	}
+	var sent PodReport
+	if err := json.Unmarshal(msg.Data, &sent); err != nil || sent != report {
+		t.Errorf("published %s, expected %+v", msg.Data, report)
+	}
+
+	conn.Close()
+	if res := sink.Send(report, 2); !res.IsError || res.ReqNum != 2 {
+		t.Errorf("got %+v with the connection closed, expected an error for try 2", res)
+	}
+}
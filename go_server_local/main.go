@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
@@ -108,6 +109,13 @@ type Response struct {
 	ReadTimeNs  int64
 }
 
+// getEpoch returns the index of the notification interval t falls in, so that
+// every pod reports the same k for the same interval
+func getEpoch(t time.Time, notifTimeInterval time.Duration) int64 {
+	intervalNs := notifTimeInterval.Nanoseconds()
+	return (t.UnixNano() + intervalNs/2) / intervalNs
+}
+
 func getWaitDuration(notifTimeIntervalNs time.Duration) time.Duration {
 
 	currentTimeNs := time.Now().UnixNano()
@@ -121,14 +129,18 @@ func getWaitDuration(notifTimeIntervalNs time.Duration) time.Duration {
 // syncronous
 func sendStateToCentralController(
 	reqURL string,
-	podname string,
-	k int64,
-	a int,
+	method string,
+	body []byte,
+	report PodReport,
 	tryNum int) Response {
 
-	log.Printf("sending state [%s, %d, %d] to %s (try %d)", podname, k, a, reqURL, tryNum)
+	log.Printf("sending state [%s, %d, %d] to %s (try %d)", report.Podname, report.K, report.A, reqURL, tryNum)
 
-	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, reqURL, reqBody)
 	if err != nil {
 		errMsg := fmt.Sprintf("client: could not create request: %s", err)
 		return Response{tryNum,
@@ -138,11 +150,15 @@ func sendStateToCentralController(
 	}
 	req.Header.Set("Connection", "close")
 
-	q := req.URL.Query()
-	q.Add("podname", podname)
-	q.Add("k", fmt.Sprintf("%d", k))
-	q.Add("a", fmt.Sprintf("%d", a))
-	req.URL.RawQuery = q.Encode()
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		q := req.URL.Query()
+		q.Add("podname", report.Podname)
+		q.Add("k", fmt.Sprintf("%d", report.K))
+		q.Add("a", fmt.Sprintf("%d", report.A))
+		req.URL.RawQuery = q.Encode()
+	}
 
 	startReq := time.Now()
 	client := &http.Client{
@@ -184,7 +200,7 @@ func getAndFlushNumOfReqs(chGetAndFlushNumOfReqs chan chan int, chGetNumOfReqs c
 }
 
 // synchronous
-func reliablySendState(podname string, chGetAndFlushNumOfReqs chan chan int, centralControllerURL string, chGetNumOfReqs chan int) {
+func reliablySendState(podname string, notifTimeInterval time.Duration, chGetAndFlushNumOfReqs chan chan int, sink ReportSink, chGetNumOfReqs chan int) {
 
 	tryNum := 1
 	// podname, err := os.Hostname()
@@ -192,10 +208,10 @@ func reliablySendState(podname string, chGetAndFlushNumOfReqs chan chan int, cen
 	// 	log.Printf("Error: couldn't look up the hostname of pod\n")
 	// }
 	numOfReqs := getAndFlushNumOfReqs(chGetAndFlushNumOfReqs, chGetNumOfReqs)
-	currentTime := time.Now().UnixNano()
+	k := getEpoch(time.Now(), notifTimeInterval)
 
 	// for {
-	resp := sendStateToCentralController(centralControllerURL, podname, currentTime, numOfReqs, tryNum)
+	resp := sink.Send(PodReport{podname, k, numOfReqs}, tryNum)
 
 	log.Printf("Resonse from CC for try %d: [%d] %s, {%s}, latency: %fms",
 		tryNum, resp.StatusCode, resp.Body, resp.ErrMsg, float64(resp.LatencyNs)/1000000)
@@ -205,14 +221,14 @@ func reliablySendState(podname string, chGetAndFlushNumOfReqs chan chan int, cen
 	// }
 
 	// if tryNum >= 3 {
-	// 	log.Printf("Error: no 200 response from CC in 3 tries. Stopping sending messages for k=%dns\n", currentTime)
+	// 	log.Printf("Error: no 200 response from CC in 3 tries. Stopping sending messages for k=%d\n", k)
 	// 	break
 	// }
 	// tryNum++
 	// }
 }
 
-func periodicallyNotifyCentralController(podname string, notifTimeInterval time.Duration, chGetAndFlushNumOfReqs chan chan int, centralControllerURL string) {
+func periodicallyNotifyCentralController(podname string, notifTimeInterval time.Duration, chGetAndFlushNumOfReqs chan chan int, sink ReportSink) {
 
 	defer log.Printf("Leaving function [periodicallyNotifyCentralController]")
 
@@ -227,7 +243,7 @@ func periodicallyNotifyCentralController(podname string, notifTimeInterval time.
 	chGetNumOfReqs := make(chan int)
 
 	for range repeatTicker.C {
-		reliablySendState(podname, chGetAndFlushNumOfReqs, centralControllerURL, chGetNumOfReqs)
+		reliablySendState(podname, notifTimeInterval, chGetAndFlushNumOfReqs, sink, chGetNumOfReqs)
 	}
 }
 
@@ -247,9 +263,14 @@ func main() {
 	centralControllerURL := getCentralControllerURL()
 	notifTimeInterval := 10 * time.Second
 
+	sink, err := getReportSink(centralControllerURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	go manageNumOfReqs(chIncrementNumOfReqs, chGetAndFlushNumOfReqs)
 
-	go periodicallyNotifyCentralController(podname, notifTimeInterval, chGetAndFlushNumOfReqs, centralControllerURL)
+	go periodicallyNotifyCentralController(podname, notifTimeInterval, chGetAndFlushNumOfReqs, sink)
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		handleRequest(chIncrementNumOfReqs, w, r)
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+Control endpoint (CONTROLLER and WEIGHTED algorithms):
+	the central controller sets our endpoints with
+		GET (or POST) http://<LB>:<control port>/?endpoints=<ip>,<ip>&version=<v>[&weights=<w>,<w>]
+	we respond
+		- 200 with the version we have in X-Assignment-Version once it is applied
+		- 409 with our (newer) version in X-Assignment-Version if it is stale
+		- 400 if it is invalid
+	(the controller can also reach us through the watch stream, see
+	WatchClient.go)
+*/
+
+func parseWeights(weightsStr string) ([]float64, error) {
+	if weightsStr == "" {
+		return nil, nil
+	}
+	weights := make([]float64, 0)
+	for _, weightStr := range strings.Split(weightsStr, ",") {
+		weight, err := strconv.ParseFloat(weightStr, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight %q", weightStr)
+		}
+		weights = append(weights, weight)
+	}
+	return weights, nil
+}
+
+func handleControlRequest(lb *LoadBalancer, app int, w http.ResponseWriter, r *http.Request) {
+
+	var assignment controllerAssignment
+	var err error
+
+	assignment.Version, err = strconv.ParseInt(r.URL.Query().Get("version"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid version: %s", err), http.StatusBadRequest)
+		return
+	}
+	if endpointsStr := r.URL.Query().Get("endpoints"); endpointsStr != "" {
+		assignment.Endpoints = strings.Split(endpointsStr, ",")
+	}
+	assignment.Weights, err = parseWeights(r.URL.Query().Get("weights"))
+	if err == nil {
+		err = checkAssignment(assignment)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	version, ok := lb.SetEndpoints(assignment.Version, getEndpointsFromURLs(assignment.Endpoints, app), assignment.Weights, false)
+
+	w.Header().Set("X-Assignment-Version", strconv.FormatInt(version, 10))
+	w.Header().Set("Connection", "close")
+	if !ok {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "stale version %d, have version %d", assignment.Version, version)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "applied version %d", version)
+}
+
+func serveControlEndpoint(lb *LoadBalancer, app int, port int) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		handleControlRequest(lb, app, w, r)
+	})
+	fmt.Printf("Control endpoint running (port=%d), route: http://localhost:%d/?endpoints=10.0.0.1&version=1\n", port, port)
+
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Health reports:
+	the LB counts the requests it sends to each endpoint, how many of them
+	failed (no response, or a 5xx) and how long they took, and every
+	interval reports them to the central controller:
+		POST <controller>/health/report?lb=<lb>&endpoint=<address>&requests=<n>&errors=<n>&latency_ms=<mean latency>
+	(endpoints with no requests since the last report are not reported)
+	the counts of a report that can't be sent are dropped, since the next
+	report is about as recent
+*/
+
+type endpointStats struct {
+	requests   int
+	errors     int
+	latencySum time.Duration
+}
+
+type HealthReporter struct {
+	controllerURL string
+	lbName        string
+	interval      time.Duration
+	client        *http.Client
+
+	mu    sync.Mutex
+	stats map[string]*endpointStats
+}
+
+func NewHealthReporter(controllerURL string, lbName string, interval time.Duration) *HealthReporter {
+	return &HealthReporter{
+		controllerURL: controllerURL,
+		lbName:        lbName,
+		interval:      interval,
+		client:        &http.Client{Timeout: interval},
+		stats:         make(map[string]*endpointStats),
+	}
+}
+
+// Record counts a request sent to the endpoint at the given address
+func (r *HealthReporter) Record(address string, latency time.Duration, failed bool) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats, ok := r.stats[address]
+	if !ok {
+		stats = &endpointStats{}
+		r.stats[address] = stats
+	}
+	stats.requests++
+	if failed {
+		stats.errors++
+	}
+	stats.latencySum += latency
+}
+
+// takeStats returns the counts since the last call, and starts over
+func (r *HealthReporter) takeStats() map[string]*endpointStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := r.stats
+	r.stats = make(map[string]*endpointStats)
+	return stats
+}
+
+func (r *HealthReporter) report(address string, stats *endpointStats) error {
+	q := url.Values{}
+	q.Set("lb", r.lbName)
+	q.Set("endpoint", address)
+	q.Set("requests", strconv.Itoa(stats.requests))
+	q.Set("errors", strconv.Itoa(stats.errors))
+	meanLatency := stats.latencySum / time.Duration(stats.requests)
+	q.Set("latency_ms", strconv.FormatFloat(float64(meanLatency)/float64(time.Millisecond), 'f', 3, 64))
+
+	res, err := r.client.Post(fmt.Sprintf("%s/health/report?%s", r.controllerURL, q.Encode()), "", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("controller responded %d: %s", res.StatusCode, body)
+	}
+	return nil
+}
+
+// Run reports the counts of every endpoint every interval, for as long as
+// the LB runs
+func (r *HealthReporter) Run() {
+	for range time.Tick(r.interval) {
+		for address, stats := range r.takeStats() {
+			if err := r.report(address, stats); err != nil {
+				log.Printf("Health report: couldn't report endpoint %s: %s\n", address, err)
+			}
+		}
+	}
+}
+
+/*
+getHealthReporter builds the health reporter configured by the environment,
+or returns nil if there is none:
+  - HEALTH_REPORT_URL:         the central controller, e.g. http://cc:3000 (optional)
+  - LB_NAME:                   name of this LB in the controller's topology
+  - HEALTH_REPORT_INTERVAL_MS: time between reports, default 5000
+*/
+func getHealthReporter() *HealthReporter {
+	controllerURL := os.Getenv("HEALTH_REPORT_URL")
+	if controllerURL == "" {
+		return nil
+	}
+
+	lbName := os.Getenv("LB_NAME")
+	if lbName == "" {
+		log.Fatal("LB_NAME must be set to report health to the controller")
+	}
+	intervalMs, err := strconv.Atoi(getEnvWithDefault("HEALTH_REPORT_INTERVAL_MS", "5000"))
+	check(err)
+	if intervalMs <= 0 {
+		log.Fatal("HEALTH_REPORT_INTERVAL_MS must be positive")
+	}
+
+	return NewHealthReporter(controllerURL, lbName, time.Duration(intervalMs)*time.Millisecond)
+}
@@ -3,12 +3,16 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"log"
 	"math/rand"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type LoadBalancer struct {
-	loadBalancerAlgo string // can be "NONE", "LEAST_REQUEST"
+	loadBalancerAlgo string // can be "NONE", "LEAST_REQUEST", "CONTROLLER", "WEIGHTED"
 	endpoints        []Endpoint
 	logWriter        *bufio.Writer
 
@@ -18,6 +22,28 @@ type LoadBalancer struct {
 
 	endpointReqCounter map[Endpoint]int
 	reqEndpoint        map[int]Endpoint
+
+	controlledEndpoints atomic.Pointer[EndpointSet]
+	weightRamp          time.Duration
+
+	healthReporter *HealthReporter
+}
+
+// EndpointSet is a versioned set of endpoints (with optional weights) given
+// by the central controller
+type EndpointSet struct {
+	Version   int64
+	Endpoints []Endpoint
+	Weights   []float64
+
+	next atomic.Uint64
+
+	// weighted round-robin state: the weights ramp from fromWeights (the
+	// weights in effect when the set was swapped in) to Weights
+	mu             sync.Mutex
+	fromWeights    []float64
+	swappedAt      time.Time
+	currentWeights []float64
 }
 
 /*
@@ -30,6 +56,20 @@ Load balancing logic:
 			and a counter for each endpoint
 		- sends the next request to whichever endpoint has the
 			least requests pending
+	controller loadbalancing
+		- the central controller sets the endpoints (and their weights)
+			through the control endpoint, or through a watch stream
+		- the whole set is swapped at once; a request that already
+			got its endpoint finishes on it
+		- requests go round-robin over the endpoints, or at random
+			in proportion to the weights if there are any
+		- updates older than the current set are rejected
+	weighted loadbalancing
+		- like controller loadbalancing, but requests go to the
+			endpoints by smooth weighted round-robin
+		- when new weights arrive, the weights in effect move to
+			them linearly over the weight ramp, so traffic shifts
+			gradually instead of all at once
 */
 
 func (lb *LoadBalancer) startLeastRequestLoadBalancer() {
@@ -54,11 +94,19 @@ func (lb *LoadBalancer) startNoneLoadBalancer() {
 	}
 }
 
+func (lb *LoadBalancer) startControllerLoadBalancer() {
+	// start from the configured endpoints (if any) until the controller
+	// tells us otherwise
+	lb.controlledEndpoints.Store(&EndpointSet{Endpoints: lb.endpoints})
+}
+
 func (lb *LoadBalancer) StartLoadBalancer() {
 	if lb.loadBalancerAlgo == "NONE" {
 		lb.startNoneLoadBalancer()
 	} else if lb.loadBalancerAlgo == "LEAST_REQUEST" {
 		lb.startLeastRequestLoadBalancer()
+	} else if lb.loadBalancerAlgo == "CONTROLLER" || lb.loadBalancerAlgo == "WEIGHTED" {
+		lb.startControllerLoadBalancer()
 	} else {
 		panic("Invalid load balancer algorithm")
 	}
@@ -129,6 +177,160 @@ func (lb *LoadBalancer) handleState() {
 	}
 }
 
+// SetEndpoints swaps in the endpoints of the given version, unless we already
+// have a newer version (or force is set). It returns the version we end up
+// with and whether the update was accepted.
+func (lb *LoadBalancer) SetEndpoints(
+	version int64,
+	endpoints []Endpoint,
+	weights []float64,
+	force bool) (int64, bool) {
+
+	for {
+		oldSet := lb.controlledEndpoints.Load()
+		if !force && version < oldSet.Version {
+			return oldSet.Version, false
+		}
+		if !force && version == oldSet.Version {
+			// we already have it
+			return version, true
+		}
+
+		newSet := &EndpointSet{Version: version, Endpoints: endpoints, Weights: weights}
+		if lb.loadBalancerAlgo == "WEIGHTED" {
+			newSet.swappedAt = time.Now()
+			newSet.fromWeights = oldSet.getWeightsOfEndpoints(endpoints, newSet.swappedAt, lb.weightRamp)
+		}
+
+		if lb.controlledEndpoints.CompareAndSwap(oldSet, newSet) {
+			log.Printf("Endpoints: version %d -> %d: %v (weights %v)\n", oldSet.Version, version, endpoints, weights)
+			return version, true
+		}
+	}
+}
+
+func (lb *LoadBalancer) GetEndpointVersion() int64 {
+	return lb.controlledEndpoints.Load().Version
+}
+
+func (lb *LoadBalancer) getControlledEndpoint() Endpoint {
+
+	endpointSet := lb.controlledEndpoints.Load()
+	if len(endpointSet.Endpoints) == 0 {
+		return Endpoint{}
+	}
+
+	if len(endpointSet.Weights) == 0 {
+		next := endpointSet.next.Add(1)
+		return endpointSet.Endpoints[next%uint64(len(endpointSet.Endpoints))]
+	}
+
+	return endpointSet.Endpoints[getWeightedRandomIndex(endpointSet.Weights)]
+}
+
+func getNormalisedWeights(weights []float64, numEndpoints int) []float64 {
+	normalised := make([]float64, numEndpoints)
+	sum := 0.0
+	for _, weight := range weights {
+		sum += weight
+	}
+	for i := range normalised {
+		if sum > 0 && i < len(weights) {
+			normalised[i] = weights[i] / sum
+		} else if sum <= 0 {
+			// no weights means equal weights
+			normalised[i] = 1 / float64(numEndpoints)
+		}
+	}
+	return normalised
+}
+
+// getEffectiveWeights returns the weights in effect at time now, part way
+// through the ramp from fromWeights to Weights
+func (s *EndpointSet) getEffectiveWeights(now time.Time, ramp time.Duration) []float64 {
+	weights := getNormalisedWeights(s.Weights, len(s.Endpoints))
+	if s.fromWeights == nil || ramp <= 0 {
+		return weights
+	}
+
+	progress := float64(now.Sub(s.swappedAt)) / float64(ramp)
+	if progress >= 1 {
+		return weights
+	}
+	for i := range weights {
+		weights[i] = s.fromWeights[i] + (weights[i]-s.fromWeights[i])*progress
+	}
+	return weights
+}
+
+// getWeightsOfEndpoints returns the weights in effect for the given endpoints
+// (0 for the ones not in this set), or nil if none of them are in this set
+func (s *EndpointSet) getWeightsOfEndpoints(endpoints []Endpoint, now time.Time, ramp time.Duration) []float64 {
+	weightsByURL := make(map[string]float64)
+	for i, weight := range s.getEffectiveWeights(now, ramp) {
+		weightsByURL[s.Endpoints[i].URL] += weight
+	}
+
+	weights := make([]float64, len(endpoints))
+	sum := 0.0
+	for i, endpoint := range endpoints {
+		weights[i] = weightsByURL[endpoint.URL]
+		sum += weights[i]
+	}
+	if sum <= 0 {
+		return nil
+	}
+	return getNormalisedWeights(weights, len(endpoints))
+}
+
+// getWeightedRoundRobinEndpoint picks the next endpoint by smooth weighted
+// round-robin: every endpoint gains its weight, and the one with the most
+// pays back the total
+func (lb *LoadBalancer) getWeightedRoundRobinEndpoint() Endpoint {
+
+	endpointSet := lb.controlledEndpoints.Load()
+	if len(endpointSet.Endpoints) == 0 {
+		return Endpoint{}
+	}
+
+	endpointSet.mu.Lock()
+	defer endpointSet.mu.Unlock()
+
+	if endpointSet.currentWeights == nil {
+		endpointSet.currentWeights = make([]float64, len(endpointSet.Endpoints))
+	}
+
+	weights := endpointSet.getEffectiveWeights(time.Now(), lb.weightRamp)
+	best := 0
+	total := 0.0
+	for i, weight := range weights {
+		endpointSet.currentWeights[i] += weight
+		total += weight
+		if endpointSet.currentWeights[i] > endpointSet.currentWeights[best] {
+			best = i
+		}
+	}
+	endpointSet.currentWeights[best] -= total
+
+	return endpointSet.Endpoints[best]
+}
+
+func getWeightedRandomIndex(weights []float64) int {
+	sum := 0.0
+	for _, weight := range weights {
+		sum += weight
+	}
+
+	r := rand.Float64() * sum
+	for i, weight := range weights {
+		if r < weight {
+			return i
+		}
+		r -= weight
+	}
+	return len(weights) - 1
+}
+
 func (lb *LoadBalancer) GetEndpointForReq(reqNum int) Endpoint {
 
 	if lb.loadBalancerAlgo == "NONE" {
@@ -136,13 +338,17 @@ func (lb *LoadBalancer) GetEndpointForReq(reqNum int) Endpoint {
 	} else if lb.loadBalancerAlgo == "LEAST_REQUEST" {
 		lb.requestForEndpointCh <- reqNum
 		return <-lb.receiveEndpointCh
+	} else if lb.loadBalancerAlgo == "CONTROLLER" {
+		return lb.getControlledEndpoint()
+	} else if lb.loadBalancerAlgo == "WEIGHTED" {
+		return lb.getWeightedRoundRobinEndpoint()
 	} else {
 		panic("Invalid load balancer algorithm")
 	}
 }
 
 func (lb *LoadBalancer) NotifyReqCompleted(reqNum int) {
-	if lb.loadBalancerAlgo == "NONE" {
+	if lb.loadBalancerAlgo == "NONE" || lb.loadBalancerAlgo == "CONTROLLER" || lb.loadBalancerAlgo == "WEIGHTED" {
 		// do nothing
 	} else if lb.loadBalancerAlgo == "LEAST_REQUEST" {
 		lb.notifyReqCompletedCh <- reqNum
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Watch stream (CONTROLLER and WEIGHTED algorithms):
+	we follow the controller's watch stream (server-sent events from
+	GET /watch?lb=<name>), each event having an assignment as JSON data:
+		{"version": <v>, "endpoints": ["<ip>", ...], "weights": [<w>, ...]}
+	when the stream breaks we reconnect with the last version we saw (as
+	Last-Event-ID); the first assignment of a stream is always applied, since
+	the controller may have restarted with lower versions
+*/
+
+type controllerAssignment struct {
+	Version   int64     `json:"version"`
+	Endpoints []string  `json:"endpoints"`
+	Weights   []float64 `json:"weights"`
+}
+
+func getEndpointsFromURLs(urls []string, app int) []Endpoint {
+	endpoints := make([]Endpoint, 0, len(urls))
+	for _, url := range urls {
+		endpoints = append(endpoints, Endpoint{URL: url, App: app})
+	}
+	return endpoints
+}
+
+func checkAssignment(assignment controllerAssignment) error {
+	if len(assignment.Endpoints) == 0 {
+		return fmt.Errorf("no endpoints")
+	}
+	for _, url := range assignment.Endpoints {
+		if url == "" {
+			return fmt.Errorf("empty endpoint in %v", assignment.Endpoints)
+		}
+	}
+	if len(assignment.Weights) == 0 {
+		return nil
+	}
+	if len(assignment.Weights) != len(assignment.Endpoints) {
+		return fmt.Errorf("%d weights for %d endpoints", len(assignment.Weights), len(assignment.Endpoints))
+	}
+	sum := 0.0
+	for _, weight := range assignment.Weights {
+		if weight < 0 {
+			return fmt.Errorf("negative weight %f", weight)
+		}
+		sum += weight
+	}
+	if sum <= 0 {
+		return fmt.Errorf("weights add up to %f", sum)
+	}
+	return nil
+}
+
+// watchController follows the controller's watch stream at watchURL for as
+// long as the LB runs
+func watchController(lb *LoadBalancer, app int, watchURL string, idleTimeout time.Duration) {
+	for {
+		err := followWatchStream(lb, app, watchURL, idleTimeout)
+		log.Printf("Watch: stream from %s ended: %v, reconnecting\n", watchURL, err)
+		time.Sleep(time.Second)
+	}
+}
+
+func followWatchStream(lb *LoadBalancer, app int, watchURL string, idleTimeout time.Duration) error {
+
+	// give up on the stream if not even a heartbeat arrives for idleTimeout
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	idleTimer := time.AfterFunc(idleTimeout, cancel)
+	defer idleTimer.Stop()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, watchURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if version := lb.GetEndpointVersion(); version > 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatInt(version, 10))
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("controller responded with %d", res.StatusCode)
+	}
+
+	isFirstEvent := true
+	var data strings.Builder
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		idleTimer.Reset(idleTimeout)
+
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data:") {
+			data.WriteString(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+			continue
+		}
+		if line != "" || data.Len() == 0 {
+			// ids, event types, retries and comments need no handling
+			continue
+		}
+
+		// an empty line ends the event
+		var assignment controllerAssignment
+		err := json.Unmarshal([]byte(data.String()), &assignment)
+		data.Reset()
+		if err == nil {
+			err = checkAssignment(assignment)
+		}
+		if err != nil {
+			log.Printf("Watch: ignoring invalid assignment: %s\n", err)
+			continue
+		}
+
+		version, ok := lb.SetEndpoints(assignment.Version, getEndpointsFromURLs(assignment.Endpoints, app), assignment.Weights, isFirstEvent)
+		if !ok {
+			log.Printf("Watch: ignoring stale version %d (have version %d)\n", assignment.Version, version)
+		}
+		isFirstEvent = false
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream closed")
+}
@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func forwardReq(
@@ -33,10 +35,16 @@ func forwardReq(
 	req.Body = io.NopCloser(bytes.NewReader(body))
 
 	endpoint := lb.GetEndpointForReq(reqNum)
+	if endpoint.URL == "" {
+		http.Error(w, "no endpoints yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	address := getEndpointHostPort(endpoint)
 
 	// create a new url from the raw RequestURI sent by the client
-	url := fmt.Sprintf("http://%s:3000/?loopCount=%s&base=%s&exp=%s",
-		endpoint.URL, loopCount, base, exp)
+	url := fmt.Sprintf("http://%s/?loopCount=%s&base=%s&exp=%s",
+		address, loopCount, base, exp)
 
 	proxyReq, err := http.NewRequest(req.Method, url, bytes.NewReader(body))
 	if err != nil {
@@ -51,13 +59,16 @@ func forwardReq(
 		proxyReq.Header[h] = val
 	}
 
+	startedAt := time.Now()
 	resp, err := http.DefaultClient.Do(proxyReq)
 	if err != nil {
+		lb.healthReporter.Record(address, time.Since(startedAt), true)
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
 
 	resBody, err := io.ReadAll(resp.Body)
+	lb.healthReporter.Record(address, time.Since(startedAt), err != nil || resp.StatusCode >= 500)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -76,6 +87,15 @@ type Endpoint struct {
 	App  int    `json:"app"`
 }
 
+// getEndpointHostPort returns the address of an endpoint, on port 3000
+// unless it has its own port
+func getEndpointHostPort(endpoint Endpoint) string {
+	if _, _, err := net.SplitHostPort(endpoint.URL); err == nil {
+		return endpoint.URL
+	}
+	return fmt.Sprintf("%s:3000", endpoint.URL)
+}
+
 func check(err error) {
 	if err != nil {
 		panic(err)
@@ -118,25 +138,47 @@ func main() {
 
 	portToListenOn := 3000
 
-	endpoints := getEndpoints()
+	// with the CONTROLLER and WEIGHTED algorithms the endpoints come from the
+	// central controller, so IPS is optional
+	isControlled := os.Getenv("LB_ALGO") == "CONTROLLER" || os.Getenv("LB_ALGO") == "WEIGHTED"
+
+	endpoints := make([]Endpoint, 0)
+	if !isControlled || os.Getenv("IPS") != "" {
+		endpoints = getEndpoints()
+	}
 
 	// print endpoints
 	fmt.Println("Endpoints:", endpoints)
 
 	// set load balancer algorithm
 	loadBalancerAlgo := "NONE"
-	if len(endpoints) > 1 {
+	if isControlled {
+		loadBalancerAlgo = os.Getenv("LB_ALGO")
+	} else if len(endpoints) > 1 {
 		loadBalancerAlgo = "LEAST_REQUEST"
 	}
 	fmt.Printf("Load balancer algorithm: %s\n", loadBalancerAlgo)
 
 	// start the load balancer
+	weightRampMs, err := strconv.Atoi(getEnvWithDefault("WEIGHT_RAMP_MS", "2000"))
+	check(err)
+
 	lb := LoadBalancer{
 		loadBalancerAlgo: loadBalancerAlgo,
 		endpoints:        endpoints,
+		weightRamp:       time.Duration(weightRampMs) * time.Millisecond,
+		healthReporter:   getHealthReporter(),
 	}
 	lb.StartLoadBalancer()
 
+	if lb.healthReporter != nil {
+		go lb.healthReporter.Run()
+	}
+
+	if isControlled {
+		startControl(&lb)
+	}
+
 	reqNum := 0
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -148,3 +190,34 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+/*
+startControl lets the central controller set the endpoints:
+  - CONTROL_PORT:            port of the control endpoint, default 3001 (the controller pushes to <LB host>:3001 unless the LB has a controlAddress)
+  - CONTROLLER_WATCH_URL:    watch stream to follow, e.g. http://cc:3000/watch?lb=<name> (optional)
+  - WATCH_IDLE_TIMEOUT_MS:   time without anything on the stream after which we reconnect, default 45000
+
+(WEIGHT_RAMP_MS, default 2000, is how long the WEIGHTED algorithm takes to
+move to new weights)
+*/
+func startControl(lb *LoadBalancer) {
+
+	app, _ := strconv.Atoi(os.Getenv("APP"))
+
+	controlPort, err := strconv.Atoi(getEnvWithDefault("CONTROL_PORT", "3001"))
+	check(err)
+	go serveControlEndpoint(lb, app, controlPort)
+
+	if watchURL := os.Getenv("CONTROLLER_WATCH_URL"); watchURL != "" {
+		idleTimeoutMs, err := strconv.Atoi(getEnvWithDefault("WATCH_IDLE_TIMEOUT_MS", "45000"))
+		check(err)
+		go watchController(lb, app, watchURL, time.Duration(idleTimeoutMs)*time.Millisecond)
+	}
+}
+
+func getEnvWithDefault(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}